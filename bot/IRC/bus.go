@@ -0,0 +1,229 @@
+package IRC
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow decides what happens to an event when a subscriber's buffer is
+// full
+type Overflow int
+
+const (
+	// OverflowBlock waits for the subscriber to make room, which holds up
+	// reading from the server, it suits subscribers that must see every
+	// event
+	OverflowBlock Overflow = iota
+	// OverflowDropNewest drops the event that does not fit
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest event in the buffer to make room
+	OverflowDropOldest
+	// OverflowWait waits up to SubscribeOptions.Wait for the subscriber to
+	// make room, then drops the event. Once it has dropped one, events are
+	// dropped without waiting until the subscriber has emptied half of its
+	// buffer, so that a stalled subscriber holds up the reader only once.
+	OverflowWait
+)
+
+// defaultOverflowWait is how long OverflowWait waits when no Wait is given
+const defaultOverflowWait = time.Second
+
+// defaultSubscriberBuffer is the buffer a subscriber gets when it does not ask
+// for one
+const defaultSubscriberBuffer = 100
+
+// SubscribeOptions tune a subscription
+type SubscribeOptions struct {
+	// Buffer is how many events can wait for the subscriber
+	Buffer int
+	// Overflow is what happens when the buffer is full
+	Overflow Overflow
+	// Wait is how long OverflowWait waits for room
+	Wait time.Duration
+	// Types limits the subscription to events of these types, eg EventJoin,
+	// all events are sent when it is empty
+	Types []string
+}
+
+// Subscription receives events from the service on C, which is closed when
+// the subscription ends
+type Subscription struct {
+	C <-chan Event
+
+	c        chan Event
+	overflow Overflow
+	wait     time.Duration
+	types    map[string]struct{}
+	dropped  uint64
+	// behind is 1 while OverflowWait is dropping events
+	behind uint32
+	// done is closed on Unsubscribe, to free a publisher that is blocked
+	// on a full buffer, and m keeps c from being closed while one is
+	// sending
+	done   chan struct{}
+	once   sync.Once
+	m      sync.RWMutex
+	closed bool
+}
+
+// Dropped returns how many events the subscriber missed because its buffer
+// was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+func (sub *Subscription) wants(ev Event) bool {
+	if len(sub.types) == 0 {
+		return true
+	}
+	_, ok := sub.types[ev.Info().Type]
+	return ok
+}
+
+// deliver sends the event to the subscriber as its overflow policy says
+func (sub *Subscription) deliver(ev Event) {
+	sub.m.RLock()
+	defer sub.m.RUnlock()
+	if sub.closed || !sub.wants(ev) {
+		return
+	}
+	if atomic.LoadUint32(&sub.behind) == 1 {
+		if len(sub.c) > cap(sub.c)/2 {
+			atomic.AddUint64(&sub.dropped, 1)
+			return
+		}
+		if atomic.CompareAndSwapUint32(&sub.behind, 1, 0) {
+			log.Printf("Subscriber caught up, %d events were dropped", sub.Dropped())
+		}
+	}
+	select {
+	case sub.c <- ev:
+		return
+	default:
+	}
+	switch sub.overflow {
+	case OverflowDropNewest:
+		atomic.AddUint64(&sub.dropped, 1)
+	case OverflowDropOldest:
+		// the subscriber may be reading at the same time, so there may
+		// be room without dropping anything
+		select {
+		case <-sub.c:
+			atomic.AddUint64(&sub.dropped, 1)
+		default:
+		}
+		select {
+		case sub.c <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	case OverflowWait:
+		t := time.NewTimer(sub.wait)
+		defer t.Stop()
+		select {
+		case sub.c <- ev:
+		case <-sub.done:
+		case <-t.C:
+			log.Printf("Subscriber buffer stayed full for %v, dropping events until it catches up", sub.wait)
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.StoreUint32(&sub.behind, 1)
+		}
+	default:
+		select {
+		case sub.c <- ev:
+		case <-sub.done:
+		}
+	}
+}
+
+// end closes the subscription, once
+func (sub *Subscription) end() {
+	sub.once.Do(func() {
+		close(sub.done)
+		sub.m.Lock()
+		defer sub.m.Unlock()
+		sub.closed = true
+		close(sub.c)
+	})
+}
+
+// bus hands the events of the service to each subscriber
+type bus struct {
+	m      sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newBus() *bus {
+	return &bus{subs: map[*Subscription]struct{}{}}
+}
+
+func (b *bus) publish(ev Event) {
+	b.m.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.m.RUnlock()
+	for _, sub := range subs {
+		sub.deliver(ev)
+	}
+}
+
+// close ends every subscription, no events are published after it
+func (b *bus) close() {
+	b.m.Lock()
+	b.closed = true
+	subs := b.subs
+	b.subs = map[*Subscription]struct{}{}
+	b.m.Unlock()
+	for sub := range subs {
+		sub.end()
+	}
+}
+
+// Subscribe returns a subscription to the events of the service. A
+// subscription taken once Run has returned is already closed.
+func (s *service) Subscribe(opts SubscribeOptions) *Subscription {
+	size := opts.Buffer
+	if size <= 0 {
+		size = defaultSubscriberBuffer
+	}
+	wait := opts.Wait
+	if wait <= 0 {
+		wait = defaultOverflowWait
+	}
+	c := make(chan Event, size)
+	sub := &Subscription{
+		C:        c,
+		c:        c,
+		overflow: opts.Overflow,
+		wait:     wait,
+		types:    map[string]struct{}{},
+		done:     make(chan struct{}),
+	}
+	for _, t := range opts.Types {
+		sub.types[t] = struct{}{}
+	}
+	s.bus.m.Lock()
+	closed := s.bus.closed
+	if !closed {
+		s.bus.subs[sub] = struct{}{}
+	}
+	s.bus.m.Unlock()
+	if closed {
+		sub.end()
+	}
+	return sub
+}
+
+// Unsubscribe ends the subscription and closes its C, events still in the
+// buffer can be read
+func (s *service) Unsubscribe(sub *Subscription) {
+	s.bus.m.Lock()
+	delete(s.bus.subs, sub)
+	s.bus.m.Unlock()
+	sub.end()
+}
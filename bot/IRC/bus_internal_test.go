@@ -0,0 +1,121 @@
+package IRC
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	testcases := map[string]struct {
+		opts     SubscribeOptions
+		sent     []string
+		expected []string
+		dropped  uint64
+	}{
+		"every event": {
+			opts:     SubscribeOptions{Buffer: 5},
+			sent:     []string{EventJoin, EventMessage, EventPart},
+			expected: []string{EventJoin, EventMessage, EventPart},
+		},
+		"only some types": {
+			opts:     SubscribeOptions{Buffer: 5, Types: []string{EventJoin, EventPart}},
+			sent:     []string{EventJoin, EventMessage, EventPart, EventTopic},
+			expected: []string{EventJoin, EventPart},
+		},
+		"drop the newest": {
+			opts:     SubscribeOptions{Buffer: 2, Overflow: OverflowDropNewest},
+			sent:     []string{EventJoin, EventMessage, EventPart, EventTopic},
+			expected: []string{EventJoin, EventMessage},
+			dropped:  2,
+		},
+		"wait then drop until caught up": {
+			opts:     SubscribeOptions{Buffer: 2, Overflow: OverflowWait, Wait: time.Millisecond},
+			sent:     []string{EventJoin, EventMessage, EventPart, EventTopic},
+			expected: []string{EventJoin, EventMessage},
+			dropped:  2,
+		},
+		"drop the oldest": {
+			opts:     SubscribeOptions{Buffer: 2, Overflow: OverflowDropOldest},
+			sent:     []string{EventJoin, EventMessage, EventPart, EventTopic},
+			expected: []string{EventPart, EventTopic},
+			dropped:  2,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			sub := s.Subscribe(tc.opts)
+			for _, typ := range tc.sent {
+				s.send(EventInfo{Type: typ, Channel: "#fake-channel"})
+			}
+			s.Unsubscribe(sub)
+			got := []string{}
+			for ev := range sub.C {
+				got = append(got, ev.Info().Type)
+			}
+			assert.Equal(t, tc.expected, got)
+			assert.Equal(t, tc.dropped, sub.Dropped())
+		})
+	}
+}
+
+func TestSubscribersAreIndependent(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.Network = "fake-network"
+	slow := s.Subscribe(SubscribeOptions{Buffer: 1, Overflow: OverflowDropNewest})
+	fast := s.Subscribe(SubscribeOptions{Buffer: 5})
+	s.send(JoinEvent{EventInfo: s.info(EventJoin, "#fake-channel", "", "", Message{})})
+	s.send(PartEvent{EventInfo: s.info(EventPart, "#fake-channel", "", "", Message{}), Reason: "bye"})
+
+	join := JoinEvent{EventInfo: EventInfo{Type: EventJoin, Network: "fake-network", Channel: "#fake-channel"}}
+	assert.Equal(t, join, <-fast.C)
+	assert.Equal(t, PartEvent{EventInfo: EventInfo{Type: EventPart, Network: "fake-network", Channel: "#fake-channel"}, Reason: "bye"}, <-fast.C)
+	assert.Equal(t, join, <-slow.C)
+	assert.Equal(t, uint64(1), slow.Dropped())
+
+	// nothing more is sent once unsubscribed
+	s.Unsubscribe(fast)
+	s.send(EventInfo{Type: EventTopic})
+	_, ok := <-fast.C
+	assert.False(t, ok)
+	assert.Equal(t, EventTopic, (<-slow.C).Info().Type)
+}
+
+func TestUnsubscribeFreesBlockedSend(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	sub := s.Subscribe(SubscribeOptions{Buffer: 1})
+	s.send(EventInfo{Type: EventJoin})
+	sent := make(chan struct{})
+	go func() {
+		s.send(EventInfo{Type: EventPart})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send did not wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.Unsubscribe(sub)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send was not freed by Unsubscribe")
+	}
+	assert.Equal(t, EventJoin, (<-sub.C).Info().Type)
+}
+
+func TestSubscribeAfterClose(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	before := s.Subscribe(SubscribeOptions{})
+	s.bus.close()
+	after := s.Subscribe(SubscribeOptions{})
+	s.send(EventInfo{Type: EventJoin})
+	_, ok := <-before.C
+	assert.False(t, ok)
+	_, ok = <-after.C
+	assert.False(t, ok)
+	// unsubscribing a closed subscription is harmless
+	s.Unsubscribe(after)
+}
@@ -0,0 +1,136 @@
+package IRC
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Charset is the encoding that lines which are not valid UTF-8 are decoded
+// from
+type Charset string
+
+// The charsets older clients commonly send
+const (
+	CharsetLatin1      Charset = "iso-8859-1"
+	CharsetLatin9      Charset = "iso-8859-15"
+	CharsetWindows1252 Charset = "windows-1252"
+)
+
+// defaultCharset is used when no charset is configured, windows-1252 is what
+// most clients that are not sending UTF-8 send, and it agrees with latin-1 on
+// every printable character latin-1 has
+const defaultCharset = CharsetWindows1252
+
+var charsetNames = map[string]Charset{
+	"iso-8859-1":   CharsetLatin1,
+	"iso8859-1":    CharsetLatin1,
+	"latin1":       CharsetLatin1,
+	"latin-1":      CharsetLatin1,
+	"iso-8859-15":  CharsetLatin9,
+	"iso8859-15":   CharsetLatin9,
+	"latin9":       CharsetLatin9,
+	"latin-9":      CharsetLatin9,
+	"windows-1252": CharsetWindows1252,
+	"cp1252":       CharsetWindows1252,
+}
+
+// ParseCharset converts a charset name, eg latin1 or cp1252, to a Charset
+func ParseCharset(name string) (Charset, error) {
+	c, ok := charsetNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return "", fmt.Errorf("unknown charset %q, expected one of iso-8859-1, iso-8859-15 or windows-1252", name)
+	}
+	return c, nil
+}
+
+// windows1252 holds the characters windows-1252 puts in 0x80 to 0x9f, where
+// latin-1 has control codes. The five bytes it leaves undefined keep their
+// control codes.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// latin9 holds the characters iso-8859-15 replaced in latin-1
+var latin9 = map[byte]rune{
+	0xa4: '€',
+	0xa6: 'Š',
+	0xa8: 'š',
+	0xb4: 'Ž',
+	0xb8: 'ž',
+	0xbc: 'Œ',
+	0xbd: 'œ',
+	0xbe: 'Ÿ',
+}
+
+// rune decodes a single byte
+func (c Charset) rune(b byte) rune {
+	switch c {
+	case CharsetWindows1252:
+		if b >= 0x80 && b < 0xa0 {
+			return windows1252[b-0x80]
+		}
+	case CharsetLatin9:
+		if r, ok := latin9[b]; ok {
+			return r
+		}
+	}
+	// latin-1 is the first 256 code points
+	return rune(b)
+}
+
+// Decode returns text as UTF-8. Only the bytes that are not part of a valid
+// UTF-8 sequence are decoded with the charset, so that a line mixing the
+// two, eg a UTF-8 nick quoting a latin-1 one, keeps both readable.
+func (c Charset) Decode(text string) string {
+	if utf8.ValidString(text) {
+		return text
+	}
+	var b strings.Builder
+	b.Grow(len(text) + len(text)/2)
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == utf8.RuneError && size == 1 {
+			r = c.rune(text[i])
+		}
+		b.WriteRune(r)
+		i += size
+	}
+	return b.String()
+}
+
+// decodeLine makes a line read from the server valid UTF-8, with the charset
+// of the channel it was sent to or else the charset of the network. The
+// charset is returned when the line had to be decoded.
+func (s *service) decodeLine(line string) (string, Charset) {
+	if utf8.ValidString(line) {
+		return line, ""
+	}
+	charset := s.charsetFor("")
+	// the target is ASCII in all but the oddest channel names, so it can
+	// be found before the line is decoded
+	if msg, err := ParseMessage(line); err == nil && s.isChannel(msg.Target()) {
+		charset = s.charsetFor(msg.Target())
+	}
+	return charset.Decode(line), charset
+}
+
+// charsetFor returns the charset for lines sent to the channel
+func (s *service) charsetFor(channel string) Charset {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if channel != "" {
+		for name, c := range s.ChannelCharsets {
+			if s.support.Equal(name, channel) {
+				return c
+			}
+		}
+	}
+	if s.Charset != "" {
+		return s.Charset
+	}
+	return defaultCharset
+}
@@ -0,0 +1,131 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCharset(t *testing.T) {
+	testcases := map[string]struct {
+		name     string
+		expected Charset
+		err      string
+	}{
+		"latin1":       {name: "latin1", expected: CharsetLatin1},
+		"iso name":     {name: "ISO-8859-1", expected: CharsetLatin1},
+		"latin9":       {name: "iso-8859-15", expected: CharsetLatin9},
+		"cp1252":       {name: "CP1252", expected: CharsetWindows1252},
+		"windows-1252": {name: " windows-1252 ", expected: CharsetWindows1252},
+		"unknown": {
+			name: "koi8-r",
+			err:  `unknown charset "koi8-r", expected one of iso-8859-1, iso-8859-15 or windows-1252`,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ParseCharset(tc.name)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, c)
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	testcases := map[string]struct {
+		charset  Charset
+		input    string
+		expected string
+	}{
+		"utf-8 is left alone": {
+			charset:  CharsetLatin1,
+			input:    "caf\xc3\xa9 \xe2\x82\xac",
+			expected: "café €",
+		},
+		"latin1": {
+			charset:  CharsetLatin1,
+			input:    "caf\xe9 \x80",
+			expected: "café \u0080",
+		},
+		"windows-1252": {
+			charset:  CharsetWindows1252,
+			input:    "caf\xe9 \x80 \x93quoted\x94 \x81",
+			expected: "café € “quoted” \u0081",
+		},
+		"latin9": {
+			charset:  CharsetLatin9,
+			input:    "\xa4 \xbd \xe9",
+			expected: "€ œ é",
+		},
+		"mixed with utf-8": {
+			charset:  CharsetWindows1252,
+			input:    "n\xc3\xa9e said caf\xe9",
+			expected: "née said café",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.charset.Decode(tc.input))
+		})
+	}
+}
+
+func TestDecodeLine(t *testing.T) {
+	testcases := map[string]struct {
+		charset  Charset
+		channels map[string]Charset
+		input    string
+		text     string
+		decoded  Charset
+	}{
+		"utf-8": {
+			input: ":fake-nick!~fake@host PRIVMSG #fake-channel :caf\xc3\xa9",
+			text:  "café",
+		},
+		"network default": {
+			input:   ":fake-nick!~fake@host PRIVMSG #fake-channel :\x93caf\xe9\x94",
+			text:    "“café”",
+			decoded: CharsetWindows1252,
+		},
+		"network charset": {
+			charset: CharsetLatin9,
+			input:   ":fake-nick!~fake@host PRIVMSG #fake-channel :\xa4",
+			text:    "€",
+			decoded: CharsetLatin9,
+		},
+		"channel charset": {
+			charset:  CharsetLatin9,
+			channels: map[string]Charset{"#Fake-Channel": CharsetLatin1},
+			input:    ":fake-nick!~fake@host PRIVMSG #fake-channel :\xa4",
+			text:     "¤",
+			decoded:  CharsetLatin1,
+		},
+		"other channels use the network charset": {
+			charset:  CharsetLatin9,
+			channels: map[string]Charset{"#other-channel": CharsetLatin1},
+			input:    ":fake-nick!~fake@host PRIVMSG #fake-channel :\xa4",
+			text:     "€",
+			decoded:  CharsetLatin9,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Charset = tc.charset
+			s.ChannelCharsets = tc.channels
+			s.processLine(tc.input)
+			ev := (<-out).Info()
+			assert.Equal(t, EventMessage, ev.Type)
+			assert.Equal(t, tc.text, ev.Text)
+			assert.Equal(t, tc.decoded, ev.Message.Charset)
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package IRC
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Permission is who may run a command
+type Permission int
+
+const (
+	// PermissionOwner commands can only be run by a verified owner
+	PermissionOwner Permission = iota
+	// PermissionAnyone commands can be run by anyone who messages the bot
+	PermissionAnyone
+)
+
+// CommandRequest is a command sent to the bot in a direct message
+type CommandRequest struct {
+	// Name is the command, as it was looked up
+	Name string
+	// Args are the words that followed the command
+	Args []string
+	// Source is who sent the command, Account their services account, if
+	// known
+	Source  Source
+	Account string
+	// Owner is set when the sender is a verified owner
+	Owner bool
+
+	s *service
+}
+
+// Reply sends text back to whoever sent the command. Commands run on the
+// reader, so the reply is queued without waiting for it to be sent.
+func (r CommandRequest) Reply(format string, args ...interface{}) error {
+	return r.s.tell(r.Source.Nick, fmt.Sprintf(format, args...))
+}
+
+// Command is a bot command that can be run over direct message
+type Command struct {
+	// Name is the first word of the message that runs the command, it is
+	// matched ignoring case
+	Name string
+	// Usage describes the arguments, eg `<channel> [key]`, and Help what
+	// the command does, both are shown by help
+	Usage string
+	Help  string
+	// MinArgs and MaxArgs bound the number of arguments, a MaxArgs of -1
+	// means there is no limit
+	MinArgs int
+	MaxArgs int
+	// Permission is who may run the command, the zero value is owner only
+	Permission Permission
+	// Run carries out the command, an error is reported back to the sender
+	Run func(req CommandRequest) error
+}
+
+// commands is the registry of the commands the bot answers
+type commands struct {
+	m      sync.RWMutex
+	byName map[string]Command
+}
+
+func newCommands() *commands {
+	return &commands{byName: map[string]Command{}}
+}
+
+func (c *commands) lookup(name string) (Command, bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	cmd, ok := c.byName[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// list returns the commands in name order
+func (c *commands) list() []Command {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	list := make([]Command, 0, len(c.byName))
+	for _, cmd := range c.byName {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// RegisterCommand adds a command to those the bot answers over direct message
+func (s *service) RegisterCommand(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " \r\n") {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("command %q has nothing to run", cmd.Name)
+	}
+	if cmd.MinArgs < 0 || (cmd.MaxArgs >= 0 && cmd.MaxArgs < cmd.MinArgs) {
+		return fmt.Errorf("command %q has invalid argument bounds %d to %d", cmd.Name, cmd.MinArgs, cmd.MaxArgs)
+	}
+	name := strings.ToLower(cmd.Name)
+	s.commands.m.Lock()
+	defer s.commands.m.Unlock()
+	if _, ok := s.commands.byName[name]; ok {
+		return fmt.Errorf("command %q is already registered", cmd.Name)
+	}
+	cmd.Name = name
+	s.commands.byName[name] = cmd
+	return nil
+}
+
+// runCommand runs the command in a direct message. It reports whether the
+// message was a command at all, messages that are not are passed on to the
+// owner.
+func (s *service) runCommand(msg Message, account string, owner bool) bool {
+	fields := strings.Fields(msg.Trailing)
+	if len(fields) == 0 {
+		return false
+	}
+	cmd, ok := s.commands.lookup(fields[0])
+	if !ok {
+		if owner {
+			s.replyTo(msg.Source, "unknown command %q, try help", fields[0])
+		}
+		return owner
+	}
+	if cmd.Permission == PermissionOwner && !owner {
+		log.Printf("AUDIT rejected command %q from %s (account %q), not a verified owner", msg.Trailing, msg.Source, account)
+		return true
+	}
+	args := fields[1:]
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		s.replyTo(msg.Source, "usage: %s", usage(cmd))
+		return true
+	}
+	req := CommandRequest{
+		Name:    cmd.Name,
+		Args:    args,
+		Source:  msg.Source,
+		Account: account,
+		Owner:   owner,
+		s:       s,
+	}
+	if err := cmd.Run(req); err != nil {
+		log.Printf("Command %q from %s failed %v", msg.Trailing, msg.Source, err)
+		s.replyTo(msg.Source, "%s failed: %v", cmd.Name, err)
+	}
+	return true
+}
+
+func (s *service) replyTo(src Source, format string, args ...interface{}) {
+	if err := s.tell(src.Nick, fmt.Sprintf(format, args...)); err != nil {
+		log.Printf("Error replying to %s %v", src, err)
+	}
+}
+
+func usage(cmd Command) string {
+	if cmd.Usage == "" {
+		return cmd.Name
+	}
+	return cmd.Name + " " + cmd.Usage
+}
+
+// registerBuiltins adds the commands every bot has
+func (s *service) registerBuiltins() {
+	builtins := []Command{
+		{
+			Name:       "help",
+			Usage:      "[command]",
+			Help:       "lists the commands, or describes one",
+			MaxArgs:    1,
+			Permission: PermissionAnyone,
+			Run:        s.helpCommand,
+		},
+		{
+			Name:    "join",
+			Usage:   "<channel> [key]",
+			Help:    "joins a channel",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Run: func(req CommandRequest) error {
+				s.queueJoin(strings.Join(req.Args, " "))
+				return nil
+			},
+		},
+		{
+			Name:    "part",
+			Usage:   "<channel>",
+			Help:    "leaves a channel",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: func(req CommandRequest) error {
+				s.queuePart(req.Args[0])
+				return nil
+			},
+		},
+		{
+			Name:    "say",
+			Usage:   "<target> <text>",
+			Help:    "says the text to a channel or nick",
+			MinArgs: 2,
+			MaxArgs: -1,
+			Run: func(req CommandRequest) error {
+				return s.tell(req.Args[0], strings.Join(req.Args[1:], " "))
+			},
+		},
+		{
+			Name: "channels",
+			Help: "lists the channels the bot is in, and why not for those it cannot join",
+			Run: func(req CommandRequest) error {
+				channels := s.channelList()
+				if len(channels) == 0 {
+					return req.Reply("not in any channels")
+				}
+				for i, c := range channels {
+					if status, ok := s.ChannelStatus(strings.Fields(c)[0]); ok && status.Status != ChannelJoined {
+						channels[i] = fmt.Sprintf("%s (%s)", c, status.Status)
+					}
+				}
+				return req.Reply("%s", strings.Join(channels, " "))
+			},
+		},
+		{
+			Name: "status",
+			Help: "shows the connection status",
+			Run: func(req CommandRequest) error {
+				state := "registering"
+				select {
+				case <-s.Ready():
+					state = "ready"
+				default:
+				}
+				lag := "unknown"
+				if l := s.Lag(); l > 0 {
+					lag = l.Round(time.Millisecond).String()
+				}
+				return req.Reply("%s on %s (%s) as %s, in %d channels, lag %s",
+					state, s.Network, s.server, s.CurrentNick(), len(s.channelList()), lag)
+			},
+		},
+		{
+			Name:    "nick",
+			Usage:   "<nick>",
+			Help:    "changes the nick of the bot",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: func(req CommandRequest) error {
+				s.enqueue(PriorityNormal, "NICK %s", req.Args[0])
+				return nil
+			},
+		},
+		{
+			Name:    "quit",
+			Usage:   "[reason]",
+			Help:    "disconnects from the network, without reconnecting",
+			MaxArgs: -1,
+			Run: func(req CommandRequest) error {
+				return s.quit(strings.Join(req.Args, " "))
+			},
+		},
+		{
+			Name:    "raw",
+			Usage:   "<line>",
+			Help:    "sends a line to the server as it is",
+			MinArgs: 1,
+			MaxArgs: -1,
+			Run: func(req CommandRequest) error {
+				line := strings.Join(req.Args, " ")
+				log.Printf("AUDIT raw line %q from %s", line, req.Source)
+				s.enqueue(PriorityNormal, "%s", line)
+				return nil
+			},
+		},
+	}
+	builtins = append(builtins, s.inviteCommands()...)
+	for _, cmd := range builtins {
+		if err := s.RegisterCommand(cmd); err != nil {
+			// the builtins are fixed, so this is a programming error
+			panic(err)
+		}
+	}
+}
+
+// helpCommand lists the commands the sender may run, or describes one of them
+func (s *service) helpCommand(req CommandRequest) error {
+	if len(req.Args) == 1 {
+		cmd, ok := s.commands.lookup(req.Args[0])
+		if !ok || (cmd.Permission == PermissionOwner && !req.Owner) {
+			return req.Reply("unknown command %q", req.Args[0])
+		}
+		return req.Reply("%s - %s", usage(cmd), cmd.Help)
+	}
+	names := []string{}
+	for _, cmd := range s.commands.list() {
+		if cmd.Permission == PermissionOwner && !req.Owner {
+			continue
+		}
+		names = append(names, cmd.Name)
+	}
+	return req.Reply("commands: %s, try help <command>", strings.Join(names, ", "))
+}
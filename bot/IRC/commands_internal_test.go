@@ -0,0 +1,174 @@
+package IRC
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommands(t *testing.T) {
+	owner := ":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :"
+	other := ":fake-nick!~fake-name@user/fake-nick PRIVMSG fake-user :"
+	testcases := map[string]struct {
+		input     string
+		writeHold []string
+		quitting  bool
+	}{
+		"bare join shows the usage": {
+			input:     owner + "join",
+			writeHold: []string{"PRIVMSG fake-owner :usage: join <channel> [key]\r\n"},
+		},
+		"join with a key": {
+			input:     owner + "JOIN #fake-channel fake-key",
+			writeHold: []string{"JOIN #fake-channel fake-key\r\n"},
+		},
+		"too many arguments": {
+			input:     owner + "part #fake-channel #second-fake-channel",
+			writeHold: []string{"PRIVMSG fake-owner :usage: part <channel>\r\n"},
+		},
+		"say": {
+			input:     owner + "say #fake-channel fake  message",
+			writeHold: []string{"PRIVMSG #fake-channel :fake message\r\n"},
+		},
+		"unknown command from the owner": {
+			input:     owner + "dance",
+			writeHold: []string{"PRIVMSG fake-owner :unknown command \"dance\", try help\r\n"},
+		},
+		"help for the owner": {
+			input:     owner + "help",
+			writeHold: []string{"PRIVMSG fake-owner :commands: accept, channels, decline, help, invites, join, nick, part, quit, raw, say, status, try help <command>\r\n"},
+		},
+		"help for a command": {
+			input:     owner + "help join",
+			writeHold: []string{"PRIVMSG fake-owner :join <channel> [key] - joins a channel\r\n"},
+		},
+		"help for anyone else": {
+			input:     other + "help",
+			writeHold: []string{"PRIVMSG fake-nick :commands: help, try help <command>\r\n"},
+		},
+		"help does not describe owner commands to anyone else": {
+			input:     other + "help raw",
+			writeHold: []string{"PRIVMSG fake-nick :unknown command \"raw\"\r\n"},
+		},
+		"owner commands from anyone else are rejected": {
+			input: other + "raw PRIVMSG #fake-channel :hi",
+		},
+		"channels": {
+			input:     owner + "channels",
+			writeHold: []string{"PRIVMSG fake-owner :#fake-channel #second-fake-channel\r\n"},
+		},
+		"nick": {
+			input:     owner + "nick fake-new",
+			writeHold: []string{"NICK fake-new\r\n"},
+		},
+		"raw": {
+			input:     owner + "raw MODE #fake-channel +m",
+			writeHold: []string{"MODE #fake-channel +m\r\n"},
+		},
+		"quit": {
+			input:     owner + "quit going away",
+			writeHold: []string{"QUIT :going away\r\n"},
+			quitting:  true,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{"#fake-channel", "#second-fake-channel"})
+			s.connection = &fakeConn{}
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			writeErr = nil
+			closeErr = nil
+			writeHold = []string{}
+			s.processLine(tc.input)
+			if tc.quitting {
+				// the QUIT is sent by another goroutine, once stopping
+				// is closed shutdown only returns when that has finished
+				<-s.stopping
+				_ = s.shutdown("")
+			}
+			s.sendQueue().drain()
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			assert.Equal(t, tc.quitting, s.quitting)
+		})
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	run := func(req CommandRequest) error { return nil }
+	testcases := map[string]struct {
+		cmd    Command
+		outErr error
+	}{
+		"new command": {
+			cmd: Command{Name: "Dance", Run: run},
+		},
+		"no name": {
+			cmd:    Command{Run: run},
+			outErr: fmt.Errorf("invalid command name \"\""),
+		},
+		"name with a space": {
+			cmd:    Command{Name: "fake command", Run: run},
+			outErr: fmt.Errorf("invalid command name \"fake command\""),
+		},
+		"nothing to run": {
+			cmd:    Command{Name: "dance"},
+			outErr: fmt.Errorf("command \"dance\" has nothing to run"),
+		},
+		"bad argument bounds": {
+			cmd:    Command{Name: "dance", MinArgs: 2, MaxArgs: 1, Run: run},
+			outErr: fmt.Errorf("command \"dance\" has invalid argument bounds 2 to 1"),
+		},
+		"already registered": {
+			cmd:    Command{Name: "JOIN", Run: run},
+			outErr: fmt.Errorf("command \"JOIN\" is already registered"),
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			err := s.RegisterCommand(tc.cmd)
+			if tc.outErr == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tc.outErr.Error())
+			}
+		})
+	}
+}
+
+func TestCustomCommand(t *testing.T) {
+	s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.Username = "fake-user"
+	writeErr = nil
+	writeHold = []string{}
+	err := s.RegisterCommand(Command{
+		Name:       "echo",
+		Usage:      "<text>",
+		MinArgs:    1,
+		MaxArgs:    -1,
+		Permission: PermissionAnyone,
+		Run: func(req CommandRequest) error {
+			if req.Args[0] == "fail" {
+				return fmt.Errorf("fake-error")
+			}
+			return req.Reply("%s said %v", req.Source.Nick, req.Args)
+		},
+	})
+	assert.Nil(t, err)
+	s.processLine(":fake-nick!~u@some.host PRIVMSG fake-user :echo hello there")
+	s.sendQueue().drain()
+	s.processLine(":fake-nick!~u@some.host PRIVMSG fake-user :echo fail")
+	s.sendQueue().drain()
+	assert.Equal(t, []string{
+		"PRIVMSG fake-nick :fake-nick said [hello there]\r\n",
+		"PRIVMSG fake-nick :echo failed: fake-error\r\n",
+	}, writeHold)
+}
@@ -0,0 +1,139 @@
+package IRC
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What the bot says about itself in reply to CTCP VERSION and SOURCE
+const (
+	ctcpVersion = "fluentdrama IRC logger"
+	ctcpSource  = "https://github.com/mindfarm/fluentdrama"
+)
+
+// ctcpCommands are the CTCP queries the bot understands, as listed by
+// CLIENTINFO
+var ctcpCommands = []string{"ACTION", "CLIENTINFO", "PING", "SOURCE", "TIME", "VERSION"}
+
+// Replies to the queries in ctcpCommands are limited to a burst of ctcpBurst,
+// and then one every ctcpRate, so that the bot cannot be used to flood itself
+// off the network. Errors for queries it does not understand are held to the
+// tighter ctcpErrBurst and ctcpErrRate.
+const (
+	ctcpBurst    = 10
+	ctcpRate     = time.Second
+	ctcpErrBurst = 3
+	ctcpErrRate  = 5 * time.Second
+)
+
+// expose this as a package global to enable it to be faked for testing
+var timeNow = time.Now
+
+// ctcpDelim frames CTCP messages
+const ctcpDelim = "\x01"
+
+// parseCTCP decodes the \x01 framing of a CTCP message into its command and
+// parameters. The closing \x01 is optional, as not every client sends it.
+func parseCTCP(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, ctcpDelim) {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], ctcpDelim)
+	command, params := text, ""
+	if i := strings.Index(text, " "); i >= 0 {
+		command, params = text[:i], text[i+1:]
+	}
+	if command == "" {
+		return "", "", false
+	}
+	return strings.ToUpper(command), params, true
+}
+
+// ctcpQuote frames a CTCP command and its parameters
+func ctcpQuote(command, params string) string {
+	if params == "" {
+		return ctcpDelim + command + ctcpDelim
+	}
+	return ctcpDelim + command + " " + params + ctcpDelim
+}
+
+// ctcpAction extracts the text of a CTCP ACTION (/me)
+func ctcpAction(text string) (string, bool) {
+	command, params, ok := parseCTCP(text)
+	if !ok || command != "ACTION" {
+		return "", false
+	}
+	return params, true
+}
+
+// ctcpLimiter is a token bucket that paces CTCP replies
+type ctcpLimiter struct {
+	m      sync.Mutex
+	burst  float64
+	rate   time.Duration
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether a reply may be sent now, and uses up a token if so
+func (l *ctcpLimiter) allow() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := timeNow()
+	if l.last.IsZero() {
+		l.tokens = l.burst
+	} else {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.rate)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// handleCTCP answers a CTCP query sent to the bot with a NOTICE, queries sent
+// to a channel are ignored so that one query cannot make every bot in it
+// reply. ACTIONs are not queries, they are dispatched as events, or kept like
+// private messages when sent to the bot.
+func (s *service) handleCTCP(msg Message, command, params string) {
+	if command == "ACTION" {
+		if s.isMe(msg.Target()) {
+			s.handleDirect(msg)
+		} else {
+			s.dispatch(msg)
+		}
+		return
+	}
+	if !s.isMe(msg.Target()) {
+		return
+	}
+	limit := s.ctcpLimit
+	var reply string
+	switch command {
+	case "VERSION":
+		reply = ctcpVersion
+	case "SOURCE":
+		reply = ctcpSource
+	case "PING":
+		reply = params
+	case "TIME":
+		reply = timeNow().Format(time.RFC1123Z)
+	case "CLIENTINFO":
+		reply = strings.Join(ctcpCommands, " ")
+	default:
+		command, reply = "ERRMSG", strings.TrimSpace(command+" "+params)+" :unknown query"
+		limit = s.ctcpErrLimit
+	}
+	if !limit.allow() {
+		log.Printf("Dropped CTCP %s reply to %s, too many queries", command, msg.Source)
+		return
+	}
+	s.enqueue(PriorityLow, "NOTICE %s :%s", msg.Source.Nick, ctcpQuote(command, reply))
+}
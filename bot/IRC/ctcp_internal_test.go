@@ -0,0 +1,169 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCTCP(t *testing.T) {
+	testcases := map[string]struct {
+		input   string
+		command string
+		params  string
+		ok      bool
+	}{
+		"version":          {input: "\x01VERSION\x01", command: "VERSION", ok: true},
+		"with params":      {input: "\x01PING 12345\x01", command: "PING", params: "12345", ok: true},
+		"lower case":       {input: "\x01action waves\x01", command: "ACTION", params: "waves", ok: true},
+		"no closing delim": {input: "\x01ACTION waves", command: "ACTION", params: "waves", ok: true},
+		"not ctcp":         {input: "VERSION"},
+		"empty":            {input: "\x01\x01"},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			command, params, ok := parseCTCP(tc.input)
+			assert.Equal(t, tc.command, command)
+			assert.Equal(t, tc.params, params)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+func TestCTCPReplies(t *testing.T) {
+	now := time.Date(2021, 12, 20, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	testcases := map[string]struct {
+		input     string
+		writeHold []string
+		events    int
+	}{
+		"version": {
+			input:     ":fake-nick!u@h PRIVMSG fake-user :\x01VERSION\x01",
+			writeHold: []string{"NOTICE fake-nick :\x01VERSION fluentdrama IRC logger\x01\r\n"},
+		},
+		"source": {
+			input:     ":fake-nick!u@h PRIVMSG fake-user :\x01SOURCE\x01",
+			writeHold: []string{"NOTICE fake-nick :\x01SOURCE https://github.com/mindfarm/fluentdrama\x01\r\n"},
+		},
+		"ping": {
+			input:     ":fake-nick!u@h PRIVMSG fake-user :\x01PING 1639999999\x01",
+			writeHold: []string{"NOTICE fake-nick :\x01PING 1639999999\x01\r\n"},
+		},
+		"time": {
+			input:     ":fake-nick!u@h PRIVMSG fake-user :\x01TIME\x01",
+			writeHold: []string{"NOTICE fake-nick :\x01TIME Mon, 20 Dec 2021 12:00:00 +0000\x01\r\n"},
+		},
+		"clientinfo": {
+			input:     ":fake-nick!u@h PRIVMSG fake-user :\x01CLIENTINFO\x01",
+			writeHold: []string{"NOTICE fake-nick :\x01CLIENTINFO ACTION CLIENTINFO PING SOURCE TIME VERSION\x01\r\n"},
+		},
+		"unknown query": {
+			input:     ":fake-nick!u@h PRIVMSG fake-user :\x01FINGER\x01",
+			writeHold: []string{"NOTICE fake-nick :\x01ERRMSG FINGER :unknown query\x01\r\n"},
+		},
+		"channel query is not answered": {
+			input: ":fake-nick!u@h PRIVMSG #fake-channel :\x01VERSION\x01",
+		},
+		"channel action is an event": {
+			input:  ":fake-nick!u@h PRIVMSG #fake-channel :\x01ACTION waves\x01",
+			events: 1,
+		},
+		"private action is kept": {
+			input:  ":fake-nick!u@h PRIVMSG fake-user :\x01ACTION waves\x01",
+			events: 1,
+		},
+		"replies are ignored": {
+			input: ":fake-nick!u@h NOTICE #fake-channel :\x01VERSION some client\x01",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			writeErr = nil
+			writeHold = []string{}
+			s.processLine(tc.input)
+			s.sendQueue().drain()
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			assert.Len(t, out, tc.events)
+		})
+	}
+}
+
+func TestCTCPRateLimit(t *testing.T) {
+	testcases := map[string]struct {
+		query string
+		burst int
+		rate  time.Duration
+	}{
+		"known queries": {
+			query: "\x01VERSION\x01",
+			burst: ctcpBurst,
+			rate:  ctcpRate,
+		},
+		"unknown queries": {
+			query: "\x01FINGER\x01",
+			burst: ctcpErrBurst,
+			rate:  ctcpErrRate,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			timeNow = func() time.Time { return now }
+			defer func() { timeNow = time.Now }()
+
+			s, _ := NewService("fake-owner", []string{})
+			// flood control is not what is being tested
+			s.FloodBurst = 2 * ctcpBurst
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			writeErr = nil
+			writeHold = []string{}
+			for i := 0; i < tc.burst+2; i++ {
+				s.processLine(":fake-nick!u@h PRIVMSG fake-user :" + tc.query)
+				s.sendQueue().drain()
+			}
+			// only the burst is answered
+			assert.Len(t, writeHold, tc.burst)
+
+			// and then one more once the rate has passed
+			now = now.Add(tc.rate)
+			s.processLine(":fake-nick!u@h PRIVMSG fake-user :" + tc.query)
+			s.sendQueue().drain()
+			s.processLine(":fake-nick!u@h PRIVMSG fake-user :" + tc.query)
+			s.sendQueue().drain()
+			assert.Len(t, writeHold, tc.burst+1)
+		})
+	}
+}
+
+func TestCTCPUnknownQueriesDoNotStopReplies(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s, _ := NewService("fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.Username = "fake-user"
+	writeErr = nil
+	writeHold = []string{}
+	for i := 0; i < ctcpErrBurst+2; i++ {
+		s.processLine(":fake-nick!u@h PRIVMSG fake-user :\x01FINGER\x01")
+	}
+	s.processLine(":fake-nick!u@h PRIVMSG fake-user :\x01VERSION\x01")
+	s.sendQueue().drain()
+	assert.Len(t, writeHold, ctcpErrBurst+1)
+	assert.Equal(t, "NOTICE fake-nick :\x01VERSION fluentdrama IRC logger\x01\r\n", writeHold[len(writeHold)-1])
+}
@@ -0,0 +1,233 @@
+package IRC
+
+import (
+	"strings"
+	"time"
+)
+
+// Channel event types, these are what gets recorded in the logs
+const (
+	EventMessage = "message"
+	EventAction  = "action"
+	EventNotice  = "notice"
+	EventJoin    = "join"
+	EventPart    = "part"
+	EventQuit    = "quit"
+	EventKick    = "kick"
+	EventNick    = "nick"
+	EventTopic   = "topic"
+	EventMode    = "mode"
+)
+
+// Connection lifecycle event types, these carry no channel
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventReconnecting = "reconnecting"
+	// EventReady is sent when registration completes and channels are
+	// being joined
+	EventReady = "ready"
+)
+
+// EventChannelState is sent when the state of a channel, as returned by
+// ChannelState, changes without a channel event, eg when the server lists
+// the members of a channel the bot has joined
+const EventChannelState = "state"
+
+// ChannelStateEvent is the state of a channel changing without a channel
+// event
+type ChannelStateEvent struct {
+	EventInfo
+}
+
+// Event is something that happened on the network that consumers of the
+// service may want to act on, eg by storing it in the logs. Each kind of event
+// has its own type, such as JoinEvent or KickEvent, that consumers can switch
+// on for its details. Info returns what every event carries, for consumers
+// that treat them all alike.
+type Event interface {
+	Info() EventInfo
+}
+
+// EventInfo is what every event carries
+type EventInfo struct {
+	// Type is one of the Event constants, eg EventJoin
+	Type string
+	// Network is the Network of the service that sent the event
+	Network string
+	// Channel the event happened in. A QUIT or NICK is sent once for every
+	// channel the nick was known to be in.
+	Channel string
+	// Nick that caused the event
+	Nick string
+	// Account is the services account Nick is logged in to, when it is
+	// known
+	Account string
+	// Text is what was said for messages, actions and notices, the reason
+	// for a part, quit or kick, the new topic, the new nick, or the mode
+	// change. A kick's text starts with the nick that was kicked.
+	Text string
+	// Message is the line the event was derived from
+	Message Message
+}
+
+// Info returns the fields every event has
+func (i EventInfo) Info() EventInfo {
+	return i
+}
+
+// MessageEvent is a message, action or notice sent to a channel, Type tells
+// them apart
+type MessageEvent struct {
+	EventInfo
+}
+
+// JoinEvent is someone, the bot included, joining a channel
+type JoinEvent struct {
+	EventInfo
+}
+
+// PartEvent is someone leaving a channel
+type PartEvent struct {
+	EventInfo
+	Reason string
+}
+
+// KickEvent is Nick kicking Kicked out of a channel
+type KickEvent struct {
+	EventInfo
+	Kicked string
+	Reason string
+}
+
+// QuitEvent is someone leaving the network, it is sent for each channel they
+// were in
+type QuitEvent struct {
+	EventInfo
+	Reason string
+}
+
+// NickEvent is someone changing their nick from Nick to NewNick, it is sent
+// for each channel they are in
+type NickEvent struct {
+	EventInfo
+	NewNick string
+}
+
+// TopicEvent is someone changing the topic of a channel
+type TopicEvent struct {
+	EventInfo
+	Topic string
+}
+
+// ModeEvent is someone changing the modes of a channel, Modes is the change
+// with its parameters, eg +o fake-nick
+type ModeEvent struct {
+	EventInfo
+	Modes string
+}
+
+// ConnectionEvent is a change to the connection, Type is one of the
+// connection lifecycle types, eg EventConnected
+type ConnectionEvent struct {
+	EventInfo
+}
+
+// info fills in the fields every event from the line carries
+func (s *service) info(typ, channel, nick, text string, msg Message) EventInfo {
+	i := EventInfo{Type: typ, Network: s.Network, Channel: channel, Nick: nick, Text: text, Message: msg}
+	if nick != "" {
+		i.Account, _ = s.senderAccount(msg)
+	}
+	return i
+}
+
+// emit sends a lifecycle event
+func (s *service) emit(event string) {
+	s.send(ConnectionEvent{EventInfo: s.info(event, "", "", "", Message{})})
+}
+
+// dispatch turns a line from the server into channel events, keeping track of
+// the state of each channel on the way, which also lets QUITs and NICKs be
+// attributed to the channels they affect. Channel names are folded by the server's
+// CASEMAPPING, so that each channel has a single name.
+func (s *service) dispatch(msg Message) {
+	nick := msg.Source.Nick
+	channel := s.Fold(msg.Target())
+	switch msg.Command {
+	case "PRIVMSG":
+		if !s.isChannel(msg.Target()) {
+			return
+		}
+		typ, text := EventMessage, msg.Trailing
+		if action, ok := ctcpAction(text); ok {
+			typ, text = EventAction, action
+		} else if _, _, ok := parseCTCP(text); ok {
+			// other CTCP requests are not conversation
+			return
+		}
+		s.send(MessageEvent{EventInfo: s.info(typ, channel, nick, text, msg)})
+	case "NOTICE":
+		if _, _, ok := parseCTCP(msg.Trailing); ok || !s.isChannel(msg.Target()) {
+			// CTCP replies are not conversation either
+			return
+		}
+		s.send(MessageEvent{EventInfo: s.info(EventNotice, channel, nick, msg.Trailing, msg)})
+	case "JOIN":
+		self := s.isMe(nick)
+		s.state.join(channel, s.Fold(nick), nick, self)
+		if self {
+			s.handleOwnJoin(channel)
+			s.setSelf(msg.Source.User, msg.Source.Host)
+			s.requestModes(msg.Target())
+		}
+		s.send(JoinEvent{EventInfo: s.info(EventJoin, channel, nick, "", msg)})
+	case "PART":
+		if s.isMe(nick) {
+			s.state.removeChannel(channel)
+		} else {
+			s.state.remove(channel, s.Fold(nick))
+		}
+		s.send(PartEvent{EventInfo: s.info(EventPart, channel, nick, msg.Arg(1), msg), Reason: msg.Arg(1)})
+	case "KICK":
+		kicked := msg.Arg(1)
+		if s.isMe(kicked) {
+			s.state.removeChannel(channel)
+		} else {
+			s.state.remove(channel, s.Fold(kicked))
+		}
+		text := strings.TrimSpace(kicked + " " + msg.Arg(2))
+		s.send(KickEvent{EventInfo: s.info(EventKick, channel, nick, text, msg), Kicked: kicked, Reason: msg.Arg(2)})
+		if s.isMe(kicked) {
+			s.handleOwnKick(msg)
+		}
+	case "QUIT":
+		for _, c := range s.state.quit(s.Fold(nick)) {
+			s.send(QuitEvent{EventInfo: s.info(EventQuit, c, nick, msg.Arg(0), msg), Reason: msg.Arg(0)})
+		}
+	case "NICK":
+		for _, c := range s.state.rename(s.Fold(nick), s.Fold(msg.Arg(0)), msg.Arg(0)) {
+			s.send(NickEvent{EventInfo: s.info(EventNick, c, nick, msg.Arg(0), msg), NewNick: msg.Arg(0)})
+		}
+	case "TOPIC":
+		s.state.topic(channel, Topic{Text: msg.Arg(1), SetBy: nick, SetAt: time.Now().UTC()})
+		s.send(TopicEvent{EventInfo: s.info(EventTopic, channel, nick, msg.Arg(1), msg), Topic: msg.Arg(1)})
+	case "MODE":
+		if !s.isChannel(msg.Target()) {
+			return
+		}
+		args := msg.Args()
+		if len(args) < 2 {
+			return
+		}
+		support := s.ServerSupport()
+		s.state.mode(channel, support.parseModes(msg.Arg(1), args[2:]), false, &support)
+		text := strings.Join(args[1:], " ")
+		s.send(ModeEvent{EventInfo: s.info(EventMode, channel, nick, text, msg), Modes: text})
+	}
+}
+
+// send publishes the event to every subscriber
+func (s *service) send(ev Event) {
+	s.bus.publish(ev)
+}
@@ -0,0 +1,184 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatch(t *testing.T) {
+	type event struct {
+		typ, channel, nick, text string
+	}
+	testcases := map[string]struct {
+		setup    []string
+		input    string
+		expected []event
+	}{
+		"channel message": {
+			input:    ":fake-nick!u@h PRIVMSG #fake-channel :hello there",
+			expected: []event{{EventMessage, "#fake-channel", "fake-nick", "hello there"}},
+		},
+		"action": {
+			input:    ":fake-nick!u@h PRIVMSG #fake-channel :\x01ACTION waves\x01",
+			expected: []event{{EventAction, "#fake-channel", "fake-nick", "waves"}},
+		},
+		"other ctcp is not logged": {
+			input: ":fake-nick!u@h PRIVMSG #fake-channel :\x01VERSION\x01",
+		},
+		"channel notice": {
+			input:    ":fake-nick!u@h NOTICE #fake-channel :meeting in 5",
+			expected: []event{{EventNotice, "#fake-channel", "fake-nick", "meeting in 5"}},
+		},
+		"private notice is kept for the owner": {
+			input:    ":NickServ!NickServ@services. NOTICE fake-user :You are now identified",
+			expected: []event{{EventPrivateNotice, "", "NickServ", "You are now identified"}},
+		},
+		"server notice is dropped": {
+			input: ":fake.server NOTICE fake-user :*** Looking up your hostname",
+		},
+		"join": {
+			input:    ":fake-nick!u@h JOIN #fake-channel",
+			expected: []event{{EventJoin, "#fake-channel", "fake-nick", ""}},
+		},
+		"part with reason": {
+			input:    ":fake-nick!u@h PART #fake-channel :bye all",
+			expected: []event{{EventPart, "#fake-channel", "fake-nick", "bye all"}},
+		},
+		"kick": {
+			input:    ":fake-op!u@h KICK #fake-channel fake-nick :behave",
+			expected: []event{{EventKick, "#fake-channel", "fake-op", "fake-nick behave"}},
+		},
+		"topic": {
+			input:    ":fake-nick!u@h TOPIC #fake-channel :new topic",
+			expected: []event{{EventTopic, "#fake-channel", "fake-nick", "new topic"}},
+		},
+		"channel mode": {
+			input:    ":fake-op!u@h MODE #fake-channel +o fake-nick",
+			expected: []event{{EventMode, "#fake-channel", "fake-op", "+o fake-nick"}},
+		},
+		"user mode is not logged": {
+			input: ":fake-user MODE fake-user :+i",
+		},
+		"quit is sent to each channel the nick was in": {
+			setup: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake.server 353 fake-user = #fake-channel :fake-user @fake-nick",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+				":fake-user!u@h JOIN #second-fake-channel",
+				":fake-nick!u@h JOIN #second-fake-channel",
+				":fake-user!u@h JOIN #third-fake-channel",
+				":other-nick!u@h JOIN #third-fake-channel",
+			},
+			input: ":fake-nick!u@h QUIT :Quit: leaving",
+			expected: []event{
+				{EventQuit, "#fake-channel", "fake-nick", "Quit: leaving"},
+				{EventQuit, "#second-fake-channel", "fake-nick", "Quit: leaving"},
+			},
+		},
+		"nick change is sent to each channel the nick was in": {
+			setup: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake.server 353 fake-user = #fake-channel :fake-user +fake-nick",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+				":fake-nick!u@h NICK :new-nick",
+			},
+			input: ":new-nick!u@h QUIT",
+			expected: []event{
+				{EventQuit, "#fake-channel", "new-nick", ""},
+			},
+		},
+		"nobody left after the bot parts": {
+			setup: []string{
+				":fake.server 353 fake-user = #fake-channel :fake-user fake-nick",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+				":fake-user!u@h PART #fake-channel",
+			},
+			input: ":fake-nick!u@h QUIT :gone",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			for _, line := range tc.setup {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			// drop the events from the setup
+			for len(out) > 0 {
+				<-out
+			}
+			s.processLine(tc.input)
+			// CTCP queries are answered
+			s.sendQueue().drain()
+			s.bus.close()
+			got := []event{}
+			for ev := range out {
+				i := ev.Info()
+				got = append(got, event{i.Type, i.Channel, i.Nick, i.Text})
+			}
+			if tc.expected == nil {
+				tc.expected = []event{}
+			}
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestEventAccount(t *testing.T) {
+	testcases := map[string]struct {
+		caps     []string
+		setup    []string
+		input    string
+		expected string
+	}{
+		"from the account tag": {
+			caps:     []string{"account-tag"},
+			input:    "@account=fake-account :fake-nick!u@h PRIVMSG #fake-channel :hi",
+			expected: "fake-account",
+		},
+		"from extended join": {
+			caps:     []string{"account-notify", "extended-join"},
+			input:    ":fake-nick!u@h JOIN #fake-channel fake-account :Fake Name",
+			expected: "fake-account",
+		},
+		"quits keep the account": {
+			caps: []string{"account-notify", "extended-join"},
+			setup: []string{
+				":fake-user!u@h JOIN #fake-channel * :Fake User",
+				":fake-nick!u@h JOIN #fake-channel fake-account :Fake Name",
+			},
+			input:    ":fake-nick!u@h QUIT :gone",
+			expected: "fake-account",
+		},
+		"unknown without account capabilities": {
+			input: ":fake-nick!u@h PRIVMSG #fake-channel :hi",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			for _, c := range tc.caps {
+				s.reg.acked[c] = struct{}{}
+			}
+			for _, line := range tc.setup {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			for len(out) > 0 {
+				<-out
+			}
+			s.processLine(tc.input)
+			ev := (<-out).Info()
+			assert.Equal(t, tc.expected, ev.Account)
+		})
+	}
+}
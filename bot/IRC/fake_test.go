@@ -59,3 +59,14 @@ func (f *fakeConn) SetReadDeadline(t time.Time) error {
 func (f *fakeConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+// closeWatcher is a fakeConn that reports when it has been closed
+type closeWatcher struct {
+	fakeConn
+	closed chan struct{}
+}
+
+func (c *closeWatcher) Close() error {
+	close(c.closed)
+	return nil
+}
@@ -0,0 +1,221 @@
+package IRC
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Private event types, for messages and notices sent to the bot rather than to
+// a channel. They carry no channel.
+const (
+	EventPrivateMessage = "private-message"
+	EventPrivateNotice  = "private-notice"
+	// EventPrivateAction is a CTCP ACTION (/me) sent to the bot, Text is
+	// the action without its framing
+	EventPrivateAction = "private-action"
+	// EventOwnerOnline is sent when a verified owner comes online, or first
+	// messages the bot, Nick is the nick they are using
+	EventOwnerOnline = "owner-online"
+)
+
+// PrivateMessageEvent is a message, action or notice sent to the bot, Type
+// tells them apart
+type PrivateMessageEvent struct {
+	EventInfo
+}
+
+// OwnerOnlineEvent is a verified owner coming online
+type OwnerOnlineEvent struct {
+	EventInfo
+}
+
+// privateInfo fills in the fields of an event for a line sent to the bot by
+// the sender logged in to account
+func (s *service) privateInfo(typ string, msg Message, account string) EventInfo {
+	return EventInfo{Type: typ, Network: s.Network, Nick: msg.Source.Nick, Account: account, Text: msg.Trailing, Message: msg}
+}
+
+// handlePrivate passes on a message from someone other than the owner that was
+// not a command, it is sent as an event to be kept for the owner, and relayed
+// to them straight away when they are online
+//
+//	:fake-nick!~u@h PRIVMSG bot :are you a bot?
+//	:fake-nick!~u@h PRIVMSG bot :\x01ACTION waves\x01
+func (s *service) handlePrivate(msg Message, account string) {
+	info, kind := s.privateInfo(EventPrivateMessage, msg, account), "message"
+	if action, ok := ctcpAction(msg.Trailing); ok {
+		info.Type, info.Text, kind = EventPrivateAction, action, "action"
+	}
+	s.send(PrivateMessageEvent{EventInfo: info})
+	s.m.RLock()
+	owner := s.ownerNick
+	s.m.RUnlock()
+	if owner == "" || s.sameName(owner, msg.Source.Nick) {
+		return
+	}
+	if err := s.tell(owner, fmt.Sprintf("private %s from %s: %s", kind, msg.Source.Nick, info.Text)); err != nil {
+		log.Printf("Error relaying a private message to %s %v", owner, err)
+	}
+}
+
+// handlePrivateNotice keeps notices sent to the bot by other clients, eg
+// services, for the owner. Server notices, CTCP replies and the owner's own
+// notices are not kept.
+//
+//	:NickServ!NickServ@services. NOTICE bot :This nickname is registered
+func (s *service) handlePrivateNotice(msg Message) {
+	if msg.Source.User == "" && msg.Source.Host == "" {
+		return
+	}
+	if _, _, ok := parseCTCP(msg.Trailing); ok {
+		return
+	}
+	account, known := s.senderAccount(msg)
+	if s.isOwner(msg.Source, account, known) {
+		return
+	}
+	s.send(PrivateMessageEvent{EventInfo: s.privateInfo(EventPrivateNotice, msg, account)})
+}
+
+// ownerWatchNicks are the nicks watched for the owner coming online, those in
+// OwnerNicks, the services accounts in Owner, which are usually also nicks,
+// and the nicks of the hostmasks in Owner that have no wildcards
+func (s *service) ownerWatchNicks() []string {
+	accountOwners, maskOwners := s.owners()
+	candidates := append([]string{}, s.OwnerNicks...)
+	candidates = append(candidates, accountOwners...)
+	for _, mask := range maskOwners {
+		candidates = append(candidates, ParseSource(mask).Nick)
+	}
+	seen := map[string]struct{}{}
+	nicks := []string{}
+	for _, nick := range candidates {
+		nick = strings.TrimSpace(nick)
+		if nick == "" || strings.ContainsAny(nick, "*?") {
+			continue
+		}
+		if _, ok := seen[s.Fold(nick)]; ok {
+			continue
+		}
+		seen[s.Fold(nick)] = struct{}{}
+		nicks = append(nicks, nick)
+	}
+	return nicks
+}
+
+// watchOwner asks the server, with MONITOR, to say when the owner comes
+// online. Without MONITOR the owner is only noticed when they message the bot.
+func (s *service) watchOwner() {
+	nicks := s.ownerWatchNicks()
+	if len(nicks) == 0 || !s.monitorSupported() {
+		return
+	}
+	s.enqueue(PriorityLow, "MONITOR + %s", strings.Join(nicks, ","))
+}
+
+// handleOwnerWatch acts on MONITOR replies about the owner's nicks. A nick
+// that comes online is checked against Owner, by WHOX when the account is not
+// yet known, before it is trusted.
+//
+//	:server 730 me :fake-owner!u@h,other!u@h   RPL_MONONLINE
+//	:server 731 me :fake-owner                 RPL_MONOFFLINE
+func (s *service) handleOwnerWatch(msg Message) {
+	if msg.Command != "730" && msg.Command != "731" {
+		return
+	}
+	watched := map[string]struct{}{}
+	for _, nick := range s.ownerWatchNicks() {
+		watched[s.Fold(nick)] = struct{}{}
+	}
+	for _, target := range strings.Split(msg.Trailing, ",") {
+		src := ParseSource(strings.TrimSpace(target))
+		if _, ok := watched[s.Fold(src.Nick)]; !ok {
+			continue
+		}
+		if msg.Command == "731" {
+			s.ownerGone(src.Nick)
+			continue
+		}
+		account, known := s.accountCache().get(src.Nick)
+		if !known || !s.capEnabled("account-notify") {
+			account, known = "", false
+		}
+		if s.isOwner(src, account, known) {
+			s.noteOwner(src.Nick)
+			continue
+		}
+		accountOwners, _ := s.owners()
+		if known || len(accountOwners) == 0 || !s.whoxSupported() {
+			continue
+		}
+		folded := s.Fold(src.Nick)
+		s.m.Lock()
+		s.ownerChecks[folded] = src
+		s.m.Unlock()
+		s.enqueue(PriorityNormal, "WHO %s %%tna,%s", src.Nick, whoxToken)
+	}
+}
+
+// checkOwner finishes checking a watched nick that came online, once WHOX has
+// said which account it is logged in to
+func (s *service) checkOwner(nick, account string) {
+	folded := s.Fold(nick)
+	s.m.Lock()
+	src, ok := s.ownerChecks[folded]
+	delete(s.ownerChecks, folded)
+	s.m.Unlock()
+	if ok && s.isOwner(src, account, true) {
+		s.noteOwner(src.Nick)
+	}
+}
+
+// followOwner keeps ownerNick in step when the owner changes nick or quits
+func (s *service) followOwner(msg Message) {
+	switch msg.Command {
+	case "NICK":
+		s.m.Lock()
+		defer s.m.Unlock()
+		if s.ownerNick != "" && s.support.Equal(s.ownerNick, msg.Source.Nick) {
+			s.ownerNick = msg.Arg(0)
+		}
+	case "QUIT":
+		s.ownerGone(msg.Source.Nick)
+	}
+}
+
+// ownerGone forgets the owner's nick once they have gone offline
+func (s *service) ownerGone(nick string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.ownerNick != "" && s.support.Equal(s.ownerNick, nick) {
+		s.ownerNick = ""
+	}
+}
+
+// noteOwner remembers the nick of a verified owner who is online, so that they
+// can be told about things that need their attention. EventOwnerOnline is
+// sent when the owner was not already known to be online with that nick.
+func (s *service) noteOwner(nick string) {
+	s.m.Lock()
+	changed := !s.support.Equal(s.ownerNick, nick)
+	s.ownerNick = nick
+	s.m.Unlock()
+	if changed {
+		s.send(OwnerOnlineEvent{EventInfo: EventInfo{Type: EventOwnerOnline, Network: s.Network, Nick: nick}})
+	}
+}
+
+// notifyOwner tells the owner last seen online, if there is one
+func (s *service) notifyOwner(format string, args ...interface{}) {
+	s.m.RLock()
+	nick := s.ownerNick
+	s.m.RUnlock()
+	if nick == "" {
+		log.Printf("No owner to notify of: %s", fmt.Sprintf(format, args...))
+		return
+	}
+	if err := s.tell(nick, fmt.Sprintf(format, args...)); err != nil {
+		log.Printf("Error notifying %s %v", nick, err)
+	}
+}
@@ -0,0 +1,205 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivateMessages(t *testing.T) {
+	type event struct {
+		typ, channel, nick, text string
+	}
+	testcases := map[string]struct {
+		input     []string
+		events    []event
+		writeHold []string
+	}{
+		"kept while the owner is away": {
+			input:  []string{":fake-nick!~u@some.host PRIVMSG fake-user :hello there"},
+			events: []event{{EventPrivateMessage, "", "fake-nick", "hello there"}},
+		},
+		"relayed to the owner when they are online": {
+			input: []string{
+				":fake.server 730 fake-user :fake-owner!~fake-name@user/fake-owner",
+				":fake-nick!~u@some.host PRIVMSG fake-user :hello there",
+			},
+			events: []event{
+				{EventOwnerOnline, "", "fake-owner", ""},
+				{EventPrivateMessage, "", "fake-nick", "hello there"},
+			},
+			writeHold: []string{"PRIVMSG fake-owner :private message from fake-nick: hello there\r\n"},
+		},
+		"relayed to the owner's new nick": {
+			input: []string{
+				":fake.server 730 fake-user :fake-owner!~fake-name@user/fake-owner",
+				":fake-owner!~fake-name@user/fake-owner NICK :fake-away",
+				":fake.server 731 fake-user :fake-owner",
+				":fake-nick!~u@some.host PRIVMSG fake-user :hello there",
+			},
+			events: []event{
+				{EventOwnerOnline, "", "fake-owner", ""},
+				{EventPrivateMessage, "", "fake-nick", "hello there"},
+			},
+			writeHold: []string{"PRIVMSG fake-away :private message from fake-nick: hello there\r\n"},
+		},
+		"not relayed once the owner has gone": {
+			input: []string{
+				":fake.server 730 fake-user :fake-owner!~fake-name@user/fake-owner",
+				":fake.server 731 fake-user :fake-owner",
+				":fake-nick!~u@some.host PRIVMSG fake-user :hello there",
+			},
+			events: []event{
+				{EventOwnerOnline, "", "fake-owner", ""},
+				{EventPrivateMessage, "", "fake-nick", "hello there"},
+			},
+		},
+		"actions are kept and relayed": {
+			input: []string{
+				":fake.server 730 fake-user :fake-owner!~fake-name@user/fake-owner",
+				":fake-nick!~u@some.host PRIVMSG fake-user :\x01ACTION waves\x01",
+			},
+			events: []event{
+				{EventOwnerOnline, "", "fake-owner", ""},
+				{EventPrivateAction, "", "fake-nick", "waves"},
+			},
+			writeHold: []string{"PRIVMSG fake-owner :private action from fake-nick: waves\r\n"},
+		},
+		"the owner's actions are not kept or taken as commands": {
+			input:  []string{":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :\x01ACTION help\x01"},
+			events: []event{{EventOwnerOnline, "", "fake-owner", ""}},
+		},
+		"notices are kept but not relayed": {
+			input: []string{
+				":fake.server 730 fake-user :fake-owner!~fake-name@user/fake-owner",
+				":NickServ!NickServ@services. NOTICE fake-user :You are now identified",
+			},
+			events: []event{
+				{EventOwnerOnline, "", "fake-owner", ""},
+				{EventPrivateNotice, "", "NickServ", "You are now identified"},
+			},
+		},
+		"the owner's notices and ctcp replies are not kept": {
+			input: []string{
+				":fake-owner!~fake-name@user/fake-owner NOTICE fake-user :hi",
+				":fake-nick!~u@some.host NOTICE fake-user :\x01VERSION fake-client\x01",
+			},
+		},
+		"the owner messaging the bot is noticed once": {
+			input: []string{
+				":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :unknown",
+				":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :unknown",
+			},
+			events: []event{{EventOwnerOnline, "", "fake-owner", ""}},
+			writeHold: []string{
+				"PRIVMSG fake-owner :unknown command \"unknown\", try help\r\n",
+				"PRIVMSG fake-owner :unknown command \"unknown\", try help\r\n",
+			},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.input {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			s.bus.close()
+			got := []event{}
+			for ev := range out {
+				i := ev.Info()
+				got = append(got, event{i.Type, i.Channel, i.Nick, i.Text})
+			}
+			if tc.events == nil {
+				tc.events = []event{}
+			}
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.events, got)
+			assert.Equal(t, tc.writeHold, writeHold)
+		})
+	}
+}
+
+func TestOwnerWatch(t *testing.T) {
+	testcases := map[string]struct {
+		owner      string
+		ownerNicks []string
+		whox       bool
+		input      []string
+		writeHold  []string
+		online     bool
+	}{
+		"owner nicks are monitored": {
+			owner:      "$a:fake-account,fake-owner!*@*,*!*@user/fake",
+			ownerNicks: []string{"fake-other", "Fake-Owner"},
+			input: []string{
+				":fake.server 005 fake-user MONITOR=100 :are supported by this server",
+				":fake.server 376 fake-user :End of /MOTD command.",
+			},
+			writeHold: []string{"MONITOR + fake-other,Fake-Owner,fake-account\r\n"},
+		},
+		"nothing is monitored without monitor": {
+			owner: "fake-owner!*@*",
+			input: []string{":fake.server 376 fake-user :End of /MOTD command."},
+		},
+		"a hostmask owner is trusted from the monitor reply": {
+			owner:  "fake-owner!*@user/fake-owner",
+			input:  []string{":fake.server 730 fake-user :fake-owner!~u@user/fake-owner"},
+			online: true,
+		},
+		"an impostor is not trusted": {
+			owner: "fake-owner!*@user/fake-owner",
+			input: []string{":fake.server 730 fake-user :fake-owner!~u@elsewhere"},
+		},
+		"an account owner is looked up": {
+			owner: "$a:fake-account",
+			whox:  true,
+			input: []string{
+				":fake.server 730 fake-user :fake-account!~u@h",
+				":fake.server 354 fake-user 616 fake-account fake-account",
+			},
+			writeHold: []string{"WHO fake-account %tna,616\r\n"},
+			online:    true,
+		},
+		"an account owner logged in to another account is not trusted": {
+			owner: "$a:fake-account",
+			whox:  true,
+			input: []string{
+				":fake.server 730 fake-user :fake-account!~u@h",
+				":fake.server 354 fake-user 616 fake-account other-account",
+			},
+			writeHold: []string{"WHO fake-account %tna,616\r\n"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService(tc.owner, []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10, Types: []string{EventOwnerOnline}}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			s.OwnerNicks = tc.ownerNicks
+			s.reg.whox = tc.whox
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.input {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			assert.Equal(t, tc.online, len(out) == 1)
+			s.reg.close()
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package IRC
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InvitePolicy decides what the bot does when it is invited to a channel
+type InvitePolicy int
+
+const (
+	// InviteIgnore leaves invites alone, channels are only joined by the
+	// owner
+	InviteIgnore InvitePolicy = iota
+	// InviteJoin joins any channel the bot is invited to
+	InviteJoin
+	// InviteOp joins when the inviter is an operator of the channel. When
+	// the server does not show the inviter to the bot, as for secret
+	// channels, the owner is asked as for InviteApprove.
+	InviteOp
+	// InviteApprove holds the invite until an owner accepts or declines it.
+	// The owner is told of it when they are known to be online, otherwise
+	// they must check for waiting invites with the invites command. Invites
+	// not answered within inviteExpiry are forgotten.
+	InviteApprove
+)
+
+var invitePolicyNames = map[string]InvitePolicy{
+	"ignore":  InviteIgnore,
+	"join":    InviteJoin,
+	"op":      InviteOp,
+	"approve": InviteApprove,
+}
+
+// ParseInvitePolicy converts one of "ignore", "join", "op" or "approve" to an
+// InvitePolicy
+func ParseInvitePolicy(name string) (InvitePolicy, error) {
+	p, ok := invitePolicyNames[strings.ToLower(name)]
+	if !ok {
+		return InviteIgnore, fmt.Errorf("unknown invite policy %q, expected one of ignore, join, op or approve", name)
+	}
+	return p, nil
+}
+
+// inviteWhoToken tags the WHOX queries that check an inviter is an operator
+const inviteWhoToken = "617"
+
+// maxPendingInvites bounds the invites waiting on the owner or on a WHO reply,
+// so that the bot cannot be made to hold an endless list
+const maxPendingInvites = 20
+
+// inviteExpiry is how long an invite waits, on the owner or on a WHO reply,
+// before it is forgotten, so that unanswered invites do not fill the list
+const inviteExpiry = 24 * time.Hour
+
+// invite is a request to join a channel
+type invite struct {
+	channel string
+	inviter Source
+	// seen is set once a WHO reply shows the inviter, and op once it shows
+	// they are an operator
+	seen bool
+	op   bool
+	at   time.Time
+}
+
+// invites are waiting, either on an owner or on the WHO that checks the
+// inviter, keyed by the folded channel name
+type invites struct {
+	m       sync.Mutex
+	pending map[string]*invite
+}
+
+func newInvites() *invites {
+	return &invites{pending: map[string]*invite{}}
+}
+
+// add holds the invite, it reports false when the channel already has one
+// waiting, or too many are waiting
+func (iv *invites) add(key string, inv *invite) bool {
+	iv.m.Lock()
+	defer iv.m.Unlock()
+	iv.expire()
+	if _, ok := iv.pending[key]; ok || len(iv.pending) >= maxPendingInvites {
+		return false
+	}
+	inv.at = timeNow()
+	iv.pending[key] = inv
+	return true
+}
+
+func (iv *invites) get(key string) (*invite, bool) {
+	iv.m.Lock()
+	defer iv.m.Unlock()
+	iv.expire()
+	inv, ok := iv.pending[key]
+	return inv, ok
+}
+
+func (iv *invites) take(key string) (*invite, bool) {
+	iv.m.Lock()
+	defer iv.m.Unlock()
+	iv.expire()
+	inv, ok := iv.pending[key]
+	delete(iv.pending, key)
+	return inv, ok
+}
+
+// list returns the invites in order of channel name
+func (iv *invites) list() []invite {
+	iv.m.Lock()
+	defer iv.m.Unlock()
+	iv.expire()
+	list := make([]invite, 0, len(iv.pending))
+	for _, inv := range iv.pending {
+		list = append(list, *inv)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].channel < list[j].channel })
+	return list
+}
+
+// expire forgets the invites older than inviteExpiry. The caller must hold
+// the lock.
+func (iv *invites) expire() {
+	for key, inv := range iv.pending {
+		if timeNow().Sub(inv.at) >= inviteExpiry {
+			log.Printf("Invite to %s from %s expired", inv.channel, inv.inviter)
+			delete(iv.pending, key)
+		}
+	}
+}
+
+// handleInvite acts on an invite to a channel as InvitePolicy says
+//
+//	:fake-nick!u@h INVITE fake-user #channel
+func (s *service) handleInvite(msg Message) {
+	// with invite-notify the server also tells us about other invites
+	if !s.isMe(msg.Arg(0)) {
+		return
+	}
+	channel := msg.Arg(1)
+	key := s.Fold(channel)
+	if !s.isChannel(channel) {
+		return
+	}
+	s.m.RLock()
+	_, member := s.Channels[key]
+	s.m.RUnlock()
+	if member {
+		return
+	}
+
+	inv := &invite{channel: channel, inviter: msg.Source}
+	switch s.InvitePolicy {
+	case InviteJoin:
+		log.Printf("Invited to %s by %s, joining", channel, msg.Source)
+		s.acceptInvite(*inv)
+	case InviteOp:
+		if !s.invites.add(key, inv) {
+			return
+		}
+		log.Printf("Invited to %s by %s, checking they are an operator", channel, msg.Source)
+		who := fmt.Sprintf("WHO %s", channel)
+		if s.whoxSupported() {
+			who = fmt.Sprintf("WHO %s %%tcnf,%s", channel, inviteWhoToken)
+		}
+		s.enqueue(PriorityLow, "%s", who)
+	case InviteApprove:
+		if !s.invites.add(key, inv) {
+			return
+		}
+		log.Printf("Invited to %s by %s, waiting for an owner", channel, msg.Source)
+		s.notifyOwner("%s invited me to %s, reply accept %s or decline %s", msg.Source.Nick, channel, channel, channel)
+	default:
+		log.Printf("Invited to %s by %s, ignoring it", channel, msg.Source)
+	}
+}
+
+// handleInviteWho checks the WHO replies for a channel we were invited to,
+// and joins it if the inviter is an operator
+//
+//	:server 354 me 617 #channel fake-nick H@
+//	:server 352 me #channel user host server fake-nick H@ :0 Real Name
+//	:server 315 me #channel :End of /WHO list.
+func (s *service) handleInviteWho(msg Message) {
+	var channel, nick, flags string
+	switch msg.Command {
+	case "354":
+		if msg.Arg(1) != inviteWhoToken {
+			return
+		}
+		channel, nick, flags = msg.Arg(2), msg.Arg(3), msg.Arg(4)
+	case "352":
+		channel, nick, flags = msg.Arg(1), msg.Arg(5), msg.Arg(6)
+	case "315":
+		inv, ok := s.invites.get(s.Fold(msg.Arg(1)))
+		if !ok || s.InvitePolicy != InviteOp {
+			return
+		}
+		s.invites.m.Lock()
+		seen, op := inv.seen, inv.op
+		s.invites.m.Unlock()
+		if !seen {
+			// the channel's members are hidden from the bot, leave it
+			// to the owner
+			log.Printf("Could not check %s is an operator of %s, waiting for an owner", inv.inviter, inv.channel)
+			s.notifyOwner("%s invited me to %s, but I could not check they are an operator there, reply accept %s or decline %s", inv.inviter.Nick, inv.channel, inv.channel, inv.channel)
+			return
+		}
+		s.invites.take(s.Fold(msg.Arg(1)))
+		if op {
+			s.acceptInvite(*inv)
+			return
+		}
+		log.Printf("Not joining %s, %s is not an operator there", inv.channel, inv.inviter)
+		return
+	}
+	inv, ok := s.invites.get(s.Fold(channel))
+	if !ok || !s.sameName(nick, inv.inviter.Nick) {
+		return
+	}
+	op := s.isOperator(flags)
+	s.invites.m.Lock()
+	inv.seen = true
+	inv.op = inv.op || op
+	s.invites.m.Unlock()
+}
+
+// isOperator reports whether the WHO flags, eg H@, show channel operator or
+// higher status
+func (s *service) isOperator(flags string) bool {
+	support := s.ServerSupport()
+	op := strings.IndexByte(support.PrefixModes, 'o')
+	if op < 0 {
+		return false
+	}
+	for i := 0; i <= op; i++ {
+		if strings.IndexByte(flags, support.PrefixSymbols[i]) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptInvite joins the channel, it is stored once the server confirms the
+// join
+func (s *service) acceptInvite(inv invite) {
+	log.Printf("Joining %s after an invite from %s", inv.channel, inv.inviter)
+	s.queueJoin(inv.channel)
+}
+
+// inviteCommands let the owner deal with the invites waiting on them
+func (s *service) inviteCommands() []Command {
+	return []Command{
+		{
+			Name: "invites",
+			Help: "lists the invites waiting to be accepted or declined",
+			Run: func(req CommandRequest) error {
+				list := s.invites.list()
+				if len(list) == 0 {
+					return req.Reply("no invites waiting")
+				}
+				entries := make([]string, 0, len(list))
+				for _, inv := range list {
+					entries = append(entries, fmt.Sprintf("%s (from %s)", inv.channel, inv.inviter.Nick))
+				}
+				return req.Reply("%s", strings.Join(entries, ", "))
+			},
+		},
+		{
+			Name:    "accept",
+			Usage:   "<channel>",
+			Help:    "joins a channel the bot was invited to",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: func(req CommandRequest) error {
+				inv, ok := s.invites.take(s.Fold(req.Args[0]))
+				if !ok {
+					return req.Reply("no invite to %s", req.Args[0])
+				}
+				log.Printf("AUDIT %s accepted the invite to %s from %s", req.Source, inv.channel, inv.inviter)
+				s.acceptInvite(*inv)
+				return nil
+			},
+		},
+		{
+			Name:    "decline",
+			Usage:   "<channel>",
+			Help:    "forgets an invite to a channel",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: func(req CommandRequest) error {
+				inv, ok := s.invites.take(s.Fold(req.Args[0]))
+				if !ok {
+					return req.Reply("no invite to %s", req.Args[0])
+				}
+				log.Printf("AUDIT %s declined the invite to %s from %s", req.Source, inv.channel, inv.inviter)
+				return req.Reply("declined %s", inv.channel)
+			},
+		},
+	}
+}
@@ -0,0 +1,202 @@
+package IRC
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInvitePolicy(t *testing.T) {
+	testcases := map[string]struct {
+		name   string
+		out    InvitePolicy
+		outErr error
+	}{
+		"ignore":  {name: "ignore", out: InviteIgnore},
+		"join":    {name: "JOIN", out: InviteJoin},
+		"op":      {name: "op", out: InviteOp},
+		"approve": {name: "Approve", out: InviteApprove},
+		"unknown": {
+			name:   "sometimes",
+			outErr: fmt.Errorf("unknown invite policy %q, expected one of ignore, join, op or approve", "sometimes"),
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			p, err := ParseInvitePolicy(tc.name)
+			if tc.outErr == nil {
+				assert.Nil(t, err, "got unexpected err %v", err)
+				assert.Equal(t, tc.out, p)
+			} else {
+				assert.EqualError(t, err, tc.outErr.Error())
+			}
+		})
+	}
+}
+
+func TestInvite(t *testing.T) {
+	owner := ":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :"
+	invite := ":fake-op!u@h INVITE fake-user #new-channel"
+	testcases := map[string]struct {
+		policy    InvitePolicy
+		whox      bool
+		lines     []string
+		writeHold []string
+		joined    bool
+	}{
+		"ignored by default": {
+			lines: []string{invite},
+		},
+		"join": {
+			policy:    InviteJoin,
+			lines:     []string{invite},
+			writeHold: []string{"JOIN #new-channel\r\n"},
+			joined:    true,
+		},
+		"invites for others are not ours": {
+			policy: InviteJoin,
+			lines:  []string{":fake-op!u@h INVITE other-nick #new-channel"},
+		},
+		"channels already joined are left alone": {
+			policy: InviteJoin,
+			lines:  []string{":fake-op!u@h INVITE fake-user #Fake-Channel"},
+		},
+		"op with whox": {
+			policy: InviteOp,
+			whox:   true,
+			lines: []string{
+				invite,
+				":fake.server 354 fake-user 617 #new-channel someone @",
+				":fake.server 354 fake-user 617 #new-channel Fake-Op H@",
+				":fake.server 315 fake-user #new-channel :End of /WHO list.",
+			},
+			writeHold: []string{"WHO #new-channel %tcnf,617\r\n", "JOIN #new-channel\r\n"},
+			joined:    true,
+		},
+		"op without whox": {
+			policy: InviteOp,
+			lines: []string{
+				invite,
+				":fake.server 352 fake-user #new-channel u h fake.server fake-op G@+ :0 Real Name",
+				":fake.server 315 fake-user #new-channel :End of /WHO list.",
+			},
+			writeHold: []string{"WHO #new-channel\r\n", "JOIN #new-channel\r\n"},
+			joined:    true,
+		},
+		"voice is not enough": {
+			policy: InviteOp,
+			whox:   true,
+			lines: []string{
+				invite,
+				":fake.server 354 fake-user 617 #new-channel fake-op H+",
+				":fake.server 315 fake-user #new-channel :End of /WHO list.",
+			},
+			writeHold: []string{"WHO #new-channel %tcnf,617\r\n"},
+		},
+		"op the server does not show asks the owner": {
+			policy: InviteOp,
+			whox:   true,
+			lines: []string{
+				owner + "channels",
+				invite,
+				":fake.server 315 fake-user #new-channel :End of /WHO list.",
+				owner + "accept #new-channel",
+			},
+			writeHold: []string{
+				"PRIVMSG fake-owner :#fake-channel\r\n",
+				"WHO #new-channel %tcnf,617\r\n",
+				"PRIVMSG fake-owner :fake-op invited me to #new-channel, but I could not check they are an operator there, reply accept #new-channel or decline #new-channel\r\n",
+				"JOIN #new-channel\r\n",
+			},
+			joined: true,
+		},
+		"owner ranks above op": {
+			policy: InviteOp,
+			whox:   true,
+			lines: []string{
+				":fake.server 005 fake-user PREFIX=(qaohv)~&@%+ :are supported by this server",
+				invite,
+				":fake.server 354 fake-user 617 #new-channel fake-op H~",
+				":fake.server 315 fake-user #new-channel :End of /WHO list.",
+			},
+			writeHold: []string{"WHO #new-channel %tcnf,617\r\n", "JOIN #new-channel\r\n"},
+			joined:    true,
+		},
+		"approve tells the owner": {
+			policy: InviteApprove,
+			lines:  []string{owner + "channels", invite, invite},
+			writeHold: []string{
+				"PRIVMSG fake-owner :#fake-channel\r\n",
+				"PRIVMSG fake-owner :fake-op invited me to #new-channel, reply accept #new-channel or decline #new-channel\r\n",
+			},
+		},
+		"approve then list": {
+			policy:    InviteApprove,
+			lines:     []string{invite, owner + "invites"},
+			writeHold: []string{"PRIVMSG fake-owner :#new-channel (from fake-op)\r\n"},
+		},
+		"approve then accept": {
+			policy:    InviteApprove,
+			lines:     []string{invite, owner + "accept #NEW-channel", owner + "invites"},
+			writeHold: []string{"JOIN #new-channel\r\n", "PRIVMSG fake-owner :no invites waiting\r\n"},
+			joined:    true,
+		},
+		"approve then decline": {
+			policy:    InviteApprove,
+			lines:     []string{invite, owner + "decline #new-channel", owner + "accept #new-channel"},
+			writeHold: []string{"PRIVMSG fake-owner :declined #new-channel\r\n", "PRIVMSG fake-owner :no invite to #new-channel\r\n"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{"#fake-channel"})
+			s.connection = &fakeConn{}
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			s.InvitePolicy = tc.policy
+			s.reg.whox = tc.whox
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.lines {
+				s.processLine(line)
+				// the lines queued for each, of different priorities, are
+				// sent before the next arrives
+				s.sendQueue().drain()
+			}
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			_, joined := s.Channels["#new-channel"]
+			assert.Equal(t, tc.joined, joined)
+		})
+	}
+}
+
+func TestPendingInvitesAreBounded(t *testing.T) {
+	iv := newInvites()
+	for i := 0; i < maxPendingInvites; i++ {
+		assert.True(t, iv.add(fmt.Sprintf("#channel-%d", i), &invite{}))
+	}
+	assert.False(t, iv.add("#one-too-many", &invite{}))
+	assert.False(t, iv.add("#channel-0", &invite{}), "a channel is only held once")
+}
+
+func TestPendingInvitesExpire(t *testing.T) {
+	now := time.Unix(1639000000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+	iv := newInvites()
+	for i := 0; i < maxPendingInvites; i++ {
+		assert.True(t, iv.add(fmt.Sprintf("#channel-%d", i), &invite{}))
+	}
+	now = now.Add(inviteExpiry - time.Second)
+	assert.False(t, iv.add("#one-too-many", &invite{}))
+	now = now.Add(time.Second)
+	assert.Empty(t, iv.list())
+	assert.True(t, iv.add("#one-too-many", &invite{}), "expired invites make room")
+}
@@ -2,14 +2,16 @@ package IRC
 
 import (
 	"bufio"
-	"crypto/rand"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/textproto"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -19,34 +21,162 @@ type service struct {
 	connection net.Conn
 	reader     *textproto.Reader
 	writer     *textproto.Writer
-	Channels   map[string]struct{}
-	out        chan map[string]string
-	m          sync.RWMutex
-	Username   string
-	Owner      string
+	// Channels are the channels the bot should be in, folded by the
+	// server's CASEMAPPING, with the key each is joined with, if any
+	Channels map[string]string
+	// channelNames are the names of the Channels as they were written, by
+	// the same folded keys, so that they can be folded again when the
+	// server's CASEMAPPING changes
+	channelNames map[string]string
+	bus          *bus
+	state        *channelStates
+	joins        *joinStates
+	support      *ISupport
+	accounts     *accounts
+	commands     *commands
+	ctcpLimit    *ctcpLimiter
+	// ctcpErrLimit paces the errors for CTCP queries the bot does not
+	// understand
+	ctcpErrLimit *ctcpLimiter
+	m            sync.RWMutex
+	// Username is the nick the bot has, it is guarded by m as nick recovery
+	// changes it, so read it with CurrentNick
+	Username string
+	// Owner is who may command the bot, a comma separated list of services
+	// accounts, written as $a:account, and hostmask globs such as
+	// nick!*@host, which are only used when no accounts are listed or the
+	// sender's account cannot be checked
+	Owner string
+	// Network names the IRC network the service is connected to, it is
+	// attached to every event
+	Network string
+	// SASLMechanism is the SASL mechanism Login authenticates with, PLAIN
+	// (the default) or EXTERNAL
+	SASLMechanism string
+	// JoinOn is the point in registration at which channels are joined
+	JoinOn Readiness
+	// AltNicks are tried, in order, when the nick supplied to Login is taken
+	AltNicks []string
+	// NickRecovery is the NickServ command used to take the nick back from
+	// whoever holds it, REGAIN (the default) or GHOST
+	NickRecovery string
+	// FloodBurst is how many lines can be sent at once before flood control
+	// starts pacing them, and FloodRate is the pace
+	FloodBurst int
+	FloodRate  time.Duration
+	// TLS tunes the connection when Connect is asked to use TLS
+	TLS TLSOptions
+	// QuitMessage is the reason given when Run is stopped
+	QuitMessage string
+	// PingInterval is how often the server is pinged once registered, and
+	// PingTimeout how long it has to answer before the connection is
+	// treated as lost
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// InvitePolicy is what the bot does when invited to a channel
+	InvitePolicy InvitePolicy
+	// Proxy, when set, is the SOCKS5 or HTTP CONNECT proxy that Connect
+	// reaches the server through, as returned by ParseProxy
+	Proxy *url.URL
+	// Charset decodes lines that are not valid UTF-8, windows-1252 when it
+	// is not set, and ChannelCharsets overrides it for some channels
+	Charset         Charset
+	ChannelCharsets map[string]Charset
+	// OwnerNicks are watched with MONITOR, along with the nicks that can be
+	// read from Owner, so that the owner is told about private messages
+	// when they come online
+	OwnerNicks []string
+
+	server    string
+	useTLS    bool
+	loginUser string
+	password  string
+	// selfUser and selfHost are the rest of our prefix, as the server shows
+	// it to others
+	selfUser string
+	selfHost string
+	// ownerNick is the verified owner last seen online, who is told about
+	// invites and private messages waiting on them
+	ownerNick string
+	// ownerChecks are the owner nicks that came online and are waiting on
+	// a WHOX reply for their account, folded
+	ownerChecks map[string]Source
+	invites     *invites
+	keepalive   *keepalive
+	reg         *registration
+	retry       *backoff
+	queue       *sendQueue
+	queueOnce   sync.Once
+	// queueStop is closed to stop the send queue's writer, once the final
+	// QUIT has been sent
+	queueStop     chan struct{}
+	queueStopOnce sync.Once
+	// quitting is set once we have chosen to leave the network, so that the
+	// lost connection is not reconnected
+	quitting bool
+	// stopping is closed when Run is stopped
+	stopping chan struct{}
+	stopOnce sync.Once
+	// stopErr is why the first shutdown failed, if it did
+	stopErr error
 }
 
 // NewService -
 // ignore returns unexported type linter warning (revive)
 // nolint:revive
-func NewService(owner string, channels []string, out chan map[string]string) (*service, error) {
+func NewService(owner string, channels []string) (*service, error) {
 	if owner == "" {
 		return nil, fmt.Errorf("no owner supplied")
 	}
-	if out == nil {
-		return nil, fmt.Errorf("no out channel supplied")
-	}
 
-	channelMap := map[string]struct{}{}
+	// until the server says otherwise the channels are folded with the
+	// default mapping
+	support := newISupport()
+	channelMap := map[string]string{}
+	names := map[string]string{}
 	for _, c := range channels {
-		channelMap[c] = struct{}{}
+		name, key := splitChannel(c)
+		channelMap[support.Fold(name)] = key
+		names[support.Fold(name)] = name
+	}
+
+	s := &service{
+		Channels:     channelMap,
+		channelNames: names,
+		Owner:        owner,
+		bus:          newBus(),
+		state:        newChannelStates(),
+		joins:        newJoinStates(),
+		support:      support,
+		reg:          newRegistration(),
+		retry:        &backoff{min: defaultReconnectDelay, max: defaultMaxReconnectDelay},
+		commands:     newCommands(),
+		ctcpLimit:    &ctcpLimiter{burst: ctcpBurst, rate: ctcpRate},
+		ctcpErrLimit: &ctcpLimiter{burst: ctcpErrBurst, rate: ctcpErrRate},
+		invites:      newInvites(),
+		ownerChecks:  map[string]Source{},
+		keepalive:    &keepalive{},
+		stopping:     make(chan struct{}),
+		queueStop:    make(chan struct{}),
 	}
+	s.accounts = newAccounts(s.Fold)
+	s.registerBuiltins()
+	return s, nil
+}
+
+// ConfigError is returned by Connect and Login when the service is set up in a
+// way that no retry can fix, such as missing credentials. Listen gives up on
+// reconnecting with it, rather than retrying.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
 
-	return &service{
-		Channels: channelMap,
-		Owner:    owner,
-		out:      out,
-	}, nil
+func (e *ConfigError) Unwrap() error {
+	return e.Err
 }
 
 // expose these as package globals to enable themt o be faked for testing
@@ -58,67 +188,147 @@ var netDial = net.Dial
 func (s *service) Connect(server string, useTLS bool) error {
 	var err error
 	if server == "" {
-		return fmt.Errorf("no server supplied, cannot connect to nothing")
+		return &ConfigError{fmt.Errorf("no server supplied, cannot connect to nothing")}
 	}
+	s.server = server
+	s.useTLS = useTLS
+	s.m.Lock()
+	s.reg = newRegistration()
+	s.accounts = newAccounts(s.Fold)
+	s.keepalive = &keepalive{}
+	s.m.Unlock()
+	s.state.reset()
+	s.joins.reset()
+	var config *tls.Config
 	if useTLS {
-		cert, certErr := tlsLoadX509KeyPair("cert.pem", "key.pem")
-		if certErr != nil {
-			log.Printf("error during certificate loading: %v", certErr)
-			return certErr
+		if config, err = s.TLS.config(); err != nil {
+			log.Printf("error during tls configuration: %v", err)
+			return &ConfigError{err}
 		}
-
-		config := tls.Config{Certificates: []tls.Certificate{cert}}
-		config.Rand = rand.Reader
-		s.connection, err = tlsDial("tcp", server, &config)
-	} else {
-		s.connection, err = netDial("tcp", server)
+	}
+	var conn net.Conn
+	switch {
+	case s.Proxy != nil:
+		conn, err = dialProxy(s.Proxy, server, config)
+	case useTLS:
+		conn, err = tlsDial("tcp", server, config)
+	default:
+		conn, err = netDial("tcp", server)
 	}
 	if err != nil {
 		log.Printf("dial server using address %s produced error %v", server, err)
 		return err
 	}
+	s.m.Lock()
+	if s.quitting {
+		// the bot was stopped while dialling, shutdown has already closed
+		// the connection it knew about
+		s.m.Unlock()
+		if err := conn.Close(); err != nil {
+			log.Printf("Error closing connection %v", err)
+		}
+		return fmt.Errorf("connect to %s abandoned, the bot is quitting", server)
+	}
+	// lines queued for the last connection are not sent ahead of the
+	// registration on this one
+	s.sendQueue().clear()
 	// Create reader and writer so we can communicate with the server
-	r := bufio.NewReader(s.connection)
-	w := bufio.NewWriter(s.connection)
-	s.reader = textproto.NewReader(r)
-	s.writer = textproto.NewWriter(w)
+	s.connection = conn
+	s.reader = textproto.NewReader(bufio.NewReader(conn))
+	s.writer = textproto.NewWriter(bufio.NewWriter(conn))
+	s.m.Unlock()
 
 	return nil
 }
 
-// Disconnect from the server
+// connected reports whether Connect has ever succeeded
+func (s *service) connected() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.writer != nil
+}
+
+// conn is the current connection, nil before Connect
+func (s *service) conn() net.Conn {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.connection
+}
+
+// registration is the state of the current connection's registration.
+// Connect replaces it, so it is read under the lock by anything that does not
+// run on the reader.
+func (s *service) registration() *registration {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.reg
+}
+
+// accountCache is the account cache for the current connection, which Connect
+// replaces like the registration
+func (s *service) accountCache() *accounts {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.accounts
+}
+
+// Disconnect from the server, once the lines already queued have been sent
 func (s *service) Disconnect() error {
-	if err := s.writer.PrintfLine("QUIT"); err != nil {
-		return fmt.Errorf("disconnect quit error %w", err)
-	}
-	if err := s.connection.Close(); err != nil {
-		return fmt.Errorf("disconnect close error %w", err)
-	}
-	log.Println("connection close")
+	return s.shutdown("")
+}
+
+// quit leaves the network with the reason, if there is one, and stops Listen
+// from reconnecting. It is for the quit command, which runs on the reader, so
+// the QUIT is sent after the lines already queued by another goroutine, the
+// same way as when Run is stopped.
+func (s *service) quit(reason string) error {
+	s.m.Lock()
+	s.quitting = true
+	s.m.Unlock()
+	go s.shutdown(reason)
 	return nil
 }
 
-// Login to the server with the supplied credentials
+// Login to the server with the supplied credentials. The server is asked for
+// its capabilities, and when it supports SASL the credentials are used to
+// authenticate before registration completes. Servers without SASL are
+// identified with NickServ once registered. When Connect has not succeeded
+// the credentials are only kept, Listen logs in with them once it has
+// connected.
 func (s *service) Login(username, password string) error {
 	if username == "" {
-		return fmt.Errorf("no username supplied for Login, cannot continue")
+		return &ConfigError{fmt.Errorf("no username supplied for Login, cannot continue")}
+	}
+	switch s.saslMechanism() {
+	case SASLPlain:
+		if utf8.RuneCountInString(password) < minpasswordlength {
+			return &ConfigError{fmt.Errorf("password supplied not long enough, got %d, require %d", utf8.RuneCountInString(password), minpasswordlength)}
+		}
+	case SASLExternal:
+		if !s.useTLS || !s.TLS.hasClientCert() {
+			return &ConfigError{fmt.Errorf("sasl EXTERNAL requires a TLS connection with a client certificate")}
+		}
+	default:
+		return &ConfigError{fmt.Errorf("unsupported sasl mechanism %q", s.SASLMechanism)}
 	}
-	if utf8.RuneCountInString(password) < minpasswordlength {
-		return fmt.Errorf("password supplied not long enough, got %d, require %d", utf8.RuneCountInString(password), minpasswordlength)
+
+	s.setNick(username)
+	s.loginUser = username
+	s.password = password
+	if !s.connected() {
+		return nil
 	}
 
-	if err := s.writer.PrintfLine("USER %s 8 * :%s", username, username); err != nil {
-		return fmt.Errorf("login USER error %w", err)
+	if err := s.write(PriorityNormal, "CAP LS 302"); err != nil {
+		return fmt.Errorf("login CAP error %w", err)
 	}
 
-	if err := s.writer.PrintfLine("NICK %s", username); err != nil {
+	if err := s.write(PriorityNormal, "NICK %s", username); err != nil {
 		return fmt.Errorf("login NICK error %w", err)
 	}
 
-	s.Username = username
-	authStr := fmt.Sprintf("PRIVMSG NickServ : identify %s %s", username, password)
-	if err := s.writer.PrintfLine(authStr); err != nil {
-		return fmt.Errorf("login identify error %w", err)
+	if err := s.write(PriorityNormal, "USER %s 8 * :%s", username, username); err != nil {
+		return fmt.Errorf("login USER error %w", err)
 	}
 	return nil
 }
@@ -126,6 +336,16 @@ func (s *service) Login(username, password string) error {
 // Join the supplied channel - it doesn't matter if we join the same channel a
 // trillion times.
 func (s *service) Join(channel string) error {
+	return s.join(channel, true)
+}
+
+// queueJoin joins the supplied channel without waiting for the JOIN to be
+// sent, for use on the reader
+func (s *service) queueJoin(channel string) {
+	_ = s.join(channel, false)
+}
+
+func (s *service) join(channel string, wait bool) error {
 	if channel == "" {
 		// Bail if no channel supplied - it's not an error though
 		log.Printf("No channel name to join supplied")
@@ -133,19 +353,105 @@ func (s *service) Join(channel string) error {
 	}
 
 	log.Printf("Join channel %s", channel)
-	if err := s.writer.PrintfLine(fmt.Sprintf("JOIN %s", channel)); err != nil {
+	if !wait {
+		s.enqueue(PriorityNormal, "JOIN %s", channel)
+	} else if err := s.write(PriorityNormal, "JOIN %s", channel); err != nil {
 		return fmt.Errorf("channel join error %w", err)
 	}
+	s.joining(channel)
 
 	// Add the channel to the map of channels that the bot has a presence in
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.Channels[channel] = struct{}{}
+	name, key := splitChannel(channel)
+	s.addChannel(name, key)
 	return nil
 }
 
+// addChannel adds the channel, with its key, to those the bot should be in,
+// the caller must hold the lock
+func (s *service) addChannel(name, key string) {
+	folded := s.support.Fold(name)
+	s.Channels[folded] = key
+	s.channelNames[folded] = name
+}
+
+// removeChannel removes the folded channel from those the bot should be in,
+// the caller must hold the lock
+func (s *service) removeChannel(folded string) {
+	delete(s.Channels, folded)
+	delete(s.channelNames, folded)
+}
+
+// channelName is the name of the folded channel as it was written, the
+// caller must hold the lock
+func (s *service) channelName(folded string) string {
+	if name, ok := s.channelNames[folded]; ok {
+		return name
+	}
+	return folded
+}
+
+// splitChannel splits a channel to join into its name and the key that may
+// follow it
+func splitChannel(channel string) (string, string) {
+	if i := strings.IndexByte(channel, ' '); i >= 0 {
+		return channel[:i], strings.TrimSpace(channel[i+1:])
+	}
+	return channel, ""
+}
+
+// Ready returns a channel that is closed once the current connection has
+// finished registering, as chosen by JoinOn. A new connection, after a
+// reconnect, has a new channel.
+func (s *service) Ready() <-chan struct{} {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.reg.ready
+}
+
+// channelList returns a copy of the channels the bot should be in, each
+// followed by its key when it has one
+func (s *service) channelList() []string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	channels := make([]string, 0, len(s.Channels))
+	for folded, key := range s.Channels {
+		c := s.channelName(folded)
+		if key != "" {
+			c += " " + key
+		}
+		channels = append(channels, c)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// joinAll joins the channels together, so that the send queue can batch them
+// into as few lines as possible. It runs on the reader, so does not wait for
+// the JOINs to be sent.
+func (s *service) joinAll(channels []string) {
+	lines := make([]string, 0, len(channels))
+	for _, c := range channels {
+		lines = append(lines, fmt.Sprintf("JOIN %s", c))
+		s.joining(c)
+	}
+	log.Printf("Join channels %v", channels)
+	s.sendQueue().enqueue(PriorityNormal, lines...)
+}
+
 // Part from the supplied channel
 func (s *service) Part(channel string) error {
+	return s.part(channel, true)
+}
+
+// queuePart parts from the supplied channel without waiting for the PART to be
+// sent, for use on the reader
+func (s *service) queuePart(channel string) {
+	_ = s.part(channel, false)
+}
+
+func (s *service) part(channel string, wait bool) error {
 	if channel == "" {
 		// Bail if no channel supplied - it's not an error though
 		log.Printf("No channel name to part supplied")
@@ -153,124 +459,161 @@ func (s *service) Part(channel string) error {
 	}
 
 	log.Printf("Part channel %s", channel)
-	if err := s.writer.PrintfLine(fmt.Sprintf("PART %s", channel)); err != nil {
+	if !wait {
+		s.enqueue(PriorityNormal, "PART %s", channel)
+	} else if err := s.write(PriorityNormal, "PART %s", channel); err != nil {
 		return fmt.Errorf("channel part error %w", err)
 	}
 
 	// Remove the channel from the map of channels that the bot has a presence in
 	s.m.Lock()
 	defer s.m.Unlock()
-	delete(s.Channels, channel)
+	name, _ := splitChannel(channel)
+	s.removeChannel(s.support.Fold(name))
+	s.joins.forget(s.support.Fold(name))
 	return nil
 }
 
-// Say the supplied text to the supplied channel
-func (s *service) Say(target, text string) error {
-	if target == "" {
-		return fmt.Errorf("say has no target supplied")
-	}
-	if text == "" {
-		return fmt.Errorf("say has no text supplied")
+// Listen reads from the server and processes each line. When the connection
+// is lost it reconnects, with backoff, and registers again. Listen only
+// returns when reconnecting cannot help, such as when the server refuses our
+// credentials, or when the bot has quit.
+func (s *service) Listen() error {
+	if !s.connected() {
+		// the first Connect failed, it is retried the way a lost
+		// connection is
+		if err := s.reconnect(); err != nil {
+			return err
+		}
+		if s.isQuitting() {
+			return nil
+		}
 	}
-	s2 := fmt.Sprintf("%s %s : %s", "PRIVMSG", target, text)
-	if err := s.writer.PrintfLine(s2); err != nil {
-		return fmt.Errorf("cannot say %s to %s because error %w", text, target, err)
+	s.emit(EventConnected)
+	for {
+		err := s.readLines()
+		// reconnecting replaces the registration, it is fetched for each
+		// connection
+		reg := s.registration()
+		reg.close()
+		if regErr := reg.Err(); regErr != nil {
+			return fmt.Errorf("registration failed %w", regErr)
+		}
+		if s.isQuitting() {
+			s.emit(EventDisconnected)
+			return nil
+		}
+		log.Printf("Error reading socket %v", err)
+		s.closeConnection()
+		s.emit(EventDisconnected)
+
+		if err := s.reconnect(); err != nil {
+			return err
+		}
+		if s.isQuitting() {
+			// the bot was stopped while it was reconnecting
+			return nil
+		}
+		s.emit(EventConnected)
 	}
-	log.Printf("Say %s to %s", text, target)
-	return nil
 }
 
-func (s *service) Listen() {
+// readLines processes lines until the connection fails
+func (s *service) readLines() error {
 	for {
+		s.readDeadline()
 		line, err := s.reader.ReadLine()
 		if err != nil {
-			log.Printf("Error reading socket %v", err)
-			log.Fatal()
+			return s.readError(err)
 		}
 		s.processLine(line)
 	}
 }
 
 func (s *service) processLine(line string) {
-	parsed := s.parseline(line)
-	switch parsed[1] {
-	case "396":
+	line, charset := s.decodeLine(line)
+	msg, err := ParseMessage(line)
+	if err != nil {
+		log.Printf("Unable to parse line %q, %v", line, err)
+		return
+	}
+	msg.Charset = charset
+	switch msg.Command {
+	case "CAP":
+		s.handleCap(msg)
+	case "AUTHENTICATE":
+		s.handleAuthenticate(msg)
+	case "903", "904", "905", "906", "907":
+		s.handleSASLNumeric(msg)
+	case "001", "376", "422", "900", "396":
 		// 396 is the services alerting that the account is now cloaked
-		for c := range s.Channels {
-			if err := s.Join(c); err != nil {
-				log.Printf("Error joining channel %q, %v", c, err)
-			}
-		}
+		s.handleSelfNumeric(msg)
+		s.handleRegistrationNumeric(msg)
 	case "PING":
-		out := strings.Replace(line, "PING", "PONG", -1)
-		if err := s.writer.PrintfLine(out); err != nil {
-			log.Printf("Error %v when writing %s", err, out)
+		// only the token is echoed, the server's tags and prefix are not
+		// ours to send
+		s.enqueue(PriorityHigh, "PONG :%s", msg.Arg(0))
+	case "PONG":
+		s.handlePong(msg)
+	case "PRIVMSG":
+		if command, params, ok := parseCTCP(msg.Trailing); ok {
+			s.handleCTCP(msg, command, params)
+			return
 		}
-	case "PRIVMSG", "JOIN":
 		// messages directed at the bot
-		if parsed[3] == s.Username {
-			if parsed[0] == s.Owner {
-				// Commands from the owner
-				str := strings.Split(parsed[2], " ")
-				switch strings.ToLower(str[0]) {
-				case "join":
-					if err := s.Join(str[1]); err != nil {
-						log.Println("join error", err)
-					}
-				case "part":
-					if err := s.Part(str[1]); err != nil {
-						log.Println("part error", err)
-					}
-				case "say":
-					if err := s.Say(str[1], strings.Join(str[2:], " ")); err != nil {
-						log.Println("say error", err)
-					}
-				}
-			} else {
-				// pass the message on to the owner
-				owner := strings.Split(parsed[0], "!")
-				if err := s.Say(owner[0], fmt.Sprint("Got this message ", parsed[2])); err != nil {
-					log.Printf("error %v", err)
-				}
-			}
+		if s.isMe(msg.Target()) {
+			s.handleDirect(msg)
 		} else {
-			// log.Println("Putting message onto channel")
-			// log.Println(line)
-			s.out <- map[string]string{
-				"Prefix":    parsed[0],
-				"Command":   parsed[1],
-				"Trailing":  parsed[2],
-				"CmdParams": parsed[3],
-			}
+			s.dispatch(msg)
 		}
+	case "005":
+		s.handleISupport(msg)
+	case "432", "433", "436", "437":
+		// 437 is also sent for channels that are temporarily unavailable
+		if !s.isChannel(msg.Arg(1)) {
+			s.handleNickInUse(msg)
+		} else {
+			s.handleJoinFailure(msg)
+		}
+	case "730", "731", "303":
+		s.handleNickWatch(msg)
+		s.handleOwnerWatch(msg)
+	case "354", "315":
+		s.handleAccountNumeric(msg)
+		s.handleInviteWho(msg)
+	case "352":
+		s.handleInviteWho(msg)
+	case "INVITE":
+		s.handleInvite(msg)
+	case "ACCOUNT":
+		s.trackAccount(msg)
+	case "NICK":
+		// the events carry the account of the old nick, so it is tracked
+		// afterwards
+		s.dispatch(msg)
+		s.trackAccount(msg)
+		s.followOwner(msg)
+		if s.isMe(msg.Source.Nick) {
+			s.handleOwnNickChange(msg)
+		}
+	case "JOIN":
+		s.trackAccount(msg)
+		s.dispatch(msg)
+	case "QUIT":
+		s.dispatch(msg)
+		s.trackAccount(msg)
+		s.followOwner(msg)
+	case "NOTICE":
+		if s.isMe(msg.Target()) {
+			s.handlePrivateNotice(msg)
+		} else {
+			s.dispatch(msg)
+		}
+	case "PART", "KICK", "TOPIC", "MODE":
+		s.dispatch(msg)
+	case "405", "470", "471", "473", "474", "475":
+		s.handleJoinFailure(msg)
+	case "324", "331", "332", "333", "353", "366":
+		s.handleChannelNumeric(msg)
 	}
 }
-
-func (s *service) parseline(line string) []string {
-	prefixEnd := -1
-	var Prefix, Command, Trailing, CmdParams string
-
-	if strings.HasPrefix(line, ":") {
-		prefixEnd = strings.Index(line, " ")
-		Prefix = line[1:prefixEnd]
-	}
-
-	trailingStart := strings.Index(line, " :")
-	if trailingStart >= 0 {
-		Trailing = line[trailingStart+2:]
-	} else {
-		trailingStart = len(line) - 1
-	}
-
-	cmdAndParams := strings.Fields(line[(prefixEnd + 1) : trailingStart+1])
-	if len(cmdAndParams) > 0 {
-		Command = cmdAndParams[0]
-	}
-
-	if len(cmdAndParams) > 1 {
-		CmdParams = strings.Join(cmdAndParams[1:], "")
-	}
-
-	fmt.Println(Prefix, Command, Trailing, CmdParams)
-	return []string{Prefix, Command, Trailing, CmdParams}
-}
@@ -16,6 +16,7 @@ func TestConnect(t *testing.T) {
 	testcases := map[string]struct {
 		server  string
 		useTLS  bool
+		tls     TLSOptions
 		outErr  error
 		cert    tls.Certificate
 		certErr error
@@ -35,8 +36,20 @@ func TestConnect(t *testing.T) {
 		"certificate error when creating tls connection": {
 			server:  "Fake-server-name",
 			useTLS:  true,
+			tls:     TLSOptions{CertFile: "cert.pem", KeyFile: "key.pem"},
 			certErr: fmt.Errorf("fake cert error"),
-			outErr:  fmt.Errorf("fake cert error"),
+			outErr:  fmt.Errorf("tls CertFile and KeyFile could not be loaded from \"cert.pem\" and \"key.pem\" fake cert error"),
+		},
+		"tls connection without a client certificate": {
+			server:  "Fake-server-name",
+			useTLS:  true,
+			certErr: fmt.Errorf("fake cert error"),
+		},
+		"tls client certificate without a key": {
+			server: "Fake-server-name",
+			useTLS: true,
+			tls:    TLSOptions{CertFile: "cert.pem"},
+			outErr: fmt.Errorf("tls CertFile and KeyFile must be set together"),
 		},
 		"Successful tls connection": {
 			server: "Fake-server-name",
@@ -67,8 +80,8 @@ func TestConnect(t *testing.T) {
 			}
 			defer func() { tlsLoadX509KeyPair = tls.LoadX509KeyPair }()
 
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner", []string{})
+			s.TLS = tc.tls
 			err := s.Connect(tc.server, tc.useTLS)
 			if tc.outErr == nil {
 				assert.Nil(t, err, "got unexpected err %v", err)
@@ -100,8 +113,7 @@ func TestDisconnect(t *testing.T) {
 	}
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner", []string{})
 			s.connection = &fakeConn{}
 			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
 			closeErr = tc.closeErr
@@ -119,11 +131,14 @@ func TestDisconnect(t *testing.T) {
 
 func TestLogin(t *testing.T) {
 	testcases := map[string]struct {
-		username string
-		password string
-		written  []string
-		writeErr error
-		outErr   error
+		username  string
+		password  string
+		mechanism string
+		useTLS    bool
+		certFile  string
+		written   []string
+		writeErr  error
+		outErr    error
 	}{
 		"No username": {
 			outErr: fmt.Errorf("no username supplied for Login, cannot continue"),
@@ -141,21 +156,47 @@ func TestLogin(t *testing.T) {
 			username: "fake-user",
 			password: "fake-pass",
 			writeErr: fmt.Errorf("fake-error"),
-			outErr:   fmt.Errorf("login USER error fake-error"),
+			outErr:   fmt.Errorf("login CAP error fake-error"),
+		},
+		"unknown sasl mechanism": {
+			username:  "fake-user",
+			password:  "fake-pass",
+			mechanism: "SCRAM-SHA-256",
+			outErr:    fmt.Errorf("unsupported sasl mechanism %q", "SCRAM-SHA-256"),
+		},
+		"sasl external without tls": {
+			username:  "fake-user",
+			mechanism: SASLExternal,
+			outErr:    fmt.Errorf("sasl EXTERNAL requires a TLS connection with a client certificate"),
+		},
+		"sasl external without a client certificate": {
+			username:  "fake-user",
+			mechanism: SASLExternal,
+			useTLS:    true,
+			outErr:    fmt.Errorf("sasl EXTERNAL requires a TLS connection with a client certificate"),
+		},
+		"sasl external needs no password": {
+			username:  "fake-user",
+			mechanism: SASLExternal,
+			useTLS:    true,
+			certFile:  "cert.pem",
+			written:   []string{"CAP LS 302\r\n", "NICK fake-user\r\n", "USER fake-user 8 * :fake-user\r\n"},
 		},
 		"successful login": {
 			username: "fake-user",
 			password: "fake-pass",
-			written:  []string{"USER fake-user 8 * :fake-user\r\n", "NICK fake-user\r\n", "PRIVMSG NickServ : identify fake-user fake-pass\r\n"},
+			written:  []string{"CAP LS 302\r\n", "NICK fake-user\r\n", "USER fake-user 8 * :fake-user\r\n"},
 		},
 	}
 
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner", []string{})
 			s.reader = textproto.NewReader(bufio.NewReader(&fakeConn{}))
 			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.SASLMechanism = tc.mechanism
+			s.useTLS = tc.useTLS
+			s.TLS.CertFile = tc.certFile
 			writeHold = []string{}
 			writeErr = tc.writeErr
 			err := s.Login(tc.username, tc.password)
@@ -200,8 +241,7 @@ func TestJoin(t *testing.T) {
 	}
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner", []string{})
 			s.reader = textproto.NewReader(bufio.NewReader(&fakeConn{}))
 			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
 			writeErr = tc.writeErr
@@ -259,8 +299,7 @@ func TestPart(t *testing.T) {
 	}
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner", []string{})
 			s.reader = textproto.NewReader(bufio.NewReader(&fakeConn{}))
 			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
 			// Set up
@@ -291,48 +330,12 @@ func TestPart(t *testing.T) {
 	}
 }
 
-func TestParseLine(t *testing.T) {
-	testcases := map[string]struct {
-		input     string
-		prefix    string
-		command   string
-		trailing  string
-		cmdParams string
-	}{
-		"no colon prefix": {
-			input:     "PING :zirconium.libera.chat",
-			prefix:    "",
-			command:   "PING",
-			trailing:  "zirconium.libera.chat",
-			cmdParams: "",
-		},
-		"colon prefix": {
-			input:     ":zirconium.libera.chat 376 loggingbot :End of /MOTD command.",
-			prefix:    "zirconium.libera.chat",
-			command:   "376",
-			trailing:  "End of /MOTD command.",
-			cmdParams: "loggingbot",
-		},
-	}
-	for name, tc := range testcases {
-		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
-			output := s.parseline(tc.input)
-			assert.Equal(t, tc.prefix, output[0])
-			assert.Equal(t, tc.command, output[1])
-			assert.Equal(t, tc.trailing, output[2])
-			assert.Equal(t, tc.cmdParams, output[3])
-		})
-	}
-}
-
 // TODO - refactor so these tests have actual meaning
 func TestProcessLine(t *testing.T) {
 	testcases := map[string]struct {
 		input      string
 		writeErr   error
-		expected   []string
+		expected   Event
 		useChannel bool
 		useWriter  bool
 		writeHold  []string
@@ -342,6 +345,11 @@ func TestProcessLine(t *testing.T) {
 			writeHold: []string{"PONG :zirconium.libera.chat\r\n"},
 			useWriter: true,
 		},
+		"ping with tags and prefix": {
+			input:     "@time=2021-12-20T10:00:00.000Z :zirconium.libera.chat PING :zirconium.libera.chat",
+			writeHold: []string{"PONG :zirconium.libera.chat\r\n"},
+			useWriter: true,
+		},
 		"376": {
 			input: ":zirconium.libera.chat 376 loggingbot :End of /MOTD command.",
 		},
@@ -369,18 +377,25 @@ func TestProcessLine(t *testing.T) {
 		"channel message": {
 			useChannel: true,
 			input:      ":fake-nick!~fake-name@user/fake-nick PRIVMSG #fake-channel :fake-trailing message data",
-			expected: []string{
-				"fake-nick!~fake-name@user/fake-nick",
-				"PRIVMSG",
-				"fake-trailing message data",
-				"#fake-channel",
-			},
+			expected: MessageEvent{EventInfo: EventInfo{
+				Type:    EventMessage,
+				Channel: "#fake-channel",
+				Nick:    "fake-nick",
+				Text:    "fake-trailing message data",
+				Message: Message{
+					Source:      Source{Nick: "fake-nick", User: "~fake-name", Host: "user/fake-nick"},
+					Command:     "PRIVMSG",
+					Params:      []string{"#fake-channel"},
+					Trailing:    "fake-trailing message data",
+					HasTrailing: true,
+				},
+			}},
 		},
 	}
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string, 1) // Note: buffer is for testing only
-			s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 1}).C
 			s.reader = textproto.NewReader(bufio.NewReader(&fakeConn{}))
 			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
 			s.Username = "fake-user"
@@ -389,16 +404,10 @@ func TestProcessLine(t *testing.T) {
 			// Test
 			writeErr = tc.writeErr
 			s.processLine(tc.input)
+			s.sendQueue().drain()
 			if tc.useChannel {
-				output := <-s.out
-				expected :=
-					map[string]string{
-						"Prefix":    tc.expected[0],
-						"Command":   tc.expected[1],
-						"Trailing":  tc.expected[2],
-						"CmdParams": tc.expected[3],
-					}
-				assert.Equal(t, expected, output)
+				output := <-out
+				assert.Equal(t, tc.expected, output)
 			}
 			if tc.useWriter {
 				assert.Equal(t, len(tc.writeHold), len(writeHold))
@@ -434,8 +443,7 @@ func TestSay(t *testing.T) {
 	}
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			out := make(chan map[string]string)
-			s, _ := NewService("fake-owner", []string{}, out)
+			s, _ := NewService("fake-owner", []string{})
 			s.reader = textproto.NewReader(bufio.NewReader(&fakeConn{}))
 			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
 			// Set up
@@ -455,3 +463,21 @@ func TestSay(t *testing.T) {
 	}
 
 }
+
+func TestKeyedChannels(t *testing.T) {
+	s, _ := NewService("fake-owner!~fake-name@user/fake-owner", []string{"#Fake-Channel fake-key"})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.Username = "fake-user"
+	s.InvitePolicy = InviteJoin
+	writeErr = nil
+	writeHold = []string{}
+	assert.Equal(t, []string{"#Fake-Channel fake-key"}, s.channelList())
+
+	// an invite to a channel the bot is already in is ignored
+	s.processLine(":fake-nick!~u@some.host INVITE fake-user #fake-channel")
+	s.sendQueue().drain()
+	assert.Equal(t, []string{}, writeHold)
+
+	assert.Nil(t, s.Part("#FAKE-channel"))
+	assert.Equal(t, []string{}, s.channelList())
+}
@@ -10,26 +10,19 @@ import (
 
 func TestNewService(t *testing.T) {
 	testcases := map[string]struct {
-		outChan  chan map[string]string
 		owner    string
 		outError error
 	}{
 		"Happy path": {
-			owner:   "fake-owner",
-			outChan: make(chan map[string]string),
+			owner: "fake-owner",
 		},
 		"No owner": {
-			outChan:  make(chan map[string]string),
 			outError: fmt.Errorf("no owner supplied"),
 		},
-		"No out channel": {
-			owner:    "fake-owner",
-			outError: fmt.Errorf("no out channel supplied"),
-		},
 	}
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
-			service, err := IRC.NewService(tc.owner, []string{}, tc.outChan)
+			service, err := IRC.NewService(tc.owner, []string{})
 			if tc.outError == nil {
 				// no error expected, but a service is
 				assert.Nil(t, err, "No error expected, but got %v", err)
@@ -0,0 +1,281 @@
+package IRC
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Case mappings a server may advertise with CASEMAPPING, they decide which
+// nicks and channel names are the same
+const (
+	// CaseMappingASCII folds A-Z only
+	CaseMappingASCII = "ascii"
+	// CaseMappingRFC1459 also folds []\~ to {}|^, and is the default
+	CaseMappingRFC1459 = "rfc1459"
+	// CaseMappingStrictRFC1459 is rfc1459 without ~ and ^
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+)
+
+// ISupport is what the server says it supports in RPL_ISUPPORT (005). Until
+// the server says otherwise the defaults from the IRC specifications apply.
+type ISupport struct {
+	// CaseMapping is one of the CaseMapping constants, an unknown mapping is
+	// treated as rfc1459
+	CaseMapping string
+	// ChanTypes are the characters a channel name can start with
+	ChanTypes string
+	// PrefixModes are the channel modes that give a member status, and
+	// PrefixSymbols the matching prefixes shown before nicks, in order of
+	// rank, eg `ov` and `@+`
+	PrefixModes   string
+	PrefixSymbols string
+	// ChanModes are the channel modes by type, A are lists such as bans, B
+	// always take a parameter, C take one only when set, and D never do
+	ChanModes [4]string
+	// NickLen and ChannelLen are the longest nick and channel name, 0 when
+	// the server has not said
+	NickLen    int
+	ChannelLen int
+	// TargMax is the most targets each command accepts, 0 means no limit.
+	// Commands that are not listed accept a single target.
+	TargMax map[string]int
+	// Modes is the most channel modes with a parameter that can be set in
+	// one MODE command, 0 means no limit
+	Modes int
+	// Tokens are every token the server advertised, with their raw values
+	Tokens map[string]string
+}
+
+func newISupport() *ISupport {
+	return &ISupport{
+		CaseMapping:   CaseMappingRFC1459,
+		ChanTypes:     "#&",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		ChanModes:     [4]string{"beI", "k", "l", "imnpst"},
+		Modes:         3,
+		TargMax:       map[string]int{},
+		Tokens:        map[string]string{},
+	}
+}
+
+// copy returns an ISupport that can be handed out without sharing the maps
+func (is *ISupport) copy() ISupport {
+	c := *is
+	c.TargMax = make(map[string]int, len(is.TargMax))
+	for k, v := range is.TargMax {
+		c.TargMax[k] = v
+	}
+	c.Tokens = make(map[string]string, len(is.Tokens))
+	for k, v := range is.Tokens {
+		c.Tokens[k] = v
+	}
+	return c
+}
+
+// parse applies a single token from a 005 line, such as CHANTYPES=# or
+// -EXCEPTS, which withdraws a token advertised earlier
+func (is *ISupport) parse(token string) {
+	if strings.HasPrefix(token, "-") {
+		name := token[1:]
+		delete(is.Tokens, name)
+		def := newISupport()
+		switch name {
+		case "CASEMAPPING":
+			is.CaseMapping = def.CaseMapping
+		case "CHANTYPES":
+			is.ChanTypes = def.ChanTypes
+		case "PREFIX":
+			is.PrefixModes, is.PrefixSymbols = def.PrefixModes, def.PrefixSymbols
+		case "CHANMODES":
+			is.ChanModes = def.ChanModes
+		case "NICKLEN":
+			is.NickLen = 0
+		case "CHANNELLEN":
+			is.ChannelLen = 0
+		case "TARGMAX":
+			is.TargMax = def.TargMax
+		case "MODES":
+			is.Modes = def.Modes
+		}
+		return
+	}
+
+	name, value := token, ""
+	if i := strings.Index(token, "="); i >= 0 {
+		name, value = token[:i], token[i+1:]
+	}
+	is.Tokens[name] = value
+	switch name {
+	case "CASEMAPPING":
+		is.CaseMapping = strings.ToLower(value)
+	case "CHANTYPES":
+		is.ChanTypes = value
+	case "PREFIX":
+		// PREFIX=(ov)@+, an empty value means there are no prefixes
+		is.PrefixModes, is.PrefixSymbols = "", ""
+		if i := strings.Index(value, ")"); strings.HasPrefix(value, "(") && i > 0 {
+			modes, symbols := value[1:i], value[i+1:]
+			if len(modes) == len(symbols) {
+				is.PrefixModes, is.PrefixSymbols = modes, symbols
+			}
+		}
+	case "CHANMODES":
+		// CHANMODES=beI,k,l,imnpst, later types may be added to the end
+		is.ChanModes = [4]string{}
+		copy(is.ChanModes[:], strings.SplitN(value, ",", 4))
+		if i := strings.IndexByte(is.ChanModes[3], ','); i >= 0 {
+			is.ChanModes[3] = is.ChanModes[3][:i]
+		}
+	case "NICKLEN":
+		is.NickLen, _ = strconv.Atoi(value)
+	case "CHANNELLEN":
+		is.ChannelLen, _ = strconv.Atoi(value)
+	case "MODES":
+		is.Modes, _ = strconv.Atoi(value)
+	case "TARGMAX":
+		// TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:
+		is.TargMax = map[string]int{}
+		for _, t := range strings.Split(value, ",") {
+			parts := strings.SplitN(t, ":", 2)
+			if parts[0] == "" {
+				continue
+			}
+			max := 0
+			if len(parts) == 2 {
+				max, _ = strconv.Atoi(parts[1])
+			}
+			is.TargMax[strings.ToUpper(parts[0])] = max
+		}
+	}
+}
+
+// Fold returns the name with its case folded as the server's CASEMAPPING
+// says, so that names that are the same on the server compare equal
+func (is *ISupport) Fold(name string) string {
+	var upper, lower string
+	switch is.CaseMapping {
+	case CaseMappingASCII:
+		upper, lower = "", ""
+	case CaseMappingStrictRFC1459:
+		upper, lower = `[]\`, `{}|`
+	default:
+		upper, lower = `[]\~`, `{}|^`
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		} else if j := strings.IndexByte(upper, c); j >= 0 {
+			b[i] = lower[j]
+		}
+	}
+	return string(b)
+}
+
+// Equal reports whether the two nicks, or channel names, are the same
+func (is *ISupport) Equal(a, b string) bool {
+	return is.Fold(a) == is.Fold(b)
+}
+
+// IsChannel reports whether the target names a channel rather than a nick
+func (is *ISupport) IsChannel(target string) bool {
+	return target != "" && strings.IndexByte(is.ChanTypes, target[0]) >= 0
+}
+
+// MaxTargets is how many targets the command accepts in one line, 0 when
+// there is no limit. Until the server sends TARGMAX nothing is limited.
+func (is *ISupport) MaxTargets(command string) int {
+	if _, ok := is.Tokens["TARGMAX"]; !ok {
+		return 0
+	}
+	max, ok := is.TargMax[command]
+	if !ok {
+		return 1
+	}
+	return max
+}
+
+// ServerSupport returns what the server the bot is connected to supports
+func (s *service) ServerSupport() ISupport {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.support.copy()
+}
+
+// Fold returns the nick or channel name as it is kept by the service, folded
+// to lower case by the server's CASEMAPPING
+func (s *service) Fold(name string) string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.support.Fold(name)
+}
+
+// sameName reports whether the two nicks, or channel names, are the same on
+// the server
+func (s *service) sameName(a, b string) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.support.Equal(a, b)
+}
+
+func (s *service) isChannel(target string) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.support.IsChannel(target)
+}
+
+// isMe reports whether the nick is the bot's current nick
+func (s *service) isMe(nick string) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.support.Equal(nick, s.Username)
+}
+
+// handleISupport records the server's features, and notes the ones the
+// registration depends on
+//
+//	:server 005 me CHANTYPES=# MONITOR=100 :are supported by this server
+func (s *service) handleISupport(msg Message) {
+	if len(msg.Params) < 1 {
+		return
+	}
+	// the last parameter is the human readable text, it is not always
+	// introduced with a `:`
+	tokens := msg.Params[1:]
+	if !msg.HasTrailing && len(tokens) > 0 {
+		tokens = tokens[:len(tokens)-1]
+	}
+	s.m.Lock()
+	caseMapping := s.support.CaseMapping
+	for _, token := range tokens {
+		s.support.parse(token)
+	}
+	if s.support.CaseMapping != caseMapping {
+		// the channels were folded by the old mapping, which cannot be
+		// undone, so they are folded again from their names
+		channels := make(map[string]string, len(s.Channels))
+		names := make(map[string]string, len(s.Channels))
+		for folded, key := range s.Channels {
+			name := s.channelName(folded)
+			channels[s.support.Fold(name)] = key
+			names[s.support.Fold(name)] = name
+		}
+		s.Channels, s.channelNames = channels, names
+	}
+	s.m.Unlock()
+
+	reg := s.registration()
+	for _, token := range tokens {
+		if token == "MONITOR" || strings.HasPrefix(token, "MONITOR=") {
+			reg.m.Lock()
+			reg.monitor = true
+			reg.m.Unlock()
+		}
+		if token == "WHOX" {
+			reg.m.Lock()
+			reg.whox = true
+			reg.m.Unlock()
+		}
+	}
+}
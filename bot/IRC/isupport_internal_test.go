@@ -0,0 +1,126 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleISupport(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{"#Fake[Channel]"})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+
+	assert.Equal(t, map[string]string{"#fake{channel}": ""}, s.Channels, "channels are folded by rfc1459 before the server says")
+
+	s.processLine(":fake.server 005 fake-user CASEMAPPING=ascii CHANTYPES=#! PREFIX=(qaohv)~&@%+ NICKLEN=30 CHANNELLEN=64 :are supported by this server")
+	s.processLine(":fake.server 005 fake-user TARGMAX=PRIVMSG:4,NOTICE:4,JOIN: MODES=4 MONITOR=100 WHOX -EXCEPTS :are supported by this server")
+
+	support := s.ServerSupport()
+	assert.Equal(t, CaseMappingASCII, support.CaseMapping)
+	assert.Equal(t, "#!", support.ChanTypes)
+	assert.Equal(t, "qaohv", support.PrefixModes)
+	assert.Equal(t, "~&@%+", support.PrefixSymbols)
+	assert.Equal(t, 30, support.NickLen)
+	assert.Equal(t, 64, support.ChannelLen)
+	assert.Equal(t, 4, support.Modes)
+	assert.Equal(t, map[string]int{"PRIVMSG": 4, "NOTICE": 4, "JOIN": 0}, support.TargMax)
+	assert.Equal(t, "100", support.Tokens["MONITOR"])
+	_, ok := support.Tokens["are supported by this server"]
+	assert.False(t, ok, "the trailing text is not a token")
+	assert.True(t, s.monitorSupported())
+	assert.True(t, s.whoxSupported())
+
+	// the copy does not share the maps
+	support.TargMax["PRIVMSG"] = 1
+	assert.Equal(t, 4, s.ServerSupport().TargMax["PRIVMSG"])
+
+	s.processLine(":fake.server 005 fake-user -CASEMAPPING -PREFIX :are supported by this server")
+	support = s.ServerSupport()
+	assert.Equal(t, CaseMappingRFC1459, support.CaseMapping)
+	assert.Equal(t, "@+", support.PrefixSymbols)
+}
+
+func TestCaseMappingChangeRefoldsChannels(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{`#Foo[Bar]\~ fake-key`, "#other"})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	assert.Equal(t, map[string]string{"#foo{bar}|^": "fake-key", "#other": ""}, s.Channels)
+
+	// ascii does not fold []\~, so the names are folded again as written
+	s.processLine(":fake.server 005 fake-user CASEMAPPING=ascii :are supported by this server")
+	assert.Equal(t, map[string]string{`#foo[bar]\~`: "fake-key", "#other": ""}, s.Channels)
+	assert.Equal(t, []string{`#Foo[Bar]\~ fake-key`, "#other"}, s.channelList())
+	name, ok := s.wantedChannel(`#foo[bar]\~`)
+	assert.True(t, ok)
+	assert.Equal(t, `#Foo[Bar]\~ fake-key`, name)
+}
+
+func TestMaxTargets(t *testing.T) {
+	is := newISupport()
+	assert.Equal(t, 0, is.MaxTargets("JOIN"), "nothing is limited before TARGMAX")
+	is.parse("TARGMAX=JOIN:,PRIVMSG:4")
+	assert.Equal(t, 0, is.MaxTargets("JOIN"))
+	assert.Equal(t, 4, is.MaxTargets("PRIVMSG"))
+	assert.Equal(t, 1, is.MaxTargets("KICK"))
+}
+
+func TestFold(t *testing.T) {
+	testcases := map[string]struct {
+		caseMapping string
+		name        string
+		expected    string
+	}{
+		"ascii":                  {CaseMappingASCII, "#Go-Nuts[]~", "#go-nuts[]~"},
+		"rfc1459":                {CaseMappingRFC1459, "Fake[Nick]\\~", "fake{nick}|^"},
+		"strict rfc1459":         {CaseMappingStrictRFC1459, "Fake[Nick]\\~", "fake{nick}|~"},
+		"unknown is rfc1459":     {"rfc7613", "[X]", "{x}"},
+		"non ascii is unchanged": {CaseMappingRFC1459, "#Ünïcode", "#Ünïcode"},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			is := newISupport()
+			is.CaseMapping = tc.caseMapping
+			assert.Equal(t, tc.expected, is.Fold(tc.name))
+			assert.True(t, is.Equal(tc.name, tc.expected))
+		})
+	}
+}
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	s.Username = "Fake-User"
+
+	assert.Nil(t, s.Join("#Go-Nuts"))
+	assert.Nil(t, s.Join("#go-nuts"))
+	assert.Equal(t, []string{"#go-nuts"}, s.channelList())
+
+	s.processLine(":Fake-User!u@h JOIN #Go-Nuts")
+	s.sendQueue().drain()
+	for len(out) > 0 {
+		<-out
+	}
+	s.processLine(":fake.server 353 fake-user = #GO-NUTS :fake-user @Fake-Nick")
+	s.processLine(":fake.server 366 fake-user #Go-Nuts :End of /NAMES list.")
+	assert.Equal(t, EventChannelState, (<-out).Info().Type)
+	s.processLine(":fake-nick!u@h QUIT :gone")
+	ev := (<-out).(QuitEvent)
+	assert.Equal(t, EventInfo{Type: EventQuit, Channel: "#go-nuts", Nick: "fake-nick", Text: "gone"}, EventInfo{Type: ev.Type, Channel: ev.Channel, Nick: ev.Nick, Text: ev.Text})
+	assert.Equal(t, "gone", ev.Reason)
+
+	// the bot leaving, in any case, forgets the channel's members
+	s.processLine(":other-nick!u@h JOIN #Go-Nuts")
+	<-out
+	s.processLine(":FAKE-USER!u@h PART #go-nuts")
+	<-out
+	s.processLine(":other-nick!u@h QUIT")
+	assert.Len(t, out, 0)
+
+	assert.Nil(t, s.Part("#GO-NUTS"))
+	assert.Empty(t, s.channelList())
+}
@@ -0,0 +1,325 @@
+package IRC
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel statuses, as returned by ChannelStatus
+const (
+	// ChannelJoining is a channel the bot has asked to join, and has not yet
+	// heard back about
+	ChannelJoining = "joining"
+	// ChannelJoined is a channel the bot is in
+	ChannelJoined = "joined"
+	// ChannelKicked is a channel the bot was kicked from, it is rejoined
+	// after a delay
+	ChannelKicked = "kicked"
+	// ChannelBanned and ChannelFailed are channels the server would not let
+	// the bot join, they are retried until maxJoinAttempts is reached
+	ChannelBanned = "banned"
+	ChannelFailed = "failed"
+	// ChannelForwarded is a channel the server sent the bot elsewhere from,
+	// the channel it was sent to is joined instead
+	ChannelForwarded = "forwarded"
+)
+
+// EventChannelStatus is sent when the status of a channel, as returned by
+// ChannelStatus, changes for the worse, eg the bot was kicked or could not
+// join
+const EventChannelStatus = "status"
+
+// ChannelStatusEvent is the status of a channel changing for the worse
+type ChannelStatusEvent struct {
+	EventInfo
+}
+
+// sendStatus tells consumers the status of the channel changed
+func (s *service) sendStatus(key string) {
+	s.send(ChannelStatusEvent{EventInfo: EventInfo{Type: EventChannelStatus, Network: s.Network, Channel: key}})
+}
+
+// Defaults for the delay between attempts to rejoin a channel
+const (
+	defaultRejoinDelay    = 5 * time.Second
+	defaultMaxRejoinDelay = 10 * time.Minute
+)
+
+// maxJoinAttempts is how many times in a row the server can refuse to let the
+// bot join a channel before the owner is told and the bot gives up on it
+const maxJoinAttempts = 5
+
+// rejoinStable is how long the bot must stay in a channel before a kick is
+// treated as the first, rather than part of a kick and rejoin loop
+const rejoinStable = 5 * time.Minute
+
+// timer is what afterFunc returns, so that it can be faked
+type timer interface {
+	Stop() bool
+}
+
+// expose as a package global to enable it to be faked for testing
+var afterFunc = func(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// ChannelStatus is whether the bot is in a channel it wants to be in, and
+// why not when it is not
+type ChannelStatus struct {
+	Name   string
+	Status string
+	// Reason is what the server gave for a kick or a failed join
+	Reason string
+	Since  time.Time
+	// Attempts counts the failed joins since the bot was last in the
+	// channel
+	Attempts int
+}
+
+type joinState struct {
+	status   ChannelStatus
+	retry    *backoff
+	joinedAt time.Time
+	rejoin   timer
+}
+
+// joinStates tracks the status of each channel, keyed by the folded name
+type joinStates struct {
+	m        sync.Mutex
+	channels map[string]*joinState
+}
+
+func newJoinStates() *joinStates {
+	return &joinStates{channels: map[string]*joinState{}}
+}
+
+// get returns the state for the channel, creating it. The caller must hold
+// the lock.
+func (j *joinStates) get(key, name string) *joinState {
+	js, ok := j.channels[key]
+	if !ok {
+		js = &joinState{
+			status: ChannelStatus{Name: name},
+			retry:  &backoff{min: defaultRejoinDelay, max: defaultMaxRejoinDelay},
+		}
+		j.channels[key] = js
+	}
+	return js
+}
+
+// set changes the status of the channel, stopping any rejoin that is waiting.
+// The caller must hold the lock.
+func (js *joinState) set(status, reason string) {
+	if js.rejoin != nil {
+		js.rejoin.Stop()
+		js.rejoin = nil
+	}
+	js.status.Status = status
+	js.status.Reason = reason
+	js.status.Since = time.Now().UTC()
+}
+
+// forget drops the channel, when the bot no longer wants to be in it
+func (j *joinStates) forget(key string) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	if js, ok := j.channels[key]; ok {
+		js.set("", "")
+		delete(j.channels, key)
+	}
+}
+
+// reset forgets every channel, for a new connection
+func (j *joinStates) reset() {
+	j.m.Lock()
+	defer j.m.Unlock()
+	for key, js := range j.channels {
+		js.set("", "")
+		delete(j.channels, key)
+	}
+}
+
+// ChannelStatus returns the status of a channel the bot has tried to join
+func (s *service) ChannelStatus(channel string) (ChannelStatus, bool) {
+	key := s.Fold(channel)
+	s.joins.m.Lock()
+	defer s.joins.m.Unlock()
+	js, ok := s.joins.channels[key]
+	if !ok {
+		return ChannelStatus{}, false
+	}
+	return js.status, true
+}
+
+// ChannelStatuses returns the status of every channel the bot has tried to
+// join, in order of name
+func (s *service) ChannelStatuses() []ChannelStatus {
+	s.joins.m.Lock()
+	defer s.joins.m.Unlock()
+	statuses := make([]ChannelStatus, 0, len(s.joins.channels))
+	for _, js := range s.joins.channels {
+		statuses = append(statuses, js.status)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// wantedChannel returns the channel to join for the folded channel name,
+// followed by its key when the channel has one
+func (s *service) wantedChannel(key string) (string, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	channelKey, ok := s.Channels[key]
+	if !ok {
+		return "", false
+	}
+	name := s.channelName(key)
+	if channelKey != "" {
+		return name + " " + channelKey, true
+	}
+	return name, true
+}
+
+// joining notes that the bot has asked to join the channel, which may be
+// followed by its key
+func (s *service) joining(channel string) {
+	name := channel
+	if i := strings.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
+	}
+	key := s.Fold(name)
+	s.joins.m.Lock()
+	defer s.joins.m.Unlock()
+	js := s.joins.get(key, key)
+	if js.status.Status != ChannelJoined {
+		js.set(ChannelJoining, js.status.Reason)
+	}
+}
+
+// handleOwnJoin marks the channel joined
+func (s *service) handleOwnJoin(key string) {
+	s.joins.m.Lock()
+	defer s.joins.m.Unlock()
+	js := s.joins.get(key, key)
+	js.set(ChannelJoined, "")
+	js.status.Attempts = 0
+	js.joinedAt = time.Now()
+}
+
+// handleOwnKick rejoins the channel after a delay, which grows while the bot
+// keeps being kicked
+//
+//	:op!u@h KICK #channel me :reason
+func (s *service) handleOwnKick(msg Message) {
+	key := s.Fold(msg.Arg(0))
+	if _, ok := s.wantedChannel(key); !ok {
+		return
+	}
+	reason := "by " + msg.Source.Nick
+	if msg.Arg(2) != "" {
+		reason += ": " + msg.Arg(2)
+	}
+	s.joins.m.Lock()
+	js := s.joins.get(key, key)
+	if !js.joinedAt.IsZero() && time.Since(js.joinedAt) >= rejoinStable {
+		js.retry.reset()
+	}
+	js.set(ChannelKicked, reason)
+	delay := s.scheduleRejoin(key, js)
+	s.joins.m.Unlock()
+	log.Printf("Kicked from %s %s, rejoining in %v", key, reason, delay)
+	s.sendStatus(key)
+}
+
+// scheduleRejoin starts the timer to join the channel again, returning the
+// delay. The caller must hold the joins lock.
+func (s *service) scheduleRejoin(key string, js *joinState) time.Duration {
+	delay := js.retry.next()
+	js.rejoin = afterFunc(delay, func() { s.rejoin(key) })
+	return delay
+}
+
+// rejoin joins the channel again, if the bot still wants to be in it
+func (s *service) rejoin(key string) {
+	channel, ok := s.wantedChannel(key)
+	if !ok {
+		return
+	}
+	log.Printf("Rejoining %s", key)
+	s.joining(channel)
+	if err := s.write(PriorityNormal, "JOIN %s", channel); err != nil {
+		log.Printf("Error rejoining %s %v", key, err)
+	}
+}
+
+// handleJoinFailure deals with the server refusing to let the bot join a
+// channel. The join is retried with backoff, and the owner is told once the
+// bot gives up. A forward is followed by joining the channel it points to in
+// place of the one asked for.
+//
+//	:server 471 me #channel :Cannot join channel (+l)
+//	:server 473 me #channel :Cannot join channel (+i)
+//	:server 474 me #channel :Cannot join channel (+b)
+//	:server 475 me #channel :Cannot join channel (+k)
+//	:server 405 me #channel :You have joined too many channels
+//	:server 437 me #channel :Nick/channel is temporarily unavailable
+//	:server 470 me #channel #other :Forwarding to another channel
+func (s *service) handleJoinFailure(msg Message) {
+	key := s.Fold(msg.Arg(1))
+	if _, ok := s.wantedChannel(key); !ok {
+		return
+	}
+	if msg.Command == "470" {
+		s.followForward(key, msg.Arg(2))
+		return
+	}
+
+	status := ChannelFailed
+	if msg.Command == "474" {
+		status = ChannelBanned
+	}
+	s.joins.m.Lock()
+	js := s.joins.get(key, key)
+	js.set(status, msg.Trailing)
+	js.status.Attempts++
+	attempts := js.status.Attempts
+	var delay time.Duration
+	if attempts < maxJoinAttempts {
+		delay = s.scheduleRejoin(key, js)
+	}
+	s.joins.m.Unlock()
+
+	if attempts < maxJoinAttempts {
+		log.Printf("Cannot join %s (%s), trying again in %v", key, msg.Trailing, delay)
+	} else {
+		log.Printf("Cannot join %s (%s), giving up after %d attempts", key, msg.Trailing, attempts)
+		s.notifyOwner("cannot join %s after %d attempts: %s", key, attempts, msg.Trailing)
+	}
+	s.sendStatus(key)
+}
+
+// followForward swaps the channel for the one the server forwarded the bot
+// to. Servers join the bot to the new channel themselves.
+func (s *service) followForward(key, to string) {
+	if !s.isChannel(to) {
+		return
+	}
+	toKey := s.Fold(to)
+	s.m.Lock()
+	s.removeChannel(key)
+	s.addChannel(to, "")
+	s.m.Unlock()
+
+	s.joins.m.Lock()
+	s.joins.get(key, key).set(ChannelForwarded, fmt.Sprintf("to %s", toKey))
+	s.joins.m.Unlock()
+	s.joining(toKey)
+
+	log.Printf("Forwarded from %s to %s", key, toKey)
+	s.notifyOwner("%s forwarded me to %s", key, toKey)
+	s.sendStatus(key)
+}
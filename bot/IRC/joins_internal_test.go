@@ -0,0 +1,201 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTimer struct {
+	stopped bool
+}
+
+func (f *fakeTimer) Stop() bool {
+	f.stopped = true
+	return true
+}
+
+func TestJoinRecovery(t *testing.T) {
+	testcases := map[string]struct {
+		lines     []string
+		rejoin    bool
+		channels  []string
+		status    ChannelStatus
+		found     bool
+		writeHold []string
+		events    []EventInfo
+	}{
+		"joined": {
+			lines: []string{":fake-user!u@h JOIN #fake-channel"},
+			found: true,
+			status: ChannelStatus{
+				Name:   "#fake-channel",
+				Status: ChannelJoined,
+			},
+			channels:  []string{"#fake-channel fake-key", "#other-channel"},
+			writeHold: []string{"MODE #fake-channel\r\n"},
+			events:    []EventInfo{{Type: EventJoin, Channel: "#fake-channel", Nick: "fake-user"}},
+		},
+		"kicked and rejoined with the key": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake-op!u@h KICK #Fake-Channel fake-user :behave",
+			},
+			rejoin: true,
+			found:  true,
+			status: ChannelStatus{
+				Name:   "#fake-channel",
+				Status: ChannelJoining,
+				Reason: "by fake-op: behave",
+			},
+			channels:  []string{"#fake-channel fake-key", "#other-channel"},
+			writeHold: []string{"MODE #fake-channel\r\n", "JOIN #fake-channel fake-key\r\n"},
+			events: []EventInfo{
+				{Type: EventJoin, Channel: "#fake-channel", Nick: "fake-user"},
+				{Type: EventKick, Channel: "#fake-channel", Nick: "fake-op", Text: "fake-user behave"},
+				{Type: EventChannelStatus, Channel: "#fake-channel"},
+			},
+		},
+		"banned": {
+			lines:  []string{":fake.server 474 fake-user #other-channel :Cannot join channel (+b)"},
+			rejoin: true,
+			found:  true,
+			status: ChannelStatus{
+				Name:     "#other-channel",
+				Status:   ChannelJoining,
+				Reason:   "Cannot join channel (+b)",
+				Attempts: 1,
+			},
+			channels:  []string{"#fake-channel fake-key", "#other-channel"},
+			writeHold: []string{"JOIN #other-channel\r\n"},
+			events:    []EventInfo{{Type: EventChannelStatus, Channel: "#other-channel"}},
+		},
+		"channel temporarily unavailable": {
+			lines: []string{":fake.server 437 fake-user #other-channel :Nick/channel is temporarily unavailable"},
+			found: true,
+			status: ChannelStatus{
+				Name:     "#other-channel",
+				Status:   ChannelFailed,
+				Reason:   "Nick/channel is temporarily unavailable",
+				Attempts: 1,
+			},
+			channels: []string{"#fake-channel fake-key", "#other-channel"},
+			events:   []EventInfo{{Type: EventChannelStatus, Channel: "#other-channel"}},
+		},
+		"failures for unwanted channels are ignored": {
+			lines:    []string{":fake.server 471 fake-user #unknown-channel :Cannot join channel (+l)"},
+			channels: []string{"#fake-channel fake-key", "#other-channel"},
+		},
+		"forwarded": {
+			lines: []string{
+				":fake.server 470 fake-user #other-channel ##overflow :Forwarding to another channel",
+				":fake-user!u@h JOIN ##overflow",
+			},
+			found: true,
+			status: ChannelStatus{
+				Name:   "#other-channel",
+				Status: ChannelForwarded,
+				Reason: "to ##overflow",
+			},
+			channels:  []string{"##overflow", "#fake-channel fake-key"},
+			writeHold: []string{"MODE ##overflow\r\n"},
+			events: []EventInfo{
+				{Type: EventChannelStatus, Channel: "#other-channel"},
+				{Type: EventJoin, Channel: "##overflow", Nick: "fake-user"},
+			},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var rejoins []func()
+			afterFunc = func(d time.Duration, f func()) timer {
+				assert.GreaterOrEqual(t, d, defaultRejoinDelay/2)
+				assert.LessOrEqual(t, d, defaultRejoinDelay)
+				rejoins = append(rejoins, f)
+				return &fakeTimer{}
+			}
+			defer func() {
+				afterFunc = func(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+			}()
+
+			s, _ := NewService("fake-owner", []string{"#fake-channel fake-key", "#other-channel"})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.connection = &fakeConn{}
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.lines {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			if tc.rejoin {
+				assert.Len(t, rejoins, 1)
+				rejoins[0]()
+			}
+
+			status, found := s.ChannelStatus(tc.status.Name)
+			assert.Equal(t, tc.found, found)
+			status.Since = time.Time{}
+			assert.Equal(t, tc.status, status)
+			assert.Equal(t, tc.channels, s.channelList())
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+
+			s.bus.close()
+			events := []EventInfo{}
+			for ev := range out {
+				i := ev.Info()
+				events = append(events, EventInfo{Type: i.Type, Channel: i.Channel, Nick: i.Nick, Text: i.Text})
+			}
+			if tc.events == nil {
+				tc.events = []EventInfo{}
+			}
+			assert.Equal(t, tc.events, events)
+		})
+	}
+}
+
+func TestJoinGivesUp(t *testing.T) {
+	timers := []*fakeTimer{}
+	afterFunc = func(d time.Duration, f func()) timer {
+		timers = append(timers, &fakeTimer{})
+		return timers[len(timers)-1]
+	}
+	defer func() {
+		afterFunc = func(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+	}()
+
+	s, _ := NewService("fake-owner!*@*", []string{"#fake-channel"})
+	out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+	s.connection = &fakeConn{}
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.Username = "fake-user"
+	s.ownerNick = "fake-owner"
+	writeErr = nil
+	writeHold = []string{}
+	for i := 0; i < maxJoinAttempts; i++ {
+		s.processLine(":fake.server 473 fake-user #fake-channel :Cannot join channel (+i)")
+		s.sendQueue().drain()
+		<-out
+	}
+
+	assert.Len(t, timers, maxJoinAttempts-1, "no retry after the last attempt")
+	for _, tm := range timers {
+		assert.True(t, tm.stopped, "each retry is replaced by the next failure")
+	}
+	status, _ := s.ChannelStatus("#fake-channel")
+	assert.Equal(t, ChannelFailed, status.Status)
+	assert.Equal(t, maxJoinAttempts, status.Attempts)
+	assert.Equal(t, []string{"PRIVMSG fake-owner :cannot join #fake-channel after 5 attempts: Cannot join channel (+i)\r\n"}, writeHold)
+
+	// parting forgets the channel
+	assert.Nil(t, s.Part("#fake-channel"))
+	_, found := s.ChannelStatus("#fake-channel")
+	assert.False(t, found)
+}
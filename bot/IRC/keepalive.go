@@ -0,0 +1,158 @@
+package IRC
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for how often the server is pinged, and how long it has to answer
+const (
+	defaultPingInterval = time.Minute
+	defaultPingTimeout  = 2 * time.Minute
+)
+
+// keepalive tracks the PING the bot is waiting on an answer to, and the lag
+// measured by the last one that was answered, for the current connection
+type keepalive struct {
+	m sync.Mutex
+	// token is the PING waiting on a PONG, "" when there is none
+	token string
+	sent  time.Time
+	lag   time.Duration
+	// err is set once the server has failed to answer in time
+	err error
+}
+
+// pingTimes returns PingInterval and PingTimeout, or their defaults
+func (s *service) pingTimes() (time.Duration, time.Duration) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	interval, timeout := s.PingInterval, s.PingTimeout
+	if interval <= 0 {
+		interval = defaultPingInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	return interval, timeout
+}
+
+// Lag returns the round trip time of the last PING the server answered, 0
+// until one has been
+func (s *service) Lag() time.Duration {
+	s.m.RLock()
+	ka := s.keepalive
+	s.m.RUnlock()
+	ka.m.Lock()
+	defer ka.m.Unlock()
+	return ka.lag
+}
+
+// startKeepalive pings the server every PingInterval once it has welcomed us,
+// and drops the connection when a PING goes unanswered for PingTimeout, so
+// that a connection that has silently died is noticed and reconnected.
+func (s *service) startKeepalive() {
+	interval, timeout := s.pingTimes()
+	s.m.RLock()
+	done, ka, conn := s.reg.done, s.keepalive, s.connection
+	s.m.RUnlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := s.keepaliveTick(ka, now, timeout); err != nil {
+					log.Printf("Dropping the connection %v", err)
+					if conn != nil {
+						if cerr := conn.Close(); cerr != nil {
+							log.Printf("Error closing connection %v", cerr)
+						}
+					}
+					return
+				}
+			}
+		}
+	}()
+}
+
+// keepaliveTick sends a PING when none is waiting, and returns an error when
+// the one that is has waited for longer than timeout
+func (s *service) keepaliveTick(ka *keepalive, now time.Time, timeout time.Duration) error {
+	ka.m.Lock()
+	if ka.token != "" {
+		defer ka.m.Unlock()
+		if waited := now.Sub(ka.sent); waited >= timeout {
+			ka.err = fmt.Errorf("ping timeout, no reply in %v", waited.Round(time.Second))
+			return ka.err
+		}
+		return nil
+	}
+	ka.token = "ka" + strconv.FormatInt(now.UnixNano(), 10)
+	ka.sent = now
+	token := ka.token
+	ka.m.Unlock()
+	if err := s.write(PriorityHigh, "PING :%s", token); err != nil {
+		log.Printf("Error pinging the server %v", err)
+	}
+	return nil
+}
+
+// handlePong measures the lag from the answer to our PING
+//
+//	:server PONG server :ka1639000000000000000
+func (s *service) handlePong(msg Message) {
+	args := msg.Args()
+	if len(args) == 0 {
+		return
+	}
+	s.m.RLock()
+	ka := s.keepalive
+	s.m.RUnlock()
+	ka.m.Lock()
+	defer ka.m.Unlock()
+	if ka.token == "" || args[len(args)-1] != ka.token {
+		return
+	}
+	ka.lag = time.Since(ka.sent)
+	ka.token = ""
+}
+
+// readDeadline stops a read from blocking forever on a connection that has
+// died without being closed. Nothing at all for a whole PING window means the
+// server is gone, even when the keepalive has not started.
+func (s *service) readDeadline() {
+	conn := s.conn()
+	if conn == nil {
+		return
+	}
+	interval, timeout := s.pingTimes()
+	if err := conn.SetReadDeadline(time.Now().Add(interval + timeout)); err != nil {
+		log.Printf("Error setting read deadline %v", err)
+	}
+}
+
+// readError explains why reading failed when it was a ping timeout
+func (s *service) readError(err error) error {
+	s.m.RLock()
+	ka := s.keepalive
+	s.m.RUnlock()
+	ka.m.Lock()
+	pingErr := ka.err
+	ka.m.Unlock()
+	if pingErr != nil {
+		return pingErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("ping timeout, nothing read %w", err)
+	}
+	return err
+}
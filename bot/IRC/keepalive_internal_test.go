@@ -0,0 +1,69 @@
+package IRC
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTimeout struct{}
+
+func (fakeTimeout) Error() string   { return "i/o timeout" }
+func (fakeTimeout) Timeout() bool   { return true }
+func (fakeTimeout) Temporary() bool { return true }
+
+func TestKeepalive(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	writeHold = []string{}
+	ka := s.keepalive
+	start := time.Unix(1639000000, 0)
+
+	assert.Nil(t, s.keepaliveTick(ka, start, time.Minute))
+	token := fmt.Sprintf("ka%d", start.UnixNano())
+	assert.Equal(t, []string{"PING :" + token + "\r\n"}, writeHold)
+
+	// only one PING waits at a time
+	assert.Nil(t, s.keepaliveTick(ka, start.Add(30*time.Second), time.Minute))
+	assert.Len(t, writeHold, 1)
+
+	// a PONG for something else is not ours
+	s.processLine(":fake.server PONG fake.server :other")
+	assert.Equal(t, time.Duration(0), s.Lag())
+
+	s.processLine(":fake.server PONG fake.server :" + token)
+	assert.Greater(t, s.Lag(), time.Duration(0))
+	assert.Equal(t, "", ka.token)
+
+	// the next PING goes unanswered
+	next := start.Add(time.Minute)
+	assert.Nil(t, s.keepaliveTick(ka, next, time.Minute))
+	assert.Len(t, writeHold, 2)
+	err := s.keepaliveTick(ka, next.Add(time.Minute), time.Minute)
+	assert.EqualError(t, err, "ping timeout, no reply in 1m0s")
+	assert.Equal(t, err, s.readError(io.EOF), "the timeout explains the lost connection")
+}
+
+func TestReadError(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	assert.Equal(t, io.EOF, s.readError(io.EOF))
+	assert.EqualError(t, s.readError(fakeTimeout{}), "ping timeout, nothing read i/o timeout")
+}
+
+func TestPingTimes(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	interval, timeout := s.pingTimes()
+	assert.Equal(t, defaultPingInterval, interval)
+	assert.Equal(t, defaultPingTimeout, timeout)
+
+	s.PingInterval, s.PingTimeout = 30*time.Second, 45*time.Second
+	interval, timeout = s.pingTimes()
+	assert.Equal(t, 30*time.Second, interval)
+	assert.Equal(t, 45*time.Second, timeout)
+}
@@ -0,0 +1,243 @@
+package IRC
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Message is a single line of the IRC protocol, including any IRCv3 message
+// tags that the server attached to it.
+//
+//	@tag=value;other :nick!user@host COMMAND param param :trailing text
+type Message struct {
+	Tags    map[string]string
+	Source  Source
+	Command string
+	// Params holds the middle parameters, in order
+	Params []string
+	// Trailing holds the final parameter, the one introduced by " :"
+	Trailing string
+	// HasTrailing records that the line carried a trailing parameter, so that
+	// an empty one (`TOPIC #chan :`) survives a round trip
+	HasTrailing bool
+	// Charset is what the line was decoded from when it was not valid UTF-8,
+	// it is empty otherwise
+	Charset Charset
+}
+
+// Source is the origin of a message. When the message comes from a server
+// rather than a client, the server name is held in Nick.
+type Source struct {
+	Nick string
+	User string
+	Host string
+}
+
+// ParseSource splits a `nick!user@host` prefix into its parts
+func ParseSource(prefix string) Source {
+	var src Source
+	if i := strings.Index(prefix, "@"); i >= 0 {
+		src.Host = prefix[i+1:]
+		prefix = prefix[:i]
+	}
+	if i := strings.Index(prefix, "!"); i >= 0 {
+		src.User = prefix[i+1:]
+		prefix = prefix[:i]
+	}
+	src.Nick = prefix
+	return src
+}
+
+// String reassembles the source into its wire form
+func (s Source) String() string {
+	out := s.Nick
+	if s.User != "" {
+		out += "!" + s.User
+	}
+	if s.Host != "" {
+		out += "@" + s.Host
+	}
+	return out
+}
+
+// ParseMessage parses a raw line, without the trailing CRLF, into a Message
+func ParseMessage(line string) (Message, error) {
+	var msg Message
+	rest := strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(rest, "@") {
+		var tags string
+		tags, rest = nextField(rest[1:])
+		msg.Tags = parseTags(tags)
+	}
+
+	rest = strings.TrimLeft(rest, " ")
+	if strings.HasPrefix(rest, ":") {
+		var prefix string
+		prefix, rest = nextField(rest[1:])
+		msg.Source = ParseSource(prefix)
+	}
+
+	msg.Command, rest = nextField(strings.TrimLeft(rest, " "))
+	if msg.Command == "" {
+		return Message{}, fmt.Errorf("no command found in line %q", line)
+	}
+	msg.Command = strings.ToUpper(msg.Command)
+
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			break
+		}
+		if strings.HasPrefix(rest, ":") {
+			msg.Trailing = rest[1:]
+			msg.HasTrailing = true
+			break
+		}
+		var param string
+		param, rest = nextField(rest)
+		msg.Params = append(msg.Params, param)
+	}
+	return msg, nil
+}
+
+// nextField returns everything up to the first space, and everything after it
+func nextField(s string) (string, string) {
+	i := strings.Index(s, " ")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// Args returns the middle parameters followed by the trailing parameter (if
+// present), which is how the IRC specs number parameters.
+func (m Message) Args() []string {
+	if !m.HasTrailing && m.Trailing == "" {
+		return m.Params
+	}
+	args := make([]string, 0, len(m.Params)+1)
+	args = append(args, m.Params...)
+	return append(args, m.Trailing)
+}
+
+// Arg returns the i'th parameter as numbered by Args, or "" if there is no such
+// parameter
+func (m Message) Arg(i int) string {
+	args := m.Args()
+	if i < 0 || i >= len(args) {
+		return ""
+	}
+	return args[i]
+}
+
+// Target is the first parameter - the channel or nick of a PRIVMSG, the
+// channel of a JOIN, and so on
+func (m Message) Target() string {
+	return m.Arg(0)
+}
+
+// String serializes the message back into its wire form, without the CRLF.
+// Tags are written in key order so that the output is stable.
+func (m Message) String() string {
+	var b strings.Builder
+	if len(m.Tags) > 0 {
+		b.WriteString("@")
+		b.WriteString(formatTags(m.Tags))
+		b.WriteString(" ")
+	}
+	if src := m.Source.String(); src != "" {
+		b.WriteString(":")
+		b.WriteString(src)
+		b.WriteString(" ")
+	}
+	b.WriteString(m.Command)
+	for _, p := range m.Params {
+		b.WriteString(" ")
+		b.WriteString(p)
+	}
+	if m.HasTrailing || m.Trailing != "" {
+		b.WriteString(" :")
+		b.WriteString(m.Trailing)
+	}
+	return b.String()
+}
+
+func parseTags(raw string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.Index(tag, "="); i >= 0 {
+			key, value = tag[:i], unescapeTagValue(tag[i+1:])
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if tags[k] == "" {
+			out = append(out, k)
+			continue
+		}
+		out = append(out, k+"="+escapeTagValue(tags[k]))
+	}
+	return strings.Join(out, ";")
+}
+
+var tagEscapes = map[byte]byte{
+	':':  ';',
+	's':  ' ',
+	'\\': '\\',
+	'r':  '\r',
+	'n':  '\n',
+}
+
+// unescapeTagValue follows the IRCv3 message-tags escaping rules. An unknown
+// escape drops the backslash, and a lone trailing backslash is dropped.
+func unescapeTagValue(v string) string {
+	if !strings.Contains(v, "\\") {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		if i == len(v) {
+			break
+		}
+		if r, ok := tagEscapes[v[i]]; ok {
+			b.WriteByte(r)
+		} else {
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+func escapeTagValue(v string) string {
+	return tagEscaper.Replace(v)
+}
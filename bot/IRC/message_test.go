@@ -0,0 +1,124 @@
+package IRC_test
+
+import (
+	"testing"
+
+	"github.com/mindfarm/fluentdrama/bot/IRC"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessage(t *testing.T) {
+	testcases := map[string]struct {
+		input    string
+		expected IRC.Message
+		outErr   string
+	}{
+		"no colon prefix": {
+			input: "PING :zirconium.libera.chat",
+			expected: IRC.Message{
+				Command:     "PING",
+				Trailing:    "zirconium.libera.chat",
+				HasTrailing: true,
+			},
+		},
+		"colon prefix": {
+			input: ":zirconium.libera.chat 376 loggingbot :End of /MOTD command.",
+			expected: IRC.Message{
+				Source:      IRC.Source{Nick: "zirconium.libera.chat"},
+				Command:     "376",
+				Params:      []string{"loggingbot"},
+				Trailing:    "End of /MOTD command.",
+				HasTrailing: true,
+			},
+		},
+		"multiple middle params are kept apart": {
+			input: ":zirconium.libera.chat 353 loggingbot = #go-nuts :loggingbot @fake-op",
+			expected: IRC.Message{
+				Source:      IRC.Source{Nick: "zirconium.libera.chat"},
+				Command:     "353",
+				Params:      []string{"loggingbot", "=", "#go-nuts"},
+				Trailing:    "loggingbot @fake-op",
+				HasTrailing: true,
+			},
+		},
+		"no trailing": {
+			input: ":fake-nick!~fake-name@user/fake-nick JOIN #fake-channel",
+			expected: IRC.Message{
+				Source:  IRC.Source{Nick: "fake-nick", User: "~fake-name", Host: "user/fake-nick"},
+				Command: "JOIN",
+				Params:  []string{"#fake-channel"},
+			},
+		},
+		"tags with escaped values": {
+			input: `@account=fake-account;time=2021-11-01T12:00:00.000Z;+example=semi\:colon\sspace\\slash;flag :fake-nick!~fake-name@host PRIVMSG #fake-channel :hi`,
+			expected: IRC.Message{
+				Tags: map[string]string{
+					"account":  "fake-account",
+					"time":     "2021-11-01T12:00:00.000Z",
+					"+example": `semi;colon space\slash`,
+					"flag":     "",
+				},
+				Source:      IRC.Source{Nick: "fake-nick", User: "~fake-name", Host: "host"},
+				Command:     "PRIVMSG",
+				Params:      []string{"#fake-channel"},
+				Trailing:    "hi",
+				HasTrailing: true,
+			},
+		},
+		"empty trailing": {
+			input: ":fake-nick!~fake-name@host TOPIC #fake-channel :",
+			expected: IRC.Message{
+				Source:      IRC.Source{Nick: "fake-nick", User: "~fake-name", Host: "host"},
+				Command:     "TOPIC",
+				Params:      []string{"#fake-channel"},
+				HasTrailing: true,
+			},
+		},
+		"empty line": {
+			input:  "",
+			outErr: `no command found in line ""`,
+		},
+		"prefix only": {
+			input:  ":zirconium.libera.chat",
+			outErr: `no command found in line ":zirconium.libera.chat"`,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			output, err := IRC.ParseMessage(tc.input)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+			assert.Nil(t, err, "got unexpected err %v", err)
+			assert.Equal(t, tc.expected, output)
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	testcases := []string{
+		"PING :zirconium.libera.chat",
+		":zirconium.libera.chat 376 loggingbot :End of /MOTD command.",
+		":fake-nick!~fake-name@user/fake-nick JOIN #fake-channel",
+		":fake-nick!~fake-name@host TOPIC #fake-channel :",
+		`@+example=semi\:colon\sspace\\slash;account=fake-account;flag :fake-nick!~fake-name@host PRIVMSG #fake-channel :hi there`,
+	}
+	for _, input := range testcases {
+		t.Run(input, func(t *testing.T) {
+			msg, err := IRC.ParseMessage(input)
+			assert.Nil(t, err, "got unexpected err %v", err)
+			again, err := IRC.ParseMessage(msg.String())
+			assert.Nil(t, err, "got unexpected err %v", err)
+			assert.Equal(t, msg, again)
+		})
+	}
+}
+
+func TestMessageArgs(t *testing.T) {
+	msg, _ := IRC.ParseMessage(":fake-nick!~fake-name@host KICK #fake-channel fake-victim :go away")
+	assert.Equal(t, []string{"#fake-channel", "fake-victim", "go away"}, msg.Args())
+	assert.Equal(t, "#fake-channel", msg.Target())
+	assert.Equal(t, "go away", msg.Arg(2))
+	assert.Equal(t, "", msg.Arg(3))
+}
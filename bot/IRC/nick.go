@@ -0,0 +1,209 @@
+package IRC
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// How often the primary nick is checked with ISON, on servers without
+// MONITOR, and how often services are asked to release it
+const (
+	nickCheckInterval    = time.Minute
+	nickRegainInterval   = 5 * time.Minute
+	maxNickFallbackTries = 10
+)
+
+// NickRecovery commands sent to NickServ to get the primary nick back from
+// whoever holds it
+const (
+	NickRegain = "REGAIN"
+	NickGhost  = "GHOST"
+)
+
+// CurrentNick is the nick the bot currently has on the server, which may
+// differ from the one it logged in with if that was taken
+func (s *service) CurrentNick() string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.Username
+}
+
+func (s *service) setNick(nick string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Username = nick
+}
+
+// primaryNick is the nick the bot logged in with, and wants to hold
+func (s *service) primaryNick() string {
+	return s.loginUser
+}
+
+// nextNick picks the nick to try after the server refused the previous one,
+// first the alternatives in AltNicks and then the primary nick with a numbered
+// suffix, shortened to fit within the server's NICKLEN.
+func (s *service) nextNick() string {
+	reg := s.registration()
+	reg.m.Lock()
+	attempt := reg.nickAttempts
+	reg.nickAttempts++
+	reg.m.Unlock()
+	if attempt < len(s.AltNicks) {
+		return s.AltNicks[attempt]
+	}
+	nick := s.primaryNick()
+	suffix := fmt.Sprintf("_%d", attempt-len(s.AltNicks)+1)
+	s.m.RLock()
+	max := s.support.NickLen
+	s.m.RUnlock()
+	if max > len(suffix) && len(nick)+len(suffix) > max {
+		nick = nick[:max-len(suffix)]
+	}
+	return nick + suffix
+}
+
+// handleNickInUse deals with the server refusing a nick. During registration
+// the next alternative is tried, afterwards the bot keeps the nick it has.
+//
+//	:server 433 * fake-user :Nickname is already in use.
+func (s *service) handleNickInUse(msg Message) {
+	reg := s.registration()
+	reg.m.Lock()
+	welcomed := reg.welcomed
+	attempts := reg.nickAttempts
+	reg.m.Unlock()
+	if welcomed {
+		log.Printf("Nick %s is unavailable, keeping %s", msg.Arg(1), s.CurrentNick())
+		return
+	}
+	if attempts >= len(s.AltNicks)+maxNickFallbackTries {
+		s.abortRegistration(fmt.Errorf("no usable nick found after %d attempts", attempts))
+		return
+	}
+
+	nick := s.nextNick()
+	log.Printf("Nick %s is unavailable (%s), trying %s", msg.Arg(1), msg.Command, nick)
+	s.setNick(nick)
+	s.enqueue(PriorityNormal, "NICK %s", nick)
+}
+
+// handleOwnNickChange keeps Username in step when the server changes our
+// nick, and stops watching for the primary nick once we have it back
+func (s *service) handleOwnNickChange(msg Message) {
+	nick := msg.Arg(0)
+	s.setNick(nick)
+	log.Printf("Nick is now %s", nick)
+	if s.isMe(s.primaryNick()) && s.monitorSupported() {
+		s.enqueue(PriorityLow, "MONITOR - %s", nick)
+	}
+}
+
+func (s *service) monitorSupported() bool {
+	reg := s.registration()
+	reg.m.Lock()
+	defer reg.m.Unlock()
+	return reg.monitor
+}
+
+// startNickRecovery begins watching for the primary nick to become free, once
+// registration is complete, if the bot did not get it. MONITOR is used when
+// the server has it, otherwise the nick is polled with ISON.
+func (s *service) startNickRecovery() {
+	primary := s.primaryNick()
+	if primary == "" || s.isMe(primary) {
+		return
+	}
+	log.Printf("Registered as %s, will try to recover %s", s.CurrentNick(), primary)
+	if s.monitorSupported() {
+		s.enqueue(PriorityLow, "MONITOR + %s", primary)
+		return
+	}
+
+	s.m.RLock()
+	done := s.reg.done
+	s.m.RUnlock()
+	go func() {
+		ticker := time.NewTicker(nickCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if s.isMe(primary) {
+					return
+				}
+				if err := s.write(PriorityLow, "ISON %s", primary); err != nil {
+					log.Printf("Error checking for %s %v", primary, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleNickWatch acts on the replies to MONITOR and ISON, taking the primary
+// nick when it is free and asking services to release it when it is not.
+//
+//	:server 730 me :fake-user!u@h       RPL_MONONLINE
+//	:server 731 me :fake-user           RPL_MONOFFLINE
+//	:server 303 me :fake-user           RPL_ISON, empty when offline
+func (s *service) handleNickWatch(msg Message) {
+	primary := s.primaryNick()
+	if primary == "" || s.isMe(primary) {
+		return
+	}
+	found := false
+	isSep := func(r rune) bool { return r == ' ' || r == ',' }
+	for _, target := range strings.FieldsFunc(msg.Trailing, isSep) {
+		if s.sameName(ParseSource(target).Nick, primary) {
+			found = true
+		}
+	}
+	online := found
+	if msg.Command == "730" || msg.Command == "731" {
+		// MONITOR replies may be about other nicks
+		if !found {
+			return
+		}
+		online = msg.Command == "730"
+	}
+
+	if !online {
+		log.Printf("Primary nick %s is free, taking it", primary)
+		s.enqueue(PriorityNormal, "NICK %s", primary)
+		return
+	}
+	s.regainNick(primary)
+}
+
+// regainNick asks NickServ to release the nick, at most once every
+// nickRegainInterval
+func (s *service) regainNick(primary string) {
+	if s.password == "" && s.saslMechanism() != SASLExternal {
+		return
+	}
+	reg := s.registration()
+	reg.m.Lock()
+	if time.Since(reg.lastRegain) < nickRegainInterval {
+		reg.m.Unlock()
+		return
+	}
+	reg.lastRegain = time.Now()
+	loggedIn := reg.loggedIn
+	reg.m.Unlock()
+
+	command := strings.ToUpper(s.NickRecovery)
+	if command == "" {
+		command = NickRegain
+	}
+	line := fmt.Sprintf("PRIVMSG NickServ :%s %s", command, primary)
+	// Services accept the command from the owner of the account without the
+	// password, only send it when we are not already identified
+	if !loggedIn && s.password != "" {
+		line = fmt.Sprintf("%s %s", line, s.password)
+	}
+	log.Printf("Asking NickServ to %s %s", command, primary)
+	s.enqueue(PriorityNormal, "%s", line)
+}
@@ -0,0 +1,137 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNickRecovery(t *testing.T) {
+	testcases := map[string]struct {
+		altNicks     []string
+		recovery     string
+		noSASL       bool
+		input        []string
+		writeHold    []string
+		expectedNick string
+	}{
+		"alternatives are tried in order": {
+			altNicks: []string{"fake-alt"},
+			input: []string{
+				":fake.server 433 * fake-user :Nickname is already in use.",
+				":fake.server 433 * fake-alt :Nickname is already in use.",
+				":fake.server 432 * fake-user_1 :Erroneous Nickname",
+			},
+			writeHold:    []string{"NICK fake-alt\r\n", "NICK fake-user_1\r\n", "NICK fake-user_2\r\n"},
+			expectedNick: "fake-user_2",
+		},
+		"numbered nicks fit within NICKLEN": {
+			input: []string{
+				":fake.server 005 * NICKLEN=9 :are supported by this server",
+				":fake.server 433 * fake-user :Nickname is already in use.",
+			},
+			writeHold:    []string{"NICK fake-us_1\r\n"},
+			expectedNick: "fake-us_1",
+		},
+		"welcome sets the nick": {
+			input: []string{
+				":fake.server 001 fake-user_1 :Welcome",
+			},
+			expectedNick: "fake-user_1",
+		},
+		"nick in use after registration is ignored": {
+			input: []string{
+				":fake.server 001 fake-alt :Welcome",
+				":fake.server 433 fake-alt fake-user :Nickname is already in use.",
+			},
+			expectedNick: "fake-alt",
+		},
+		"monitor takes the nick when it goes offline": {
+			input: []string{
+				":fake.server 001 fake-alt :Welcome",
+				":fake.server 005 fake-alt CHANTYPES=# MONITOR=100 :are supported by this server",
+				":fake.server 376 fake-alt :End of /MOTD command.",
+				":fake.server 731 fake-alt :fake-user",
+				":fake-alt!u@h NICK :fake-user",
+			},
+			writeHold:    []string{"MONITOR + fake-user\r\n", "NICK fake-user\r\n", "MONITOR - fake-user\r\n"},
+			expectedNick: "fake-user",
+		},
+		"monitor replies about other nicks are ignored": {
+			input: []string{
+				":fake.server 001 fake-alt :Welcome",
+				":fake.server 005 fake-alt MONITOR=100 :are supported by this server",
+				":fake.server 376 fake-alt :End of /MOTD command.",
+				":fake.server 731 fake-alt :someone-else",
+			},
+			writeHold:    []string{"MONITOR + fake-user\r\n"},
+			expectedNick: "fake-alt",
+		},
+		"services are asked to release a nick that is online": {
+			input: []string{
+				":fake.server 900 * fake-user!u@h fake-user :You are now logged in as fake-user",
+				":fake.server 001 fake-alt :Welcome",
+				":fake.server 005 fake-alt MONITOR=100 :are supported by this server",
+				":fake.server 422 fake-alt :MOTD File is missing",
+				":fake.server 730 fake-alt :fake-user!u@h",
+				":fake.server 730 fake-alt :fake-user!u@h",
+			},
+			writeHold:    []string{"MONITOR + fake-user\r\n", "PRIVMSG NickServ :REGAIN fake-user\r\n"},
+			expectedNick: "fake-alt",
+		},
+		"ghost includes the password when not identified": {
+			recovery: NickGhost,
+			noSASL:   true,
+			input: []string{
+				":fake.server 001 fake-alt :Welcome",
+				":fake.server 303 fake-alt :fake-user",
+			},
+			writeHold: []string{
+				"PRIVMSG NickServ :IDENTIFY fake-user fake-pass\r\n",
+				"PRIVMSG NickServ :GHOST fake-user fake-pass\r\n",
+			},
+			expectedNick: "fake-alt",
+		},
+		"ison takes the nick when it is free": {
+			noSASL: true,
+			input: []string{
+				":fake.server 001 fake-alt :Welcome",
+				":fake.server 303 fake-alt :",
+			},
+			writeHold: []string{
+				"PRIVMSG NickServ :IDENTIFY fake-user fake-pass\r\n",
+				"NICK fake-user\r\n",
+			},
+			expectedNick: "fake-alt",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			// an owner without a nick to watch keeps MONITOR to the
+			// primary nick
+			s, _ := NewService("*!*@user/fake-owner", []string{})
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			s.loginUser = "fake-user"
+			s.password = "fake-pass"
+			s.AltNicks = tc.altNicks
+			s.NickRecovery = tc.recovery
+			// registering with SASL avoids the NickServ fallback
+			s.reg.saslStarted = !tc.noSASL
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.input {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			assert.Equal(t, tc.expectedNick, s.CurrentNick())
+			s.reg.close()
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package IRC
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// accountPrefix marks an Owner entry as a services account rather than a
+// hostmask, following the extban syntax, eg `$a:fake-account`
+const accountPrefix = "$a:"
+
+// whoxToken tags our WHOX queries so the replies can be told apart from
+// anyone else's
+const whoxToken = "616"
+
+// Direct messages waiting on a WHOX reply are limited to maxPendingPerNick for
+// each sender, and maxPendingMessages in all, so that someone flooding the bot
+// with messages cannot grow its memory. Those past the limit are dropped.
+const (
+	maxPendingPerNick  = 5
+	maxPendingMessages = 100
+)
+
+// accounts remembers which services account each nick is logged in to, as
+// learned from extended-join, account-notify and WHOX. The cache is only
+// trusted while account-notify keeps it up to date. Nicks are folded before
+// they are used as keys.
+type accounts struct {
+	m     sync.Mutex
+	fold  func(string) string
+	nicks map[string]string
+	// pending are the direct messages waiting on a WHOX reply for the nick,
+	// waiting counts them
+	pending map[string][]Message
+	waiting int
+}
+
+func newAccounts(fold func(string) string) *accounts {
+	return &accounts{
+		fold:    fold,
+		nicks:   map[string]string{},
+		pending: map[string][]Message{},
+	}
+}
+
+func (a *accounts) set(nick, account string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.nicks[a.fold(nick)] = account
+}
+
+func (a *accounts) get(nick string) (string, bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	account, ok := a.nicks[a.fold(nick)]
+	return account, ok
+}
+
+func (a *accounts) rename(from, to string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	from, to = a.fold(from), a.fold(to)
+	if account, ok := a.nicks[from]; ok {
+		delete(a.nicks, from)
+		a.nicks[to] = account
+	}
+}
+
+func (a *accounts) forget(nick string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	delete(a.nicks, a.fold(nick))
+}
+
+// wait holds the message until the account of its sender is known. It reports
+// whether the message was held, which it is not once the sender or everyone
+// has too many waiting, and whether a lookup is already under way.
+func (a *accounts) wait(msg Message) (bool, bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	nick := a.fold(msg.Source.Nick)
+	msgs, inFlight := a.pending[nick]
+	if len(msgs) >= maxPendingPerNick || a.waiting >= maxPendingMessages {
+		return false, inFlight
+	}
+	a.pending[nick] = append(msgs, msg)
+	a.waiting++
+	return true, inFlight
+}
+
+func (a *accounts) release(nick string) []Message {
+	a.m.Lock()
+	defer a.m.Unlock()
+	nick = a.fold(nick)
+	msgs := a.pending[nick]
+	delete(a.pending, nick)
+	a.waiting -= len(msgs)
+	return msgs
+}
+
+// owners splits Owner, a comma separated list, into services accounts and
+// hostmask globs
+func (s *service) owners() ([]string, []string) {
+	accountOwners := []string{}
+	maskOwners := []string{}
+	for _, o := range strings.Split(s.Owner, ",") {
+		o = strings.TrimSpace(o)
+		switch {
+		case o == "":
+		case strings.HasPrefix(o, accountPrefix):
+			accountOwners = append(accountOwners, o[len(accountPrefix):])
+		default:
+			maskOwners = append(maskOwners, o)
+		}
+	}
+	return accountOwners, maskOwners
+}
+
+func (s *service) capEnabled(name string) bool {
+	reg := s.registration()
+	reg.m.Lock()
+	defer reg.m.Unlock()
+	_, ok := reg.acked[name]
+	return ok
+}
+
+// senderAccount returns the account the sender of the message is logged in to
+// ("" for none), and whether that is known
+func (s *service) senderAccount(msg Message) (string, bool) {
+	if account, ok := msg.Tags["account"]; ok {
+		return account, true
+	}
+	if s.capEnabled("account-tag") {
+		// the tag is only left off for senders that are not logged in
+		return "", true
+	}
+	if s.capEnabled("account-notify") {
+		return s.accountCache().get(msg.Source.Nick)
+	}
+	return "", false
+}
+
+// Account returns the services account the nick is logged in to, "" for none,
+// when it is known from extended-join, account-notify or WHOX
+func (s *service) Account(nick string) (string, bool) {
+	if !s.capEnabled("account-notify") {
+		return "", false
+	}
+	return s.accountCache().get(nick)
+}
+
+// handleDirect deals with a message sent directly to the bot. When the owner
+// is a services account and the sender's account is not yet known, it is
+// looked up with WHOX first.
+func (s *service) handleDirect(msg Message) {
+	accountOwners, _ := s.owners()
+	account, known := s.senderAccount(msg)
+	if !known && len(accountOwners) > 0 && s.whoxSupported() {
+		held, inFlight := s.accountCache().wait(msg)
+		if !held {
+			log.Printf("Dropped a direct message from %s, too many are waiting on their account", msg.Source)
+			return
+		}
+		if inFlight {
+			return
+		}
+		s.enqueue(PriorityNormal, "WHO %s %%tna,%s", msg.Source.Nick, whoxToken)
+		return
+	}
+	s.handleDirectFrom(msg, account, known)
+}
+
+// handleDirectFrom deals with a message sent directly to the bot once the
+// sender's account is known, or cannot be found out
+func (s *service) handleDirectFrom(msg Message, account string, known bool) {
+	owner := s.isOwner(msg.Source, account, known)
+	if owner {
+		s.noteOwner(msg.Source.Nick)
+	}
+	if _, ok := ctcpAction(msg.Trailing); ok {
+		// actions are never commands, and the owner's own are not kept
+		if !owner {
+			s.handlePrivate(msg, account)
+		}
+		return
+	}
+	if s.runCommand(msg, account, owner) {
+		return
+	}
+	s.handlePrivate(msg, account)
+}
+
+// isOwner checks the sender against Owner. Services accounts are checked
+// first, hostmasks are the fallback for when accounts are not in use, or the
+// sender's account is not known. A sender known to be logged in to another
+// account, or to none, is never matched by a hostmask.
+func (s *service) isOwner(src Source, account string, known bool) bool {
+	accountOwners, maskOwners := s.owners()
+	if account != "" {
+		for _, o := range accountOwners {
+			if strings.EqualFold(o, account) {
+				return true
+			}
+		}
+	}
+	if known && len(accountOwners) > 0 {
+		return false
+	}
+	for _, mask := range maskOwners {
+		if globMatch(mask, src.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAccountNumeric tracks accounts from WHOX replies, and deals with the
+// direct messages that were waiting on them
+//
+//	:server 354 me 616 fake-nick fake-account
+//	:server 315 me fake-nick :End of /WHO list.
+func (s *service) handleAccountNumeric(msg Message) {
+	cache := s.accountCache()
+	switch msg.Command {
+	case "354":
+		if msg.Arg(1) != whoxToken {
+			return
+		}
+		nick, account := msg.Arg(2), msg.Arg(3)
+		if account == "0" {
+			// WHOX uses 0 for no account
+			account = ""
+		}
+		if s.capEnabled("account-notify") {
+			cache.set(nick, account)
+		}
+		for _, m := range cache.release(nick) {
+			s.handleDirectFrom(m, account, true)
+		}
+		s.checkOwner(nick, account)
+	case "315":
+		// no reply for the nick, it has gone
+		for _, m := range cache.release(msg.Arg(1)) {
+			s.handleDirectFrom(m, "", false)
+		}
+		s.checkOwner(msg.Arg(1), "")
+	}
+}
+
+// trackAccount keeps the account cache up to date from extended-join, account
+// notify, nick changes and quits
+func (s *service) trackAccount(msg Message) {
+	cache := s.accountCache()
+	nick := msg.Source.Nick
+	switch msg.Command {
+	case "JOIN":
+		// extended-join  :nick!u@h JOIN #channel account :realname
+		if s.capEnabled("extended-join") && len(msg.Args()) > 1 {
+			account := msg.Arg(1)
+			if account == "*" {
+				account = ""
+			}
+			cache.set(nick, account)
+		}
+	case "ACCOUNT":
+		account := msg.Arg(0)
+		if account == "*" {
+			account = ""
+		}
+		cache.set(nick, account)
+	case "NICK":
+		cache.rename(nick, msg.Arg(0))
+	case "QUIT":
+		cache.forget(nick)
+	}
+}
+
+func (s *service) whoxSupported() bool {
+	reg := s.registration()
+	reg.m.Lock()
+	defer reg.m.Unlock()
+	return reg.whox
+}
+
+// globMatch matches s against a pattern where * matches any run of
+// characters and ? matches any single character, ignoring case, as hostmasks
+// are matched
+func globMatch(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	// p and i are where we are in pattern and s, star and mark remember
+	// the last * and where in s it was tried from, for backtracking
+	p, i, star, mark := 0, 0, -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			if pattern[p] == '?' {
+				_, size := utf8.DecodeRuneInString(s[i:])
+				i += size
+			} else {
+				i++
+			}
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
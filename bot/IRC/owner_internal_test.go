@@ -0,0 +1,233 @@
+package IRC
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwnerCommands(t *testing.T) {
+	testcases := map[string]struct {
+		owner     string
+		caps      []string
+		whox      bool
+		input     []string
+		writeHold []string
+	}{
+		"hostmask owner": {
+			owner:     "fake-owner!~fake-name@user/fake-owner",
+			input:     []string{":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :join #fake-channel"},
+			writeHold: []string{"JOIN #fake-channel\r\n"},
+		},
+		"hostmask glob owner": {
+			owner:     "*!*@user/fake-owner",
+			input:     []string{":fake-other!~other@user/fake-owner PRIVMSG fake-user :join #fake-channel"},
+			writeHold: []string{"JOIN #fake-channel\r\n"},
+		},
+		"hostmask glob does not match": {
+			owner: "*!*@user/fake-owner",
+			input: []string{":fake-owner!~fake-name@some.host PRIVMSG fake-user :join #fake-channel"},
+		},
+		"account from the account tag": {
+			owner:     "$a:fake-account",
+			caps:      []string{"account-tag"},
+			input:     []string{"@account=fake-account :fake-nick!~u@some.host PRIVMSG fake-user :join #fake-channel"},
+			writeHold: []string{"JOIN #fake-channel\r\n"},
+		},
+		"sender without the account tag is not logged in": {
+			owner: "$a:fake-account",
+			caps:  []string{"account-tag"},
+			whox:  true,
+			input: []string{":fake-nick!~u@some.host PRIVMSG fake-user :join #fake-channel"},
+		},
+		"account from extended join": {
+			owner: "$a:fake-account",
+			caps:  []string{"account-notify", "extended-join"},
+			input: []string{
+				":fake-nick!~u@some.host JOIN #fake-channel fake-account :Fake Name",
+				":fake-nick!~u@some.host PRIVMSG fake-user :part #fake-channel",
+			},
+			writeHold: []string{"PART #fake-channel\r\n"},
+		},
+		"account follows nick changes": {
+			owner: "$a:fake-account",
+			caps:  []string{"account-notify", "extended-join"},
+			input: []string{
+				":fake-nick!~u@some.host JOIN #fake-channel fake-account :Fake Name",
+				":fake-nick!~u@some.host NICK fake-renamed",
+				":fake-renamed!~u@some.host PRIVMSG fake-user :part #fake-channel",
+			},
+			writeHold: []string{"PART #fake-channel\r\n"},
+		},
+		"logging out of the account removes ownership": {
+			owner: "$a:fake-account",
+			caps:  []string{"account-notify", "extended-join"},
+			input: []string{
+				":fake-nick!~u@some.host JOIN #fake-channel fake-account :Fake Name",
+				":fake-nick!~u@some.host ACCOUNT *",
+				":fake-nick!~u@some.host PRIVMSG fake-user :part #fake-channel",
+			},
+		},
+		"account looked up with whox": {
+			owner: "$a:fake-account",
+			whox:  true,
+			input: []string{
+				":fake-nick!~u@some.host PRIVMSG fake-user :join #fake-channel",
+				":fake-nick!~u@some.host PRIVMSG fake-user :part #second-fake-channel",
+				":fake.server 354 fake-user 616 fake-nick fake-account",
+				":fake.server 315 fake-user fake-nick :End of /WHO list.",
+			},
+			writeHold: []string{
+				"WHO fake-nick %tna,616\r\n",
+				"JOIN #fake-channel\r\n",
+				"PART #second-fake-channel\r\n",
+			},
+		},
+		"whox reply without an account": {
+			owner: "$a:fake-account",
+			whox:  true,
+			input: []string{
+				":fake-nick!~u@some.host PRIVMSG fake-user :join #fake-channel",
+				":fake.server 354 fake-user 616 fake-nick 0",
+			},
+			writeHold: []string{"WHO fake-nick %tna,616\r\n"},
+		},
+		"whox replies for other queries are ignored": {
+			owner: "$a:fake-account",
+			whox:  true,
+			input: []string{
+				":fake-nick!~u@some.host PRIVMSG fake-user :join #fake-channel",
+				":fake.server 354 fake-user 1 fake-nick fake-account",
+			},
+			writeHold: []string{"WHO fake-nick %tna,616\r\n"},
+		},
+		"hostmask fallback without account support": {
+			owner:     "$a:fake-account,fake-owner!*@user/fake-owner",
+			input:     []string{":fake-owner!~fake-name@user/fake-owner PRIVMSG fake-user :join #fake-channel"},
+			writeHold: []string{"JOIN #fake-channel\r\n"},
+		},
+		"hostmask is not used when another account is known": {
+			owner: "$a:fake-account,*!*@*.example",
+			caps:  []string{"account-tag"},
+			input: []string{"@account=someone-else :fake-nick!~u@evil.example PRIVMSG fake-user :join #fake-channel"},
+		},
+		"hostmask is not used for a sender known to be logged out": {
+			owner: "$a:fake-account,*!*@*.example",
+			caps:  []string{"account-tag"},
+			input: []string{":fake-nick!~u@evil.example PRIVMSG fake-user :join #fake-channel"},
+		},
+		"hostmask owners alone still match when accounts are known": {
+			owner:     "*!*@user/fake-owner",
+			caps:      []string{"account-tag"},
+			input:     []string{"@account=someone :fake-nick!~u@user/fake-owner PRIVMSG fake-user :join #fake-channel"},
+			writeHold: []string{"JOIN #fake-channel\r\n"},
+		},
+		"messages from others are not sent back to them": {
+			owner: "$a:fake-account",
+			caps:  []string{"account-tag"},
+			input: []string{":fake-nick!~u@some.host PRIVMSG fake-user :hello there"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService(tc.owner, []string{})
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			for _, c := range tc.caps {
+				s.reg.acked[c] = struct{}{}
+			}
+			s.reg.whox = tc.whox
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.input {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	testcases := map[string]struct {
+		pattern  string
+		input    string
+		expected bool
+	}{
+		"exact":              {pattern: "nick!user@host", input: "nick!user@host", expected: true},
+		"case is ignored":    {pattern: "Nick!User@Host", input: "nick!user@host", expected: true},
+		"star":               {pattern: "*!*@user/fake", input: "nick!~u@user/fake", expected: true},
+		"star matches empty": {pattern: "nick*!user@host", input: "nick!user@host", expected: true},
+		"question mark":      {pattern: "nic?!user@host", input: "nick!user@host", expected: true},
+		"backtracking":       {pattern: "*a*b", input: "xaxaxb", expected: true},
+		"no match":           {pattern: "*!*@user/fake", input: "nick!~u@user/other", expected: false},
+		"trailing text":      {pattern: "nick", input: "nick!user@host", expected: false},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, globMatch(tc.pattern, tc.input))
+		})
+	}
+}
+
+func TestAccount(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.Username = "fake-user"
+	s.processLine(":fake-nick!~u@some.host JOIN #fake-channel fake-account :Fake Name")
+	_, known := s.Account("fake-nick")
+	assert.False(t, known, "the cache is not trusted without account-notify")
+
+	s.reg.acked["account-notify"] = struct{}{}
+	s.reg.acked["extended-join"] = struct{}{}
+	s.processLine(":fake-nick!~u@some.host JOIN #fake-channel fake-account :Fake Name")
+	account, known := s.Account("Fake-Nick")
+	assert.True(t, known)
+	assert.Equal(t, "fake-account", account)
+}
+
+func TestPendingDirectMessagesAreLimited(t *testing.T) {
+	s, _ := NewService("$a:fake-account", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.Username = "fake-user"
+	s.reg.whox = true
+	writeErr = nil
+	writeHold = []string{}
+
+	// one sender cannot have more than maxPendingPerNick waiting
+	channels := []string{}
+	for i := 0; i < maxPendingPerNick+2; i++ {
+		channel := fmt.Sprintf("#fake-channel-%d", i)
+		if i < maxPendingPerNick {
+			channels = append(channels, channel)
+		}
+		s.processLine(":fake-nick!~u@some.host PRIVMSG fake-user :join " + channel)
+	}
+	s.processLine(":fake.server 354 fake-user 616 fake-nick fake-account")
+	s.sendQueue().drain()
+	assert.Equal(t, []string{"WHO fake-nick %tna,616\r\n", "JOIN " + strings.Join(channels, ",") + "\r\n"}, writeHold)
+	assert.Equal(t, 0, s.accounts.waiting)
+}
+
+func TestPendingTotalIsLimited(t *testing.T) {
+	a := newAccounts(strings.ToLower)
+	for i := 0; i < maxPendingMessages; i++ {
+		held, _ := a.wait(Message{Source: Source{Nick: fmt.Sprintf("fake-nick-%d", i/maxPendingPerNick)}})
+		assert.True(t, held)
+	}
+	held, inFlight := a.wait(Message{Source: Source{Nick: "fake-late"}})
+	assert.False(t, held, "past maxPendingMessages nothing is held")
+	assert.False(t, inFlight)
+
+	assert.Len(t, a.release("Fake-Nick-0"), maxPendingPerNick)
+	assert.Equal(t, maxPendingMessages-maxPendingPerNick, a.waiting)
+	held, inFlight = a.wait(Message{Source: Source{Nick: "fake-late"}})
+	assert.True(t, held)
+	assert.False(t, inFlight)
+}
@@ -0,0 +1,292 @@
+package IRC
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Ports used for a proxy that does not give one
+const (
+	defaultSOCKS5Port = "1080"
+	defaultHTTPPort   = "8080"
+)
+
+// proxyTimeout bounds the handshake with the proxy, so that a proxy that
+// accepts the connection but never answers does not hang Connect
+const proxyTimeout = 30 * time.Second
+
+// ParseProxy checks a proxy URL, socks5://[user:pass@]host[:port] or
+// http://[user:pass@]host[:port], filling in the default port. Errors never
+// hold the password.
+func ParseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// url.Error repeats the raw url
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("proxy is not a url %w", err)
+	}
+	var port string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		port = defaultSOCKS5Port
+	case "http":
+		port = defaultHTTPPort
+	default:
+		return nil, fmt.Errorf("proxy %q has unknown scheme %q, expected socks5 or http", u.Redacted(), u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q has no host", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// dialProxy connects to the server through the proxy, then starts TLS over
+// the tunnel when a config is supplied. The deadline is kept until the TLS
+// handshake is done, so that a stalled handshake does not hang Connect.
+func dialProxy(proxy *url.URL, server string, config *tls.Config) (net.Conn, error) {
+	conn, err := netDial("tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s produced %w", proxy.Host, err)
+	}
+	if err = conn.SetDeadline(time.Now().Add(proxyTimeout)); err == nil {
+		switch proxy.Scheme {
+		case "http":
+			conn, err = httpConnect(conn, proxy, server)
+		default:
+			err = socks5Connect(conn, proxy, server)
+		}
+	}
+	if err == nil && config == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s could not reach %s %w", proxy.Host, server, err)
+	}
+	if config == nil {
+		return conn, nil
+	}
+
+	// tls.Dial would take the server name from the address, tls.Client
+	// needs to be told it
+	if config.ServerName == "" {
+		host, _, splitErr := net.SplitHostPort(server)
+		if splitErr != nil {
+			host = server
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := conn.SetDeadline(time.Now().Add(proxyTimeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s could not reach %s %w", proxy.Host, server, err)
+	}
+	err = tlsConn.Handshake()
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s through proxy %s produced %w", server, proxy.Host, err)
+	}
+	return tlsConn, nil
+}
+
+// SOCKS5 protocol values, from RFC 1928 and RFC 1929
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+	socks5AuthVersion  = 0x01
+)
+
+var socks5Errors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to addr, logging in
+// when the proxy URL has a user. Host names are resolved by the proxy.
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port in %q", addr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if proxy.User != nil {
+		methods = []byte{socks5UserPass}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("proxy is not SOCKS5, it replied with version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if proxy.User == nil {
+			return fmt.Errorf("proxy wants a user and password")
+		}
+		if err := socks5Login(conn, proxy.User); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return fmt.Errorf("proxy accepts none of our authentication methods")
+	default:
+		return fmt.Errorf("proxy chose unknown authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host %q is too long for SOCKS5", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address and port, which are not
+	// needed but must be read past
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		msg, ok := socks5Errors[head[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown error %d", head[1])
+		}
+		return fmt.Errorf("proxy refused the connection, %s", msg)
+	}
+	var skip int
+	switch head[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return fmt.Errorf("proxy replied with unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// socks5Login sends the user and password, RFC 1929
+func socks5Login(conn net.Conn, user *url.Userinfo) error {
+	name := user.Username()
+	pass, _ := user.Password()
+	if len(name) > 255 || len(pass) > 255 {
+		return fmt.Errorf("proxy user or password is too long for SOCKS5")
+	}
+	req := []byte{socks5AuthVersion, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("proxy rejected the user and password")
+	}
+	return nil
+}
+
+// httpConnect asks the HTTP proxy on conn to open a tunnel to addr. Anything
+// the server sends straight after the proxy's reply is kept for the caller
+// to read.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy refused the connection, %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn reads through the buffer that was used to read the proxy's
+// reply, so that nothing the server has already sent is lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,416 @@
+package IRC
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority orders lines waiting in the send queue
+type Priority int
+
+const (
+	// PriorityLow is for lines that can wait behind everything else
+	PriorityLow Priority = iota
+	// PriorityNormal is for most commands and messages
+	PriorityNormal
+	// PriorityHigh jumps the queue and is not held back by flood control,
+	// it is for PONG and QUIT
+	PriorityHigh
+)
+
+// Defaults for flood control, a burst of 5 lines and then one line every two
+// seconds keeps us clear of the excess flood limits of the common ircds
+const (
+	defaultFloodBurst = 5
+	defaultFloodRate  = 2 * time.Second
+)
+
+// maxLineLength is the longest line a client may send, excluding the CRLF
+const maxLineLength = 510
+
+// errConnectionGone is the result of lines that were queued for a connection
+// that was closed before they could be sent
+var errConnectionGone = errors.New("connection closed before the line was sent")
+
+// errNotConnected is the result of lines sent before Connect
+var errNotConnected = errors.New("not connected")
+
+type queuedLine struct {
+	line string
+	// more are the lines of a group written straight after line, with the
+	// same token, such as the rest of a draft/multiline batch
+	more     []string
+	priority Priority
+	// connection is the queue's connection count when the line was added
+	connection int
+	// result is nil for lines that nobody waits on, their errors are logged
+	result chan error
+}
+
+// sendQueue paces the lines written to the server with a token bucket, so
+// that the server never kills the bot for flooding. It is safe for concurrent
+// callers.
+type sendQueue struct {
+	m     sync.Mutex
+	lines [PriorityHigh + 1][]*queuedLine
+	wake  chan struct{}
+	// pending counts the lines, and groups, not yet written, idle is
+	// signalled when it reaches zero
+	pending int
+	idle    *sync.Cond
+	// connection counts the calls to clear, lines queued before the last
+	// one are never written
+	connection int
+	// stopped is set once run has returned, lines added afterwards fail
+	stopped bool
+	tokens  float64
+	burst   float64
+	rate    time.Duration
+	last    time.Time
+
+	write func(string) error
+	// maxTargets is how many targets a command may have, 0 for no limit,
+	// it caps the JOIN batches when it is set
+	maxTargets func(command string) int
+	// expose these to enable them to be faked for testing
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newSendQueue(burst int, rate time.Duration, write func(string) error) *sendQueue {
+	if burst <= 0 {
+		burst = defaultFloodBurst
+	}
+	if rate <= 0 {
+		rate = defaultFloodRate
+	}
+	q := &sendQueue{
+		wake:   make(chan struct{}, 1),
+		tokens: float64(burst),
+		burst:  float64(burst),
+		rate:   rate,
+		write:  write,
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+	q.last = q.now()
+	q.idle = sync.NewCond(&q.m)
+	return q
+}
+
+// push adds the lines to the queue together, so that JOINs can be batched.
+// The returned channels receive the result of writing each line.
+func (q *sendQueue) push(p Priority, lines ...string) []<-chan error {
+	return q.add(p, true, groupEach(lines))
+}
+
+// enqueue adds the lines to the queue like push, without waiting on them,
+// failures to write them are logged
+func (q *sendQueue) enqueue(p Priority, lines ...string) {
+	q.add(p, false, groupEach(lines))
+}
+
+// pushGroups adds groups of lines to the queue, the lines of a group are
+// written together for a single token, so that flood control never splits a
+// draft/multiline batch. The returned channels receive the result of writing
+// each group.
+func (q *sendQueue) pushGroups(p Priority, groups ...[]string) []<-chan error {
+	return q.add(p, true, groups)
+}
+
+// enqueueGroups adds the groups to the queue like pushGroups, without waiting
+// on them
+func (q *sendQueue) enqueueGroups(p Priority, groups ...[]string) {
+	q.add(p, false, groups)
+}
+
+// groupEach puts each line in a group of its own
+func groupEach(lines []string) [][]string {
+	groups := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		groups = append(groups, []string{line})
+	}
+	return groups
+}
+
+func (q *sendQueue) add(p Priority, wait bool, groups [][]string) []<-chan error {
+	results := make([]<-chan error, 0, len(groups))
+	q.m.Lock()
+	if q.stopped {
+		q.m.Unlock()
+		for range groups {
+			if wait {
+				result := make(chan error, 1)
+				result <- errConnectionGone
+				results = append(results, result)
+			}
+		}
+		return results
+	}
+	for _, group := range groups {
+		ql := &queuedLine{line: group[0], more: group[1:], priority: p, connection: q.connection}
+		if wait {
+			ql.result = make(chan error, 1)
+			results = append(results, ql.result)
+		}
+		q.lines[p] = append(q.lines[p], ql)
+	}
+	q.pending += len(groups)
+	q.m.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return results
+}
+
+// clear fails every line still waiting, for when the connection they were
+// queued for has gone, so that they are not sent ahead of the next
+// registration. A line already waiting for a token is failed too.
+func (q *sendQueue) clear() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.connection++
+	dropped := 0
+	for p := range q.lines {
+		for _, ql := range q.lines[p] {
+			if ql.result != nil {
+				ql.result <- errConnectionGone
+			}
+		}
+		dropped += len(q.lines[p])
+		q.lines[p] = nil
+	}
+	if dropped == 0 {
+		return
+	}
+	log.Printf("Dropped %d queued lines, the connection has gone", dropped)
+	q.pending -= dropped
+	if q.pending == 0 {
+		q.idle.Broadcast()
+	}
+}
+
+// stop fails the lines still waiting, and marks the queue as stopped so that
+// later ones fail too
+func (q *sendQueue) stop() {
+	q.m.Lock()
+	q.stopped = true
+	q.m.Unlock()
+	q.clear()
+}
+
+// drain waits until every line queued so far has been written, or dropped
+func (q *sendQueue) drain() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for q.pending > 0 {
+		q.idle.Wait()
+	}
+}
+
+// run writes queued lines until stop is closed. The lines still waiting then,
+// and any added later, fail.
+func (q *sendQueue) run(stop <-chan struct{}) {
+	defer q.stop()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		batch := q.next()
+		if batch == nil {
+			select {
+			case <-stop:
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		if batch[0].priority != PriorityHigh {
+			q.waitForToken()
+		} else {
+			q.takeToken()
+		}
+		line := joinBatch(batch)
+		q.m.Lock()
+		gone := batch[0].connection != q.connection
+		q.m.Unlock()
+		err := errConnectionGone
+		if !gone {
+			err = q.write(line)
+			// a JOIN batch is never a group, so only the first can have
+			// more lines
+			for _, more := range batch[0].more {
+				if err != nil {
+					break
+				}
+				err = q.write(more)
+			}
+		}
+		logged := false
+		for _, ql := range batch {
+			if ql.result != nil {
+				ql.result <- err
+			} else if err != nil && !logged {
+				// only the command is logged, the line may hold a
+				// password
+				log.Printf("Error sending %s %v", strings.Fields(line)[0], err)
+				logged = true
+			}
+		}
+		q.m.Lock()
+		q.pending -= len(batch)
+		if q.pending == 0 {
+			q.idle.Broadcast()
+		}
+		q.m.Unlock()
+	}
+}
+
+// next removes the highest priority line from the queue. A keyless JOIN is
+// returned along with the keyless JOINs queued behind it at the same priority,
+// so that they can be sent as a single line, within the server's TARGMAX.
+func (q *sendQueue) next() []*queuedLine {
+	max := 0
+	if q.maxTargets != nil {
+		max = q.maxTargets("JOIN")
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	for p := PriorityHigh; p >= PriorityLow; p-- {
+		if len(q.lines[p]) == 0 {
+			continue
+		}
+		first := q.lines[p][0]
+		q.lines[p] = q.lines[p][1:]
+		batch := []*queuedLine{first}
+		if _, ok := joinChannel(first); !ok {
+			return batch
+		}
+		length := len(first.line)
+		rest := q.lines[p][:0]
+		for _, ql := range q.lines[p] {
+			channel, ok := joinChannel(ql)
+			if ok && length+1+len(channel) <= maxLineLength && (max == 0 || len(batch) < max) {
+				batch = append(batch, ql)
+				length += 1 + len(channel)
+				continue
+			}
+			rest = append(rest, ql)
+		}
+		q.lines[p] = rest
+		return batch
+	}
+	return nil
+}
+
+// joinChannel returns the channel of a JOIN line without a key, a line with
+// more in its group is never batched
+func joinChannel(ql *queuedLine) (string, bool) {
+	if len(ql.more) > 0 {
+		return "", false
+	}
+	fields := strings.Fields(ql.line)
+	if len(fields) != 2 || fields[0] != "JOIN" || strings.Contains(fields[1], ",") {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func joinBatch(batch []*queuedLine) string {
+	if len(batch) == 1 {
+		return batch[0].line
+	}
+	channels := make([]string, 0, len(batch))
+	for _, ql := range batch {
+		c, _ := joinChannel(ql)
+		channels = append(channels, c)
+	}
+	return "JOIN " + strings.Join(channels, ",")
+}
+
+// refill adds the tokens earned since the last refill
+func (q *sendQueue) refill() {
+	now := q.now()
+	q.tokens += float64(now.Sub(q.last)) / float64(q.rate)
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	q.last = now
+}
+
+// waitForToken blocks until a line may be sent, and uses up the token
+func (q *sendQueue) waitForToken() {
+	q.refill()
+	if q.tokens < 1 {
+		q.sleep(time.Duration((1 - q.tokens) * float64(q.rate)))
+		q.refill()
+	}
+	q.tokens--
+}
+
+// takeToken uses up a token without waiting, if there is one, so that lines
+// that skip flood control still count towards it
+func (q *sendQueue) takeToken() {
+	q.refill()
+	if q.tokens >= 1 {
+		q.tokens--
+	}
+}
+
+// write queues a line for the server, and waits until it has been sent. The
+// reader must not wait on flood control, it uses enqueue instead.
+func (s *service) write(p Priority, format string, args ...interface{}) error {
+	return <-s.sendQueue().push(p, fmt.Sprintf(format, args...))[0]
+}
+
+// enqueue queues a line for the server without waiting for it to be sent, so
+// that lines sent while handling what the server said never stop the bot
+// reading, and answering PINGs
+func (s *service) enqueue(p Priority, format string, args ...interface{}) {
+	s.sendQueue().enqueue(p, fmt.Sprintf(format, args...))
+}
+
+// sendQueue returns the queue, starting it on first use so that the flood
+// control settings can be changed after NewService
+func (s *service) sendQueue() *sendQueue {
+	s.queueOnce.Do(func() {
+		s.queue = newSendQueue(s.FloodBurst, s.FloodRate, s.writeLine)
+		s.queue.maxTargets = s.maxTargets
+		go s.queue.run(s.queueStop)
+	})
+	return s.queue
+}
+
+// stopQueue stops the writer, once the bot has quit and nothing more is to be
+// sent
+func (s *service) stopQueue() {
+	s.queueStopOnce.Do(func() {
+		close(s.queueStop)
+	})
+}
+
+// maxTargets is how many targets the server accepts for the command
+func (s *service) maxTargets(command string) int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.support.MaxTargets(command)
+}
+
+// writeLine writes directly to the current connection, only the send queue
+// should call it
+func (s *service) writeLine(line string) error {
+	s.m.RLock()
+	w := s.writer
+	s.m.RUnlock()
+	if w == nil {
+		return errNotConnected
+	}
+	return w.PrintfLine("%s", line)
+}
@@ -0,0 +1,235 @@
+package IRC
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendQueueOrder(t *testing.T) {
+	long := "#" + strings.Repeat("c", 300)
+	testcases := map[string]struct {
+		low      []string
+		normal   []string
+		high     []string
+		maxJoins int
+		expected []string
+	}{
+		"priority order": {
+			low:      []string{"ISON fake-user"},
+			normal:   []string{"PRIVMSG #fake-channel :hi", "PRIVMSG #fake-channel :there"},
+			high:     []string{"PONG :fake.server"},
+			expected: []string{"PONG :fake.server", "PRIVMSG #fake-channel :hi", "PRIVMSG #fake-channel :there", "ISON fake-user"},
+		},
+		"joins are batched": {
+			normal: []string{"JOIN #a", "PRIVMSG #a :hi", "JOIN #b", "JOIN #c"},
+			expected: []string{
+				"JOIN #a,#b,#c",
+				"PRIVMSG #a :hi",
+			},
+		},
+		"joins with keys are not batched": {
+			normal:   []string{"JOIN #a", "JOIN #b key", "JOIN #c"},
+			expected: []string{"JOIN #a,#c", "JOIN #b key"},
+		},
+		"batches stay within TARGMAX": {
+			normal:   []string{"JOIN #a", "JOIN #b", "JOIN #c"},
+			maxJoins: 2,
+			expected: []string{"JOIN #a,#b", "JOIN #c"},
+		},
+		"batches stay within the line length": {
+			normal:   []string{"JOIN " + long, "JOIN " + long + "2", "JOIN #short"},
+			expected: []string{"JOIN " + long + ",#short", "JOIN " + long + "2"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			q := newSendQueue(0, 0, nil)
+			q.maxTargets = func(string) int { return tc.maxJoins }
+			q.push(PriorityLow, tc.low...)
+			q.push(PriorityNormal, tc.normal...)
+			q.push(PriorityHigh, tc.high...)
+			got := []string{}
+			for batch := q.next(); batch != nil; batch = q.next() {
+				got = append(got, joinBatch(batch))
+			}
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestSendQueueFloodControl(t *testing.T) {
+	now := time.Now()
+	slept := []time.Duration{}
+	written := []string{}
+	q := newSendQueue(2, time.Second, func(line string) error {
+		written = append(written, line)
+		return nil
+	})
+	q.now = func() time.Time { return now }
+	q.last = now
+	q.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+
+	results := q.push(PriorityNormal, "PRIVMSG #a :1", "PRIVMSG #a :2", "PRIVMSG #a :3", "PRIVMSG #a :4")
+	for _, r := range results {
+		assert.Nil(t, <-r)
+	}
+	// the burst goes straight out, then one line a second
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, slept)
+
+	// high priority lines are never held back
+	assert.Nil(t, <-q.push(PriorityHigh, "PONG :fake.server")[0])
+	assert.Len(t, slept, 2)
+	assert.Equal(t, "PONG :fake.server", written[len(written)-1])
+}
+
+func TestSendQueueGroups(t *testing.T) {
+	now := time.Now()
+	slept := []time.Duration{}
+	written := []string{}
+	q := newSendQueue(1, time.Second, func(line string) error {
+		written = append(written, line)
+		return nil
+	})
+	q.now = func() time.Time { return now }
+	q.last = now
+	q.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+
+	batch := []string{"BATCH +ml1 draft/multiline #a", "@batch=ml1 PRIVMSG #a :1", "@batch=ml1 PRIVMSG #a :2", "BATCH -ml1"}
+	results := q.pushGroups(PriorityNormal, batch, []string{"PRIVMSG #a :3"})
+	assert.Len(t, results, 2)
+	for _, r := range results {
+		assert.Nil(t, <-r)
+	}
+	// the batch is written whole for the one token in the burst
+	assert.Equal(t, append(batch, "PRIVMSG #a :3"), written)
+	assert.Equal(t, []time.Duration{time.Second}, slept)
+}
+
+func TestSendQueueWriteError(t *testing.T) {
+	q := newSendQueue(0, 0, func(line string) error {
+		return fmt.Errorf("fake-write-error")
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	results := q.push(PriorityNormal, "JOIN #a", "JOIN #b")
+	for _, r := range results {
+		assert.EqualError(t, <-r, "fake-write-error")
+	}
+}
+
+func TestSendQueueBatchWriteError(t *testing.T) {
+	q := newSendQueue(0, 0, func(line string) error {
+		return fmt.Errorf("fake-write-error")
+	})
+	// the JOINs are batched into one line, which fails for everyone waiting
+	// on it, whether or not a line before them is waited on
+	q.enqueue(PriorityNormal, "JOIN #a")
+	results := q.push(PriorityNormal, "JOIN #b", "JOIN #c")
+	q.enqueue(PriorityNormal, "JOIN #d")
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	for _, r := range results {
+		select {
+		case err := <-r:
+			assert.EqualError(t, err, "fake-write-error")
+		case <-time.After(5 * time.Second):
+			t.Fatal("waited on a line that failed")
+		}
+	}
+	q.drain()
+}
+
+func TestSendQueueEnqueue(t *testing.T) {
+	release := make(chan struct{})
+	written := []string{}
+	q := newSendQueue(0, 0, func(line string) error {
+		<-release
+		written = append(written, line)
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	// the writer is held, enqueue must not wait on it
+	q.enqueue(PriorityNormal, "PRIVMSG #a :hi", "PRIVMSG #a :there")
+	q.enqueue(PriorityHigh, "PONG :fake.server")
+	close(release)
+	q.drain()
+	assert.Len(t, written, 3)
+	assert.Contains(t, written, "PONG :fake.server")
+}
+
+func TestSendQueueClear(t *testing.T) {
+	sleeping := make(chan struct{})
+	release := make(chan struct{})
+	written := make(chan string, 5)
+	q := newSendQueue(1, time.Hour, func(line string) error {
+		written <- line
+		return nil
+	})
+	q.sleep = func(time.Duration) {
+		close(sleeping)
+		<-release
+	}
+	first := q.push(PriorityNormal, "PRIVMSG #a :one")[0]
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.run(stop)
+	assert.Nil(t, <-first)
+	// the second line is waiting for a token, the third is still queued
+	results := q.push(PriorityNormal, "PRIVMSG #a :two", "PRIVMSG #a :three")
+	<-sleeping
+	q.clear()
+	close(release)
+	for _, r := range results {
+		assert.Equal(t, errConnectionGone, <-r)
+	}
+	q.drain()
+	assert.Equal(t, "PRIVMSG #a :one", <-written)
+	assert.Empty(t, written)
+}
+
+func TestSendQueueStop(t *testing.T) {
+	q := newSendQueue(0, 0, func(line string) error {
+		return nil
+	})
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		q.run(stop)
+		close(stopped)
+	}()
+	assert.Nil(t, <-q.push(PriorityNormal, "PRIVMSG #a :one")[0])
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the writer did not stop")
+	}
+	// nothing is written once the writer has stopped, and nobody waits on it
+	assert.Equal(t, errConnectionGone, <-q.push(PriorityNormal, "PRIVMSG #a :two")[0])
+	q.drain()
+}
+
+func TestWriteNotConnected(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	assert.Equal(t, errNotConnected, s.write(PriorityNormal, "PING :fake"))
+}
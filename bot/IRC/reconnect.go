@@ -0,0 +1,119 @@
+package IRC
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Defaults for the delay between reconnection attempts
+const (
+	defaultReconnectDelay    = time.Second
+	defaultMaxReconnectDelay = 5 * time.Minute
+)
+
+// expose as a package global to enable it to be faked for testing
+var sleep = time.Sleep
+
+// backoff produces exponentially growing, jittered delays so that a restart
+// loop does not hammer the network.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+// next returns the delay before the next attempt. Half of the delay is fixed
+// and the other half is random, so consecutive attempts never happen
+// immediately but several bots do not retry in lockstep.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	// guard the shift against overflowing
+	if b.attempt < 32 {
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.attempt++
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// reset starts the delays from the minimum again, after a connection has
+// succeeded
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// reconnect keeps trying to connect and log in to the server again, waiting
+// longer between each attempt. Channels are rejoined as part of the normal
+// registration flow once the server says we are ready. It gives up without an
+// error when the bot is stopped, and with the error when it is a ConfigError,
+// as trying again cannot help.
+func (s *service) reconnect() error {
+	if s.server == "" {
+		return fmt.Errorf("cannot reconnect, Connect was never called")
+	}
+	for {
+		delay := s.retry.next()
+		log.Printf("Reconnecting to %s in %v", s.server, delay)
+		s.emit(EventReconnecting)
+		if !s.wait(delay) {
+			return nil
+		}
+
+		var cfgErr *ConfigError
+		if err := s.Connect(s.server, s.useTLS); err != nil {
+			if errors.As(err, &cfgErr) {
+				return fmt.Errorf("reconnect failed %w", err)
+			}
+			log.Printf("Reconnect failed %v", err)
+			continue
+		}
+		if err := s.Login(s.loginUser, s.password); err != nil {
+			s.closeConnection()
+			if errors.As(err, &cfgErr) {
+				return fmt.Errorf("login after reconnect failed %w", err)
+			}
+			log.Printf("Login after reconnect failed %v", err)
+			continue
+		}
+		if s.isQuitting() {
+			s.closeConnection()
+		}
+		return nil
+	}
+}
+
+// wait sleeps for the delay, returning false early when the bot is stopped
+func (s *service) wait(delay time.Duration) bool {
+	slept := make(chan struct{})
+	go func() {
+		sleep(delay)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+		return !s.isQuitting()
+	case <-s.stopping:
+		return false
+	}
+}
+
+// closeConnection drops the current connection without sending QUIT, for
+// when the connection is already broken, and drops the lines queued for it.
+// The error from closing it is logged and returned.
+func (s *service) closeConnection() error {
+	s.sendQueue().clear()
+	conn := s.conn()
+	if conn == nil {
+		return nil
+	}
+	if err := conn.Close(); err != nil {
+		log.Printf("Error closing connection %v", err)
+		return err
+	}
+	return nil
+}
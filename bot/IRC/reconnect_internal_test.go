@@ -0,0 +1,153 @@
+package IRC
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+	testcases := []struct {
+		low  time.Duration
+		high time.Duration
+	}{
+		{500 * time.Millisecond, time.Second},
+		{time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{4 * time.Second, 8 * time.Second},
+		{5 * time.Second, 10 * time.Second},
+		{5 * time.Second, 10 * time.Second},
+	}
+	for i, tc := range testcases {
+		d := b.next()
+		assert.True(t, d >= tc.low && d <= tc.high, "attempt %d got %v, expected between %v and %v", i, d, tc.low, tc.high)
+	}
+
+	b.reset()
+	d := b.next()
+	assert.True(t, d >= 500*time.Millisecond && d <= time.Second, "after reset got %v", d)
+
+	// a very large number of attempts must not overflow into a tiny delay
+	b.attempt = 70
+	d = b.next()
+	assert.True(t, d >= 5*time.Second && d <= 10*time.Second, "after many attempts got %v", d)
+}
+
+func TestReconnect(t *testing.T) {
+	testcases := map[string]struct {
+		dialErrs  []error
+		server    string
+		events    []string
+		writeHold []string
+		outErr    error
+	}{
+		"never connected": {
+			outErr: fmt.Errorf("cannot reconnect, Connect was never called"),
+		},
+		"first attempt succeeds": {
+			server:    "fake-server",
+			dialErrs:  []error{nil},
+			events:    []string{EventReconnecting},
+			writeHold: []string{"CAP LS 302\r\n", "NICK fake-user\r\n", "USER fake-user 8 * :fake-user\r\n"},
+		},
+		"retries until the server answers": {
+			server:    "fake-server",
+			dialErrs:  []error{fmt.Errorf("fake dial error"), fmt.Errorf("fake dial error"), nil},
+			events:    []string{EventReconnecting, EventReconnecting, EventReconnecting},
+			writeHold: []string{"CAP LS 302\r\n", "NICK fake-user\r\n", "USER fake-user 8 * :fake-user\r\n"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			dials := 0
+			netDial = func(network, address string) (net.Conn, error) {
+				err := tc.dialErrs[dials]
+				dials++
+				return &fakeConn{}, err
+			}
+			defer func() { netDial = net.Dial }()
+			slept := []time.Duration{}
+			sleep = func(d time.Duration) { slept = append(slept, d) }
+			defer func() { sleep = time.Sleep }()
+
+			s, _ := NewService("fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.server = tc.server
+			s.loginUser = "fake-user"
+			s.password = "fake-pass"
+			writeErr = nil
+			writeHold = []string{}
+
+			err := s.reconnect()
+			if tc.outErr != nil {
+				assert.EqualError(t, err, tc.outErr.Error())
+				return
+			}
+			s.sendQueue().drain()
+			assert.Nil(t, err, "got unexpected err %v", err)
+			assert.Len(t, slept, len(tc.dialErrs))
+			assert.Equal(t, tc.writeHold, writeHold)
+			s.bus.close()
+			events := []string{}
+			for m := range out {
+				events = append(events, m.Info().Type)
+			}
+			assert.Equal(t, tc.events, events)
+		})
+	}
+}
+
+func TestReconnectConfigError(t *testing.T) {
+	dials := 0
+	netDial = func(network, address string) (net.Conn, error) {
+		dials++
+		return &fakeConn{}, nil
+	}
+	defer func() { netDial = net.Dial }()
+	sleep = func(d time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	s, _ := NewService("fake-owner", []string{})
+	s.server = "fake-server"
+	s.loginUser = "fake-user"
+	s.SASLMechanism = "SCRAM-SHA-256"
+	err := s.reconnect()
+	assert.EqualError(t, err, `login after reconnect failed unsupported sasl mechanism "SCRAM-SHA-256"`)
+	var cfgErr *ConfigError
+	assert.True(t, errors.As(err, &cfgErr), "expected a *ConfigError")
+	// the bad mechanism is not tried again
+	assert.Equal(t, 1, dials)
+}
+
+// TestReconnectWhileConsuming reconnects while another goroutine asks about
+// the connection, as the event consumers do, it is meant for go test -race
+func TestReconnectWhileConsuming(t *testing.T) {
+	netDial = func(network, address string) (net.Conn, error) {
+		return &fakeConn{}, nil
+	}
+	defer func() { netDial = net.Dial }()
+
+	s, _ := NewService("fake-owner", []string{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, s.Connect("fake-server", false))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		s.Account("fake-nick")
+		s.capEnabled("draft/multiline")
+		s.multilineLimits()
+	}
+}
@@ -0,0 +1,460 @@
+package IRC
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SASL mechanisms understood by Login
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
+// saslChunkSize is the longest AUTHENTICATE payload the server will accept in
+// a single line
+const saslChunkSize = 400
+
+// SASLError is the reason registration was aborted when the server refuses
+// the SASL authentication.
+type SASLError struct {
+	Mechanism string
+	// Code is the numeric the server replied with, eg 904 or 905
+	Code    string
+	Message string
+}
+
+func (e *SASLError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("sasl %s authentication failed: %s", e.Mechanism, e.Message)
+	}
+	return fmt.Sprintf("sasl %s authentication failed with %s: %s", e.Mechanism, e.Code, e.Message)
+}
+
+// Readiness picks the point in registration at which the bot is considered
+// ready, and joins its channels.
+type Readiness int
+
+const (
+	// ReadyOnMOTD waits for the end of the MOTD (376), or for the server to
+	// say there is no MOTD (422)
+	ReadyOnMOTD Readiness = iota
+	// ReadyOnWelcome is ready as soon as the server welcomes us (001)
+	ReadyOnWelcome
+	// ReadyOnLogin waits for the MOTD and for services to confirm we are
+	// logged in (900)
+	ReadyOnLogin
+	// ReadyOnCloak waits for services to apply our cloak (396), so that the
+	// channels never see our real host
+	ReadyOnCloak
+)
+
+var readinessNames = map[string]Readiness{
+	"motd":    ReadyOnMOTD,
+	"welcome": ReadyOnWelcome,
+	"login":   ReadyOnLogin,
+	"cloak":   ReadyOnCloak,
+}
+
+// ParseReadiness converts one of "motd", "welcome", "login" or "cloak" to a
+// Readiness
+func ParseReadiness(name string) (Readiness, error) {
+	r, ok := readinessNames[strings.ToLower(name)]
+	if !ok {
+		return ReadyOnMOTD, fmt.Errorf("unknown readiness %q, expected one of motd, welcome, login or cloak", name)
+	}
+	return r, nil
+}
+
+// registration holds the state of the capability negotiation, authentication
+// and registration for the current connection.
+type registration struct {
+	m sync.Mutex
+	// caps are the capabilities the server advertised in CAP LS, with any
+	// values they were advertised with (eg sasl=PLAIN,EXTERNAL)
+	caps map[string]string
+	// acked are the capabilities the server agreed to enable
+	acked map[string]struct{}
+	// capRequests counts the CAP REQs the server has yet to answer
+	capRequests int
+	// saslStarted is set once an AUTHENTICATE exchange begins
+	saslStarted bool
+	// loggedIn is set once the server confirms (900) we are identified
+	loggedIn bool
+	// welcomed is set once the server accepts our registration (001)
+	welcomed bool
+	// motdDone is set at the end of the MOTD (376/422)
+	motdDone bool
+	// cloaked is set once services have applied our cloak (396)
+	cloaked bool
+	// ready is closed when the readiness condition is met
+	ready chan struct{}
+	// done is closed when the connection is lost
+	done chan struct{}
+	// nickAttempts counts the nicks the server refused during registration
+	nickAttempts int
+	// monitor is set when the server supports MONITOR (advertised in 005)
+	monitor bool
+	// whox is set when the server supports WHOX (advertised in 005)
+	whox bool
+	// recovering is set once we start trying to get the primary nick back
+	recovering bool
+	// lastRegain is when services were last asked to release the nick
+	lastRegain time.Time
+	// err is why registration was aborted, if it was
+	err error
+}
+
+func newRegistration() *registration {
+	return &registration{
+		caps:  map[string]string{},
+		acked: map[string]struct{}{},
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// close marks the connection this registration belongs to as lost
+func (r *registration) close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+// isReady reports whether the readiness condition has been met, the caller
+// must hold the lock
+func (r *registration) isReady() bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// satisfies reports whether the registration has progressed far enough for
+// the supplied readiness, the caller must hold the lock
+func (r *registration) satisfies(when Readiness) bool {
+	if !r.welcomed {
+		return false
+	}
+	switch when {
+	case ReadyOnWelcome:
+		return true
+	case ReadyOnLogin:
+		return r.motdDone && r.loggedIn
+	case ReadyOnCloak:
+		return r.cloaked
+	default:
+		return r.motdDone
+	}
+}
+
+// Err returns the reason registration was aborted, or nil
+func (r *registration) Err() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.err
+}
+
+// wantedCaps are the capabilities the bot will request, if the server offers
+// them
+func (s *service) wantedCaps() []string {
+	// the account capabilities let owners be recognised by their services
+	// account rather than their hostmask
+	wanted := []string{"account-notify", "account-tag", "extended-join"}
+	// long messages are sent as a single multiline message
+	wanted = append(wanted, "batch", "draft/multiline")
+	if s.password != "" || s.saslMechanism() == SASLExternal {
+		wanted = append(wanted, "sasl")
+	}
+	return wanted
+}
+
+func (s *service) saslMechanism() string {
+	if s.SASLMechanism == "" {
+		return SASLPlain
+	}
+	return strings.ToUpper(s.SASLMechanism)
+}
+
+// handleCap deals with the CAP subcommands sent by the server during
+// negotiation.
+//
+//	:server CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL
+//	:server CAP * LS :away-notify
+//	:server CAP nick ACK :sasl
+func (s *service) handleCap(msg Message) {
+	reg := s.registration()
+	subcommand := strings.ToUpper(msg.Arg(1))
+	switch subcommand {
+	case "LS":
+		// a `*` before the list means there are more lines to come
+		more := msg.Arg(2) == "*"
+		caps := msg.Trailing
+		reg.m.Lock()
+		for _, c := range strings.Fields(caps) {
+			name, value := c, ""
+			if i := strings.Index(c, "="); i >= 0 {
+				name, value = c[:i], c[i+1:]
+			}
+			reg.caps[name] = value
+		}
+		reg.m.Unlock()
+		if more {
+			return
+		}
+		s.requestCaps()
+	case "ACK":
+		sasl := false
+		reg.m.Lock()
+		for _, c := range strings.Fields(msg.Trailing) {
+			reg.acked[strings.TrimPrefix(c, "-")] = struct{}{}
+			sasl = sasl || c == "sasl"
+		}
+		reg.capRequests--
+		done := reg.capRequests <= 0
+		reg.m.Unlock()
+		if sasl {
+			s.startSASL()
+			return
+		}
+		if done {
+			s.endCap()
+		}
+	case "NAK":
+		log.Printf("Server refused capabilities %q", msg.Trailing)
+		sasl := false
+		for _, c := range strings.Fields(msg.Trailing) {
+			sasl = sasl || c == "sasl"
+		}
+		reg.m.Lock()
+		reg.capRequests--
+		done := reg.capRequests <= 0
+		reg.m.Unlock()
+		if sasl {
+			// the server offered sasl, identifying with NickServ
+			// instead would send the password in the clear
+			s.abortRegistration(&SASLError{Mechanism: s.saslMechanism(), Message: "the server refused the sasl capability"})
+			return
+		}
+		if done {
+			s.endCap()
+		}
+	}
+}
+
+// requestCaps asks for whichever of the wanted capabilities the server
+// offered, or finishes negotiation if there are none. sasl is requested on
+// its own, and last, so that the server refusing another capability cannot
+// stop us authenticating, and its answer is the last one.
+func (s *service) requestCaps() {
+	reg := s.registration()
+	reg.m.Lock()
+	req := []string{}
+	sasl := false
+	for _, c := range s.wantedCaps() {
+		if _, ok := reg.caps[c]; !ok {
+			continue
+		}
+		if c == "sasl" {
+			sasl = true
+			continue
+		}
+		req = append(req, c)
+	}
+	reqs := []string{}
+	if len(req) > 0 {
+		sort.Strings(req)
+		reqs = append(reqs, "CAP REQ :"+strings.Join(req, " "))
+	}
+	if sasl {
+		reqs = append(reqs, "CAP REQ :sasl")
+	}
+	reg.capRequests = len(reqs)
+	reg.m.Unlock()
+	if len(reqs) == 0 {
+		s.endCap()
+		return
+	}
+	s.sendQueue().enqueue(PriorityNormal, reqs...)
+}
+
+func (s *service) endCap() {
+	s.enqueue(PriorityNormal, "CAP END")
+}
+
+// startSASL begins the AUTHENTICATE exchange, provided the server supports
+// the configured mechanism.
+func (s *service) startSASL() {
+	mech := s.saslMechanism()
+	reg := s.registration()
+	reg.m.Lock()
+	offered := reg.caps["sasl"]
+	reg.saslStarted = true
+	reg.m.Unlock()
+
+	// A server may list the mechanisms it supports as the value of the
+	// capability, if it does, check that ours is one of them
+	if offered != "" {
+		found := false
+		for _, m := range strings.Split(offered, ",") {
+			if strings.EqualFold(m, mech) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.abortRegistration(&SASLError{Mechanism: mech, Message: fmt.Sprintf("mechanism not offered by server, which supports %s", offered)})
+			return
+		}
+	}
+
+	s.enqueue(PriorityNormal, "AUTHENTICATE %s", mech)
+}
+
+// handleAuthenticate answers the server's `AUTHENTICATE +` prompt with the
+// credentials for the configured mechanism.
+func (s *service) handleAuthenticate(msg Message) {
+	if msg.Arg(0) != "+" {
+		return
+	}
+	if s.saslMechanism() == SASLExternal {
+		// the credentials are the client certificate presented during the
+		// TLS handshake
+		s.enqueue(PriorityNormal, "AUTHENTICATE +")
+		return
+	}
+
+	payload := base64.StdEncoding.EncodeToString([]byte(s.loginUser + "\x00" + s.loginUser + "\x00" + s.password))
+	lines := []string{}
+	for len(payload) >= saslChunkSize {
+		lines = append(lines, "AUTHENTICATE "+payload[:saslChunkSize])
+		payload = payload[saslChunkSize:]
+	}
+	// A payload that is an exact multiple of the chunk size is terminated
+	// with an empty response
+	if payload == "" {
+		payload = "+"
+	}
+	s.sendQueue().enqueue(PriorityNormal, append(lines, "AUTHENTICATE "+payload)...)
+}
+
+// handleSASLNumeric deals with the numerics the server sends in reply to the
+// AUTHENTICATE exchange.
+func (s *service) handleSASLNumeric(msg Message) {
+	switch msg.Command {
+	case "903", "907":
+		// RPL_SASLSUCCESS, ERR_SASLALREADY
+		s.endCap()
+	case "904", "905", "906":
+		// ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+		s.abortRegistration(&SASLError{Mechanism: s.saslMechanism(), Code: msg.Command, Message: msg.Trailing})
+	}
+}
+
+// handleRegistrationNumeric advances registration as the server reports
+// progress, and once the configured readiness is reached joins the channels.
+func (s *service) handleRegistrationNumeric(msg Message) {
+	reg := s.registration()
+	reg.m.Lock()
+	recover := false
+	switch msg.Command {
+	case "001":
+		reg.welcomed = true
+	case "376", "422":
+		reg.motdDone = true
+		recover = !reg.recovering
+		reg.recovering = true
+	case "900":
+		reg.loggedIn = true
+		log.Printf("Logged in as %s", msg.Arg(2))
+	case "396":
+		reg.cloaked = true
+	}
+	ready := !reg.isReady() && reg.satisfies(s.JoinOn)
+	if ready {
+		close(reg.ready)
+	}
+	reg.m.Unlock()
+
+	if msg.Command == "001" {
+		// the welcome is addressed to the nick the server gave us
+		s.setNick(msg.Arg(0))
+		s.handleWelcome()
+	}
+	if recover {
+		s.startNickRecovery()
+		s.watchOwner()
+	}
+	if ready {
+		s.becomeReady()
+	}
+}
+
+// becomeReady joins every channel the bot should be in and tells the
+// consumers that the bot is ready.
+func (s *service) becomeReady() {
+	log.Print("Registration complete, joining channels")
+	s.joinAll(s.channelList())
+	s.emit(EventReady)
+}
+
+// handleWelcome identifies with NickServ when the server did not offer SASL.
+// A server that offered it and then refused is never sent the password.
+func (s *service) handleWelcome() {
+	// the server has accepted us, so the next disconnect starts with a short
+	// delay again
+	s.retry.reset()
+	s.startKeepalive()
+
+	reg := s.registration()
+	reg.m.Lock()
+	_, offered := reg.caps["sasl"]
+	sasl := reg.saslStarted || offered
+	reg.m.Unlock()
+	if sasl || s.password == "" {
+		return
+	}
+	log.Print("Server does not support sasl, identifying with NickServ")
+	s.enqueue(PriorityNormal, "PRIVMSG NickServ :IDENTIFY %s %s", s.loginUser, s.password)
+}
+
+// abortRegistration records why registration cannot continue and drops the
+// connection, so that Listen can report the error. It runs on the reader, so
+// the connection is closed by another goroutine once the QUIT has been sent,
+// or shutdownTimeout has passed.
+func (s *service) abortRegistration(err error) {
+	log.Printf("Aborting registration %v", err)
+	reg := s.registration()
+	reg.m.Lock()
+	reg.err = err
+	reg.m.Unlock()
+	conn := s.conn()
+	result := s.sendQueue().push(PriorityHigh, "QUIT :authentication failed")[0]
+	go func() {
+		select {
+		case werr := <-result:
+			if werr != nil {
+				log.Printf("Error sending QUIT %v", werr)
+			}
+		case <-time.After(shutdownTimeout):
+			log.Printf("QUIT was not sent within %v, closing the connection", shutdownTimeout)
+		}
+		if conn == nil {
+			return
+		}
+		if cerr := conn.Close(); cerr != nil {
+			log.Printf("Error closing connection %v", cerr)
+		}
+	}()
+}
@@ -0,0 +1,292 @@
+package IRC
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistration(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("fake-user\x00fake-user\x00fake-pass"))
+	testcases := map[string]struct {
+		mechanism string
+		password  string
+		input     []string
+		writeHold []string
+		regErr    string
+	}{
+		"server without sasl": {
+			password: "fake-pass",
+			input: []string{
+				":fake.server CAP * LS :multi-prefix away-notify",
+				":fake.server 001 fake-user :Welcome",
+			},
+			writeHold: []string{
+				"CAP END\r\n",
+				"PRIVMSG NickServ :IDENTIFY fake-user fake-pass\r\n",
+			},
+		},
+		"server without CAP support": {
+			password: "fake-pass",
+			input: []string{
+				":fake.server 001 fake-user :Welcome",
+			},
+			writeHold: []string{
+				"PRIVMSG NickServ :IDENTIFY fake-user fake-pass\r\n",
+			},
+		},
+		"sasl plain over multiline LS": {
+			password: "fake-pass",
+			input: []string{
+				":fake.server CAP * LS * :multi-prefix",
+				":fake.server CAP * LS :sasl=PLAIN,EXTERNAL",
+				":fake.server CAP fake-user ACK :sasl",
+				"AUTHENTICATE +",
+				":fake.server 900 fake-user fake-user!u@h fake-user :You are now logged in as fake-user",
+				":fake.server 903 fake-user :SASL authentication successful",
+				":fake.server 001 fake-user :Welcome",
+			},
+			writeHold: []string{
+				"CAP REQ :sasl\r\n",
+				"AUTHENTICATE PLAIN\r\n",
+				"AUTHENTICATE " + plain + "\r\n",
+				"CAP END\r\n",
+			},
+		},
+		"sasl is requested on its own": {
+			password: "fake-pass",
+			input: []string{
+				":fake.server CAP * LS :account-notify draft/multiline sasl",
+				":fake.server CAP fake-user NAK :account-notify draft/multiline",
+				":fake.server CAP fake-user ACK :sasl",
+				"AUTHENTICATE +",
+				":fake.server 903 fake-user :SASL authentication successful",
+			},
+			writeHold: []string{
+				"CAP REQ :account-notify draft/multiline\r\n",
+				"CAP REQ :sasl\r\n",
+				"AUTHENTICATE PLAIN\r\n",
+				"AUTHENTICATE " + plain + "\r\n",
+				"CAP END\r\n",
+			},
+		},
+		"negotiation ends once every request is answered": {
+			input: []string{
+				":fake.server CAP * LS :account-notify extended-join",
+				":fake.server CAP fake-user ACK :account-notify extended-join",
+			},
+			writeHold: []string{
+				"CAP REQ :account-notify extended-join\r\n",
+				"CAP END\r\n",
+			},
+		},
+		"sasl refused aborts registration": {
+			password: "fake-pass",
+			input: []string{
+				":fake.server CAP * LS :account-notify sasl",
+				":fake.server CAP fake-user ACK :account-notify",
+				":fake.server CAP fake-user NAK :sasl",
+				":fake.server 001 fake-user :Welcome",
+			},
+			writeHold: []string{
+				"CAP REQ :account-notify\r\n",
+				"CAP REQ :sasl\r\n",
+				"QUIT :authentication failed\r\n",
+			},
+			regErr: "sasl PLAIN authentication failed: the server refused the sasl capability",
+		},
+		"sasl external": {
+			mechanism: SASLExternal,
+			input: []string{
+				":fake.server CAP * LS :sasl",
+				":fake.server CAP fake-user ACK :sasl",
+				"AUTHENTICATE +",
+				":fake.server 903 fake-user :SASL authentication successful",
+			},
+			writeHold: []string{
+				"CAP REQ :sasl\r\n",
+				"AUTHENTICATE EXTERNAL\r\n",
+				"AUTHENTICATE +\r\n",
+				"CAP END\r\n",
+			},
+		},
+		"sasl failure aborts registration": {
+			password: "fake-pass",
+			input: []string{
+				":fake.server CAP * LS :sasl",
+				":fake.server CAP fake-user ACK :sasl",
+				"AUTHENTICATE +",
+				":fake.server 904 fake-user :SASL authentication failed",
+				":fake.server 001 fake-user :Welcome",
+			},
+			writeHold: []string{
+				"CAP REQ :sasl\r\n",
+				"AUTHENTICATE PLAIN\r\n",
+				"AUTHENTICATE " + plain + "\r\n",
+				"QUIT :authentication failed\r\n",
+			},
+			regErr: "sasl PLAIN authentication failed with 904: SASL authentication failed",
+		},
+		"mechanism not offered": {
+			mechanism: SASLExternal,
+			input: []string{
+				":fake.server CAP * LS :sasl=PLAIN",
+				":fake.server CAP fake-user ACK :sasl",
+			},
+			writeHold: []string{
+				"CAP REQ :sasl\r\n",
+				"QUIT :authentication failed\r\n",
+			},
+			regErr: "sasl EXTERNAL authentication failed: mechanism not offered by server, which supports PLAIN",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			conn := &closeWatcher{closed: make(chan struct{})}
+			s.connection = conn
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			s.loginUser = "fake-user"
+			s.password = tc.password
+			s.SASLMechanism = tc.mechanism
+			writeErr = nil
+			closeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.input {
+				if s.reg.Err() != nil {
+					// the connection has been dropped
+					break
+				}
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			if tc.regErr == "" {
+				assert.Nil(t, s.reg.Err())
+			} else {
+				assert.EqualError(t, s.reg.Err(), tc.regErr)
+				_, ok := s.reg.Err().(*SASLError)
+				assert.True(t, ok, "expected a *SASLError")
+				select {
+				case <-conn.closed:
+				case <-time.After(time.Second):
+					t.Fatal("connection was not closed")
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateChunking(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.loginUser = "fake-user"
+	// two copies of the username, two NULs and the password make 300 bytes,
+	// which base64 encodes to exactly one chunk
+	s.password = strings.Repeat("p", 300-2-2*len("fake-user"))
+	writeErr = nil
+	writeHold = []string{}
+	s.handleAuthenticate(Message{Command: "AUTHENTICATE", Params: []string{"+"}})
+	s.sendQueue().drain()
+	assert.Len(t, writeHold, 2)
+	assert.Len(t, writeHold[0], len("AUTHENTICATE ")+saslChunkSize+2)
+	assert.Equal(t, "AUTHENTICATE +\r\n", writeHold[1])
+}
+
+func TestReadiness(t *testing.T) {
+	welcome := ":fake.server 001 fake-user :Welcome"
+	motd := ":fake.server 376 fake-user :End of /MOTD command."
+	noMotd := ":fake.server 422 fake-user :MOTD File is missing"
+	loggedIn := ":fake.server 900 fake-user fake-user!u@h fake-user :You are now logged in as fake-user"
+	cloak := ":fake.server 396 fake-user user/fake-user :is now your visible host"
+	joins := []string{"JOIN #fake-channel,#second-fake-channel\r\n"}
+	testcases := map[string]struct {
+		joinOn    Readiness
+		input     []string
+		writeHold []string
+		ready     bool
+	}{
+		"motd": {
+			joinOn:    ReadyOnMOTD,
+			input:     []string{welcome, motd},
+			writeHold: joins,
+			ready:     true,
+		},
+		"missing motd": {
+			joinOn:    ReadyOnMOTD,
+			input:     []string{welcome, noMotd},
+			writeHold: joins,
+			ready:     true,
+		},
+		"motd before welcome is not ready": {
+			joinOn: ReadyOnMOTD,
+			input:  []string{motd},
+		},
+		"welcome": {
+			joinOn:    ReadyOnWelcome,
+			input:     []string{welcome, motd},
+			writeHold: joins,
+			ready:     true,
+		},
+		"login waits for 900": {
+			joinOn: ReadyOnLogin,
+			input:  []string{welcome, motd},
+		},
+		"login": {
+			joinOn:    ReadyOnLogin,
+			input:     []string{loggedIn, welcome, motd},
+			writeHold: joins,
+			ready:     true,
+		},
+		"cloak waits for 396": {
+			joinOn: ReadyOnCloak,
+			input:  []string{welcome, motd},
+		},
+		"cloak": {
+			joinOn:    ReadyOnCloak,
+			input:     []string{welcome, motd, cloak, cloak},
+			writeHold: joins,
+			ready:     true,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{"#second-fake-channel", "#fake-channel"})
+			out := s.Subscribe(SubscribeOptions{Buffer: 1}).C
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			s.Username = "fake-user"
+			s.JoinOn = tc.joinOn
+			writeErr = nil
+			writeHold = []string{}
+			for _, line := range tc.input {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			if tc.writeHold == nil {
+				tc.writeHold = []string{}
+			}
+			assert.Equal(t, tc.writeHold, writeHold)
+			select {
+			case <-s.Ready():
+				assert.True(t, tc.ready, "unexpectedly ready")
+				assert.Equal(t, EventReady, (<-out).Info().Type)
+			default:
+				assert.False(t, tc.ready, "expected to be ready")
+			}
+		})
+	}
+}
+
+func TestParseReadiness(t *testing.T) {
+	r, err := ParseReadiness("Cloak")
+	assert.Nil(t, err)
+	assert.Equal(t, ReadyOnCloak, r)
+	_, err = ParseReadiness("fake-readiness")
+	assert.EqualError(t, err, `unknown readiness "fake-readiness", expected one of motd, welcome, login or cloak`)
+}
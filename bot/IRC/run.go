@@ -0,0 +1,100 @@
+package IRC
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// shutdownTimeout bounds how long Run waits for the lines already queued to be
+// sent before the QUIT, and then for Listen to stop
+const shutdownTimeout = 10 * time.Second
+
+// Run listens to the server until ctx is cancelled, and then leaves the
+// network with QuitMessage. Lines that were already queued are sent ahead of
+// the QUIT. Run returns the error that stopped Listen, or nil once the bot has
+// quit. Every subscription is closed once Run has returned.
+func (s *service) Run(ctx context.Context) error {
+	defer s.bus.close()
+	// nothing is sent once Run has returned
+	defer s.stopQueue()
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Listen()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.m.RLock()
+	reason := s.QuitMessage
+	s.m.RUnlock()
+	if err := s.shutdown(reason); err != nil {
+		log.Printf("Error quitting %v", err)
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(shutdownTimeout):
+		return fmt.Errorf("listen did not stop within %v of quitting", shutdownTimeout)
+	}
+}
+
+// shutdown sends the QUIT, with the reason if there is one, once the send
+// queue has drained, or shutdownTimeout has passed, and then closes the
+// connection. Only the first call does anything, later ones wait for it and
+// return the same error.
+func (s *service) shutdown(reason string) error {
+	s.stopOnce.Do(func() {
+		s.m.Lock()
+		s.quitting = true
+		s.m.Unlock()
+		// nothing is to be rejoined now
+		s.joins.reset()
+
+		line := "QUIT"
+		if reason != "" {
+			line = "QUIT :" + reason
+		}
+		log.Printf("Shutting down, sending %s once the send queue has drained", line)
+		q := s.sendQueue()
+		drained := make(chan struct{})
+		go func() {
+			// closing the connection drops whatever is left, so this
+			// always returns
+			q.drain()
+			close(drained)
+		}()
+		close(s.stopping)
+		timeout := time.After(shutdownTimeout)
+		select {
+		case <-drained:
+			select {
+			case err := <-q.push(PriorityHigh, line)[0]:
+				if err != nil {
+					log.Printf("Error sending %s %v", line, err)
+					s.stopErr = fmt.Errorf("disconnect quit error %w", err)
+				}
+			case <-timeout:
+				log.Printf("%s was not sent within %v, closing the connection", line, shutdownTimeout)
+			}
+		case <-timeout:
+			log.Printf("Send queue did not drain within %v, closing the connection", shutdownTimeout)
+		}
+		if err := s.closeConnection(); err != nil && s.stopErr == nil {
+			s.stopErr = fmt.Errorf("disconnect close error %w", err)
+		}
+		s.stopQueue()
+	})
+	return s.stopErr
+}
+
+// isQuitting reports whether the bot has chosen to leave the network
+func (s *service) isQuitting() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.quitting
+}
@@ -0,0 +1,170 @@
+package IRC
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startRecorder stands in for the IRC server, sending the lines read from
+// the client on the returned channel
+func startRecorder(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	lines := make(chan string, 20)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewScanner(conn)
+		for r.Scan() {
+			lines <- r.Text()
+		}
+		close(lines)
+	}()
+	return l.Addr().String(), lines
+}
+
+func TestRun(t *testing.T) {
+	testcases := map[string]struct {
+		quitMessage string
+		queued      []string
+		expected    []string
+	}{
+		"quit without a message": {
+			expected: []string{"QUIT"},
+		},
+		"quit with a message": {
+			quitMessage: "shutting down",
+			expected:    []string{"QUIT :shutting down"},
+		},
+		"queued lines are sent first": {
+			quitMessage: "bye",
+			queued:      []string{"PRIVMSG #fake-channel :one", "PRIVMSG #fake-channel :two"},
+			expected:    []string{"PRIVMSG #fake-channel :one", "PRIVMSG #fake-channel :two", "QUIT :bye"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			addr, lines := startRecorder(t)
+			s, _ := NewService("fake-owner", []string{})
+			out := s.Subscribe(SubscribeOptions{Buffer: 10}).C
+			s.QuitMessage = tc.quitMessage
+			// no tokens for flood control, so that the queued lines are
+			// still waiting when Run is stopped
+			s.FloodBurst, s.FloodRate = 1, 10*time.Millisecond
+			assert.Nil(t, s.Connect(addr, false))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			result := make(chan error, 1)
+			go func() { result <- s.Run(ctx) }()
+			for _, line := range tc.queued {
+				s.sendQueue().push(PriorityNormal, line)
+			}
+			cancel()
+
+			select {
+			case err := <-result:
+				assert.Nil(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run did not stop")
+			}
+			got := []string{}
+			for line := range lines {
+				got = append(got, line)
+			}
+			assert.Equal(t, tc.expected, got)
+			assert.Equal(t, EventConnected, (<-out).Info().Type)
+			assert.Equal(t, EventDisconnected, (<-out).Info().Type)
+			// the writer has stopped with Run
+			assert.Equal(t, errConnectionGone, s.write(PriorityNormal, "PRIVMSG #fake-channel :late"))
+		})
+	}
+}
+
+func TestRunReturnsListenErrors(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.connection = &fakeConn{}
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	s.reg.err = &SASLError{Mechanism: SASLPlain, Code: "904", Message: "bad password"}
+	s.reader = textproto.NewReader(bufio.NewReader(strings.NewReader("")))
+	err := s.Run(context.Background())
+	assert.EqualError(t, err, "registration failed sasl PLAIN authentication failed with 904: bad password")
+}
+
+func TestRunRetriesTheFirstConnect(t *testing.T) {
+	addr, lines := startRecorder(t)
+	dials := 0
+	netDial = func(network, address string) (net.Conn, error) {
+		dials++
+		if dials == 1 {
+			return nil, fmt.Errorf("fake dial error")
+		}
+		return net.Dial(network, address)
+	}
+	defer func() { netDial = net.Dial }()
+	sleep = func(d time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	s, _ := NewService("fake-owner", []string{})
+	assert.EqualError(t, s.Connect(addr, false), "fake dial error")
+	// the credentials are kept for when Run has connected
+	assert.Nil(t, s.Login("fake-user", "fake-pass"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- s.Run(ctx) }()
+	for _, expected := range []string{"CAP LS 302", "NICK fake-user", "USER fake-user 8 * :fake-user"} {
+		select {
+		case line := <-lines:
+			assert.Equal(t, expected, line)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not connect")
+		}
+	}
+	cancel()
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+	assert.Equal(t, 2, dials)
+}
+
+func TestConnectWhileQuitting(t *testing.T) {
+	addr, lines := startRecorder(t)
+	s, _ := NewService("fake-owner", []string{})
+	s.quitting = true
+	assert.EqualError(t, s.Connect(addr, false), "connect to "+addr+" abandoned, the bot is quitting")
+	assert.Nil(t, s.conn())
+	// the new connection is closed rather than kept
+	select {
+	case _, ok := <-lines:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was left open")
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.connection = &fakeConn{}
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	closeErr = nil
+	writeHold = []string{}
+	s.shutdown("")
+	assert.NotPanics(t, func() { s.shutdown("again") })
+	assert.Equal(t, []string{"QUIT\r\n"}, writeHold)
+}
@@ -0,0 +1,278 @@
+package IRC
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/mindfarm/fluentdrama/formatting"
+)
+
+// Until the server shows the bot its own prefix, the longest user and host it
+// could have are assumed, so that relayed lines are never cut short
+const (
+	assumedUserLength = 11
+	assumedHostLength = 63
+)
+
+// Limits on a draft/multiline batch, used when the server does not give its
+// own in the capability value
+const (
+	defaultMultilineMaxBytes = 4096
+	defaultMultilineMaxLines = 24
+)
+
+// batchCount numbers the batches the bot opens, to give each a unique
+// reference
+var batchCount uint64
+
+// setSelf records the user and host the server shows for the bot, as seen on
+// its own JOINs, the welcome and a new cloak
+func (s *service) setSelf(user, host string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if user != "" {
+		s.selfUser = user
+	}
+	if host != "" {
+		s.selfHost = host
+	}
+}
+
+// handleSelfNumeric notes our prefix from the numerics that show it
+//
+//	:server 001 me :Welcome to the network me!user@host
+//	:server 396 me new.host :is now your displayed host
+func (s *service) handleSelfNumeric(msg Message) {
+	switch msg.Command {
+	case "001":
+		fields := strings.Fields(msg.Trailing)
+		if len(fields) == 0 {
+			return
+		}
+		if src := ParseSource(fields[len(fields)-1]); src.Host != "" && s.sameName(src.Nick, msg.Arg(0)) {
+			s.setSelf(src.User, src.Host)
+		}
+	case "396":
+		s.setSelf("", msg.Arg(1))
+	}
+}
+
+// lineBudget is how many bytes of text fit in the command to the target, once
+// the server has put our prefix in front of it to relay it
+func (s *service) lineBudget(command, target string) int {
+	s.m.RLock()
+	prefix := len(s.Username)
+	if s.selfUser != "" {
+		prefix += 1 + len(s.selfUser)
+	} else {
+		prefix += 1 + assumedUserLength
+	}
+	if s.selfHost != "" {
+		prefix += 1 + len(s.selfHost)
+	} else {
+		prefix += 1 + assumedHostLength
+	}
+	s.m.RUnlock()
+	// :prefix COMMAND target :text
+	return maxLineLength - len(":"+" "+command+" "+target+" :") - prefix
+}
+
+// splitText breaks the text into pieces of at most max bytes, at a space when
+// there is one, otherwise between characters. A piece that ends at a space
+// keeps it, so that the pieces join back into the text. UTF-8 sequences and
+// formatting codes are never split.
+func splitText(text string, max int) []string {
+	pieces := []string{}
+	for len(text) > max {
+		// cut is the end of the last whole character or code that fits, and
+		// space the end of the last space
+		cut, space := 0, 0
+		for cut < len(text) {
+			size := formatting.CodeLen(text[cut:])
+			if size == 0 {
+				_, size = utf8.DecodeRuneInString(text[cut:])
+			}
+			if cut+size > max {
+				break
+			}
+			cut += size
+			if text[cut-1] == ' ' {
+				space = cut
+			}
+		}
+		switch {
+		case space > 0:
+			cut = space
+		case cut == 0:
+			// a single code longer than max, send it whole
+			cut = formatting.CodeLen(text)
+			if cut == 0 {
+				_, cut = utf8.DecodeRuneInString(text)
+			}
+		}
+		pieces = append(pieces, text[:cut])
+		text = text[cut:]
+	}
+	if text != "" {
+		pieces = append(pieces, text)
+	}
+	return pieces
+}
+
+// multilineLimits returns the max-bytes and max-lines of a batch, from the
+// value the server gave the capability, eg max-bytes=4096,max-lines=24
+func (s *service) multilineLimits() (int, int) {
+	reg := s.registration()
+	reg.m.Lock()
+	value := reg.caps["draft/multiline"]
+	reg.m.Unlock()
+	maxBytes, maxLines := defaultMultilineMaxBytes, defaultMultilineMaxLines
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			continue
+		}
+		switch parts[0] {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+	return maxBytes, maxLines
+}
+
+// sayLines turns the text into the lines that say it to the target, in the
+// groups they are queued in. Each line of the text is split to fit the line
+// budget, and when the server supports draft/multiline the pieces are sent in
+// batches, each a single group, so that they are shown as the text was
+// written. Batches only end between lines of the text, so that the pieces of
+// a line are always concatenated.
+func (s *service) sayLines(target, text string) [][]string {
+	budget := s.lineBudget("PRIVMSG", target)
+	lines := [][]string{}
+	count := 0
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		pieces := splitText(line, budget)
+		lines = append(lines, pieces)
+		count += len(pieces)
+	}
+
+	if count < 2 || !s.capEnabled("draft/multiline") {
+		groups := [][]string{}
+		for _, pieces := range lines {
+			groups = append(groups, privmsgs(target, pieces)...)
+		}
+		return groups
+	}
+
+	maxBytes, maxLines := s.multilineLimits()
+	groups := [][]string{}
+	var batch []string
+	var ref string
+	var bytes int
+	end := func() {
+		if batch != nil {
+			groups = append(groups, append(batch, "BATCH -"+ref))
+			batch = nil
+		}
+	}
+	for _, pieces := range lines {
+		if len(pieces) == 0 {
+			continue
+		}
+		size := len(strings.Join(pieces, ""))
+		if len(pieces) > maxLines || size > maxBytes {
+			// too long for any batch, it is sent the way it would be
+			// without draft/multiline
+			end()
+			groups = append(groups, privmsgs(target, pieces)...)
+			continue
+		}
+		// the batch holds its BATCH + line and the lines so far, joined by
+		// newlines
+		if batch != nil && (len(batch)-1+len(pieces) > maxLines || bytes+1+size > maxBytes) {
+			end()
+		}
+		if batch == nil {
+			ref = "ml" + strconv.FormatUint(atomic.AddUint64(&batchCount, 1), 10)
+			batch = []string{fmt.Sprintf("BATCH +%s draft/multiline %s", ref, target)}
+			bytes = 0
+		} else {
+			bytes++
+		}
+		for i, p := range pieces {
+			tags := "@batch=" + ref
+			if i > 0 {
+				tags += ";draft/multiline-concat"
+			}
+			batch = append(batch, fmt.Sprintf("%s PRIVMSG %s :%s", tags, target, p))
+		}
+		bytes += size
+	}
+	end()
+	return groups
+}
+
+// privmsgs says the pieces of a line as separate messages, each a group of
+// its own
+func privmsgs(target string, pieces []string) [][]string {
+	groups := make([][]string, 0, len(pieces))
+	for _, p := range pieces {
+		// pieces split at a space end with it, which is only needed to
+		// concatenate them
+		if t := strings.TrimRight(p, " "); t != "" {
+			groups = append(groups, []string{fmt.Sprintf("PRIVMSG %s :%s", target, t)})
+		}
+	}
+	return groups
+}
+
+// Say the supplied text to the supplied channel or nick. Text that is too long
+// for a single line, or has several lines, is split up.
+func (s *service) Say(target, text string) error {
+	if err := checkSay(target, text); err != nil {
+		return err
+	}
+	var err error
+	for _, result := range s.sendQueue().pushGroups(PriorityNormal, s.sayLines(target, text)...) {
+		if lineErr := <-result; lineErr != nil && err == nil {
+			err = lineErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot say %s to %s because error %w", text, target, err)
+	}
+	log.Printf("Say %s to %s", text, target)
+	return nil
+}
+
+// tell says the text like Say, without waiting for it to be sent, for use on
+// the reader. Only a missing target or text is returned, failures to send are
+// logged.
+func (s *service) tell(target, text string) error {
+	if err := checkSay(target, text); err != nil {
+		return err
+	}
+	s.sendQueue().enqueueGroups(PriorityNormal, s.sayLines(target, text)...)
+	log.Printf("Say %s to %s", text, target)
+	return nil
+}
+
+func checkSay(target, text string) error {
+	if target == "" {
+		return fmt.Errorf("say has no target supplied")
+	}
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("say has no text supplied")
+	}
+	return nil
+}
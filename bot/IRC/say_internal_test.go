@@ -0,0 +1,210 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitText(t *testing.T) {
+	testcases := map[string]struct {
+		text     string
+		max      int
+		expected []string
+	}{
+		"fits": {
+			text:     "hello there",
+			max:      20,
+			expected: []string{"hello there"},
+		},
+		"at word boundaries": {
+			text:     "the quick brown fox",
+			max:      10,
+			expected: []string{"the quick ", "brown fox"},
+		},
+		"long words are broken": {
+			text:     "abcdefghij",
+			max:      4,
+			expected: []string{"abcd", "efgh", "ij"},
+		},
+		"runes are not split": {
+			text:     "ééééé",
+			max:      5,
+			expected: []string{"éé", "éé", "é"},
+		},
+		"colour codes are not split": {
+			text:     "ab\x0304,12cd",
+			max:      5,
+			expected: []string{"ab", "\x0304,12", "cd"},
+		},
+		"hex colour codes are not split": {
+			text:     "a\x04FF00FFb",
+			max:      4,
+			expected: []string{"a", "\x04FF00FF", "b"},
+		},
+		"a comma without a background is text": {
+			text:     "\x034,x",
+			max:      3,
+			expected: []string{"\x034,", "x"},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got := splitText(tc.text, tc.max)
+			assert.Equal(t, tc.expected, got)
+			assert.Equal(t, tc.text, strings.Join(got, ""), "pieces must join back into the text")
+			for _, p := range got {
+				assert.True(t, utf8.ValidString(p), "piece %q is not valid utf-8", p)
+			}
+		})
+	}
+}
+
+func TestLineBudget(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	s.Username = "fake-user"
+
+	// nothing is known about our prefix yet, so the longest is assumed
+	assert.Equal(t, 510-len(":fake-user!"+strings.Repeat("u", assumedUserLength)+"@"+strings.Repeat("h", assumedHostLength)+" PRIVMSG #c :"), s.lineBudget("PRIVMSG", "#c"))
+
+	s.processLine(":fake.server 001 fake-user :Welcome to the network fake-user!~fake@some.host")
+	assert.Equal(t, 510-len(":fake-user!~fake@some.host PRIVMSG #c :"), s.lineBudget("PRIVMSG", "#c"))
+
+	s.processLine(":fake.server 396 fake-user user/fake :is now your displayed host")
+	assert.Equal(t, 510-len(":fake-user!~fake@user/fake PRIVMSG #c :"), s.lineBudget("PRIVMSG", "#c"))
+
+	s.processLine(":fake-user!~other@joined.host JOIN #c")
+	s.sendQueue().drain()
+	assert.Equal(t, 510-len(":fake-user!~other@joined.host PRIVMSG #c :"), s.lineBudget("PRIVMSG", "#c"))
+}
+
+func TestSayLines(t *testing.T) {
+	long := strings.Repeat("word ", 100)
+	// 94 words fit in the line budget of 471 bytes
+	first, rest := strings.Repeat("word ", 94), strings.Repeat("word ", 6)
+	testcases := map[string]struct {
+		multiline string
+		text      string
+		expected  [][]string
+	}{
+		"short": {
+			text:     "hello",
+			expected: [][]string{{"PRIVMSG #c :hello"}},
+		},
+		"newlines are separate messages": {
+			text:     "one\r\ntwo\n\nthree",
+			expected: [][]string{{"PRIVMSG #c :one"}, {"PRIVMSG #c :two"}, {"PRIVMSG #c :three"}},
+		},
+		"long text is split": {
+			text:     long,
+			expected: [][]string{{"PRIVMSG #c :" + strings.TrimSpace(first)}, {"PRIVMSG #c :" + strings.TrimSpace(rest)}},
+		},
+		"multiline batch": {
+			multiline: "max-bytes=4096",
+			text:      long + "\nnext",
+			expected: [][]string{{
+				"BATCH +ml{n} draft/multiline #c",
+				"@batch=ml{n} PRIVMSG #c :" + first,
+				"@batch=ml{n};draft/multiline-concat PRIVMSG #c :" + rest,
+				"@batch=ml{n} PRIVMSG #c :next",
+				"BATCH -ml{n}",
+			}},
+		},
+		"multiline batches are limited": {
+			multiline: "max-bytes=4096,max-lines=2",
+			text:      "one\ntwo\nthree",
+			expected: [][]string{{
+				"BATCH +ml{n} draft/multiline #c",
+				"@batch=ml{n} PRIVMSG #c :one",
+				"@batch=ml{n} PRIVMSG #c :two",
+				"BATCH -ml{n}",
+			}, {
+				"BATCH +ml{m} draft/multiline #c",
+				"@batch=ml{m} PRIVMSG #c :three",
+				"BATCH -ml{m}",
+			}},
+		},
+		"multiline batches end between lines": {
+			multiline: "max-bytes=4096,max-lines=2",
+			text:      "one\n" + long,
+			expected: [][]string{{
+				"BATCH +ml{n} draft/multiline #c",
+				"@batch=ml{n} PRIVMSG #c :one",
+				"BATCH -ml{n}",
+			}, {
+				"BATCH +ml{m} draft/multiline #c",
+				"@batch=ml{m} PRIVMSG #c :" + first,
+				"@batch=ml{m};draft/multiline-concat PRIVMSG #c :" + rest,
+				"BATCH -ml{m}",
+			}},
+		},
+		"multiline batches end before max-bytes": {
+			multiline: "max-bytes=500,max-lines=24",
+			text:      long + "\nnext",
+			expected: [][]string{{
+				"BATCH +ml{n} draft/multiline #c",
+				"@batch=ml{n} PRIVMSG #c :" + first,
+				"@batch=ml{n};draft/multiline-concat PRIVMSG #c :" + rest,
+				"BATCH -ml{n}",
+			}, {
+				"BATCH +ml{m} draft/multiline #c",
+				"@batch=ml{m} PRIVMSG #c :next",
+				"BATCH -ml{m}",
+			}},
+		},
+		"a line too long for a batch is sent without one": {
+			multiline: "max-bytes=4096,max-lines=1",
+			text:      "one\n" + long,
+			expected: [][]string{{
+				"BATCH +ml{n} draft/multiline #c",
+				"@batch=ml{n} PRIVMSG #c :one",
+				"BATCH -ml{n}",
+			}, {
+				"PRIVMSG #c :" + strings.TrimSpace(first),
+			}, {
+				"PRIVMSG #c :" + strings.TrimSpace(rest),
+			}},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			s.Username = "fake-user"
+			s.selfUser, s.selfHost = "~fake", "some.host"
+			if tc.multiline != "" {
+				s.reg.caps["draft/multiline"] = tc.multiline
+				s.reg.acked["draft/multiline"] = struct{}{}
+			}
+			got := s.sayLines("#c", tc.text)
+			// the batch references are unique, so they are swapped for
+			// placeholders
+			refs := map[string]string{}
+			for _, group := range got {
+				for i, line := range group {
+					if strings.HasPrefix(line, "BATCH +") {
+						ref := strings.Fields(line)[1][1:]
+						refs[ref] = []string{"ml{n}", "ml{m}"}[len(refs)]
+					}
+					for ref, placeholder := range refs {
+						group[i] = strings.ReplaceAll(group[i], ref, placeholder)
+					}
+				}
+			}
+			assert.Equal(t, tc.expected, got)
+			for _, group := range got {
+				for _, line := range group {
+					if i := strings.Index(line, " PRIVMSG"); strings.HasPrefix(line, "@") && i > 0 {
+						line = line[i+1:]
+					}
+					assert.LessOrEqual(t, len(":fake-user!~fake@some.host "+line), maxLineLength)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package IRC
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Member is someone in a channel
+type Member struct {
+	Nick string
+	// Modes are the prefix modes the member holds, eg `o` for op, highest
+	// rank first, and Prefixes the symbols shown for them, eg `@`
+	Modes    string
+	Prefixes string
+}
+
+// Prefix is the symbol for the highest ranked mode the member holds, or ""
+func (m Member) Prefix() string {
+	if m.Prefixes == "" {
+		return ""
+	}
+	return m.Prefixes[:1]
+}
+
+// Topic of a channel, SetBy and SetAt are empty when the server did not say
+type Topic struct {
+	Text  string
+	SetBy string
+	SetAt time.Time
+}
+
+// ChannelState is what the bot knows about a channel it is in
+type ChannelState struct {
+	// Name is the folded name of the channel
+	Name string
+	// Members are in order of their folded nicks
+	Members []Member
+	Topic   Topic
+	// Modes are the channel modes that are set, with their parameter when
+	// they have one. List modes, such as bans, are not tracked, and the
+	// parameters of type B modes, such as the key, are secret so they are
+	// never kept.
+	Modes map[string]string
+}
+
+// ModeString formats the modes the way a MODE line would, eg `+kln 10`
+func (cs ChannelState) ModeString() string {
+	if len(cs.Modes) == 0 {
+		return ""
+	}
+	modes := make([]string, 0, len(cs.Modes))
+	for m := range cs.Modes {
+		modes = append(modes, m)
+	}
+	sort.Strings(modes)
+	params := []string{}
+	for _, m := range modes {
+		if p := cs.Modes[m]; p != "" {
+			params = append(params, p)
+		}
+	}
+	return strings.TrimSpace("+" + strings.Join(modes, "") + " " + strings.Join(params, " "))
+}
+
+// modeChange is a single mode being set or unset
+type modeChange struct {
+	add   bool
+	mode  byte
+	param string
+}
+
+// parseModes splits a mode change such as `+ov-k fake-nick other-nick key`
+// into its changes, giving a parameter to the modes that take one
+func (is *ISupport) parseModes(modes string, params []string) []modeChange {
+	changes := []modeChange{}
+	add := true
+	for i := 0; i < len(modes); i++ {
+		c := modes[i]
+		if c == '+' || c == '-' {
+			add = c == '+'
+			continue
+		}
+		takes := false
+		switch {
+		case strings.IndexByte(is.PrefixModes, c) >= 0,
+			strings.IndexByte(is.ChanModes[0], c) >= 0,
+			strings.IndexByte(is.ChanModes[1], c) >= 0:
+			takes = true
+		case strings.IndexByte(is.ChanModes[2], c) >= 0:
+			takes = add
+		}
+		change := modeChange{add: add, mode: c}
+		if takes && len(params) > 0 {
+			change.param, params = params[0], params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+type member struct {
+	nick  string
+	modes string
+}
+
+type channelState struct {
+	members map[string]*member
+	topic   Topic
+	modes   map[byte]string
+	// names collects a NAMES reply, which replaces the members once it ends
+	names map[string]*member
+}
+
+func newChannelState() *channelState {
+	return &channelState{
+		members: map[string]*member{},
+		modes:   map[byte]string{},
+	}
+}
+
+// channelStates tracks the members, topic and modes of each channel the bot
+// is in. Channels and nicks are keyed by their folded names, and the nicks
+// are kept as they were last seen.
+type channelStates struct {
+	m        sync.RWMutex
+	channels map[string]*channelState
+}
+
+func newChannelStates() *channelStates {
+	return &channelStates{channels: map[string]*channelState{}}
+}
+
+// get returns the state of the channel, or nil when the bot is not in it, the
+// caller must hold the lock. State is only created by the bot's own JOIN, so
+// that replies about other channels, such as a WHO before accepting an
+// invite, are not mistaken for channels the bot is in.
+func (cs *channelStates) get(channel string) *channelState {
+	return cs.channels[channel]
+}
+
+// has reports whether the bot is in the channel
+func (cs *channelStates) has(channel string) bool {
+	cs.m.RLock()
+	defer cs.m.RUnlock()
+	return cs.channels[channel] != nil
+}
+
+// reset forgets every channel, for when the connection is lost
+func (cs *channelStates) reset() {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	cs.channels = map[string]*channelState{}
+}
+
+// join adds the nick to the channel, when the bot itself joins anything
+// known about the channel is out of date
+func (cs *channelStates) join(channel, key, nick string, self bool) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if self {
+		cs.channels[channel] = newChannelState()
+	}
+	if c := cs.get(channel); c != nil {
+		c.members[key] = &member{nick: nick}
+	}
+}
+
+func (cs *channelStates) remove(channel, key string) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if c, ok := cs.channels[channel]; ok {
+		delete(c.members, key)
+	}
+}
+
+// removeChannel forgets a channel entirely, for when the bot leaves it
+func (cs *channelStates) removeChannel(channel string) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	delete(cs.channels, channel)
+}
+
+// quit removes the nick from every channel, and returns the channels it was
+// in
+func (cs *channelStates) quit(key string) []string {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	channels := []string{}
+	for name, c := range cs.channels {
+		if _, ok := c.members[key]; ok {
+			delete(c.members, key)
+			channels = append(channels, name)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// rename changes the nick in every channel, and returns the channels it was
+// in
+func (cs *channelStates) rename(from, to, nick string) []string {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	channels := []string{}
+	for name, c := range cs.channels {
+		if m, ok := c.members[from]; ok {
+			delete(c.members, from)
+			m.nick = nick
+			c.members[to] = m
+			channels = append(channels, name)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// names adds an entry from a NAMES reply, eg `@+fake-nick`, to the members
+// being collected for the channel
+func (cs *channelStates) names(channel, entry string, support *ISupport) {
+	// multi-prefix can put several prefixes before the nick, and
+	// userhost-in-names the user and host after it
+	nick := ParseSource(strings.TrimLeft(entry, support.PrefixSymbols)).Nick
+	if nick == "" {
+		return
+	}
+	m := &member{nick: nick}
+	for _, p := range entry[:len(entry)-len(strings.TrimLeft(entry, support.PrefixSymbols))] {
+		if i := strings.IndexRune(support.PrefixSymbols, p); i >= 0 {
+			m.modes = addMode(m.modes, support.PrefixModes[i], support)
+		}
+	}
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	c := cs.get(channel)
+	if c == nil {
+		return
+	}
+	if c.names == nil {
+		c.names = map[string]*member{}
+	}
+	c.names[support.Fold(nick)] = m
+}
+
+// endNames replaces the members of the channel with the NAMES reply
+func (cs *channelStates) endNames(channel string) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	c, ok := cs.channels[channel]
+	if !ok || c.names == nil {
+		return
+	}
+	c.members, c.names = c.names, nil
+}
+
+// mode applies a MODE change to the channel, with clear set every mode that
+// is not in the change is removed first, as for RPL_CHANNELMODEIS
+func (cs *channelStates) mode(channel string, changes []modeChange, clear bool, support *ISupport) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	c := cs.get(channel)
+	if c == nil {
+		return
+	}
+	if clear {
+		c.modes = map[byte]string{}
+	}
+	for _, change := range changes {
+		switch {
+		case strings.IndexByte(support.PrefixModes, change.mode) >= 0:
+			m, ok := c.members[support.Fold(change.param)]
+			if !ok {
+				continue
+			}
+			if change.add {
+				m.modes = addMode(m.modes, change.mode, support)
+			} else {
+				m.modes = strings.Replace(m.modes, string(change.mode), "", 1)
+			}
+		case strings.IndexByte(support.ChanModes[0], change.mode) >= 0:
+			// list modes are not tracked
+		case change.add && strings.IndexByte(support.ChanModes[1], change.mode) >= 0:
+			// the key is only for those let into the channel, so it is
+			// noted without its parameter
+			c.modes[change.mode] = ""
+		case change.add:
+			c.modes[change.mode] = change.param
+		default:
+			delete(c.modes, change.mode)
+		}
+	}
+}
+
+// addMode adds the prefix mode to those a member holds, keeping them in order
+// of rank
+func addMode(modes string, mode byte, support *ISupport) string {
+	if strings.IndexByte(modes, mode) >= 0 {
+		return modes
+	}
+	b := []byte(modes + string(mode))
+	sort.SliceStable(b, func(i, j int) bool {
+		return strings.IndexByte(support.PrefixModes, b[i]) < strings.IndexByte(support.PrefixModes, b[j])
+	})
+	return string(b)
+}
+
+// topic sets the text of the topic, and who set it when that is known
+func (cs *channelStates) topic(channel string, topic Topic) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if c := cs.get(channel); c != nil {
+		c.topic = topic
+	}
+}
+
+// topicWho records who set the topic, from RPL_TOPICWHOTIME
+func (cs *channelStates) topicWho(channel, setBy string, setAt time.Time) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if c := cs.get(channel); c != nil {
+		c.topic.SetBy, c.topic.SetAt = setBy, setAt
+	}
+}
+
+// snapshot copies the state of the channel
+func (cs *channelStates) snapshot(channel string, support *ISupport) (ChannelState, bool) {
+	cs.m.RLock()
+	defer cs.m.RUnlock()
+	c, ok := cs.channels[channel]
+	if !ok {
+		return ChannelState{}, false
+	}
+	state := ChannelState{
+		Name:    channel,
+		Members: make([]Member, 0, len(c.members)),
+		Topic:   c.topic,
+		Modes:   make(map[string]string, len(c.modes)),
+	}
+	keys := make([]string, 0, len(c.members))
+	for k := range c.members {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m := c.members[k]
+		prefixes := []byte{}
+		for i := 0; i < len(m.modes); i++ {
+			if j := strings.IndexByte(support.PrefixModes, m.modes[i]); j >= 0 {
+				prefixes = append(prefixes, support.PrefixSymbols[j])
+			}
+		}
+		state.Members = append(state.Members, Member{Nick: m.nick, Modes: m.modes, Prefixes: string(prefixes)})
+	}
+	for mode, param := range c.modes {
+		state.Modes[string(mode)] = param
+	}
+	return state, true
+}
+
+// ChannelState returns what is known about a channel the bot is in
+func (s *service) ChannelState(channel string) (ChannelState, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.state.snapshot(s.support.Fold(channel), s.support)
+}
+
+// ChannelStates returns what is known about every channel the bot is in, in
+// order of their names
+func (s *service) ChannelStates() []ChannelState {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	s.state.m.RLock()
+	names := make([]string, 0, len(s.state.channels))
+	for name := range s.state.channels {
+		names = append(names, name)
+	}
+	s.state.m.RUnlock()
+	sort.Strings(names)
+	states := make([]ChannelState, 0, len(names))
+	for _, name := range names {
+		if state, ok := s.state.snapshot(name, s.support); ok {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// handleChannelNumeric keeps the channel state up to date from the replies
+// the server sends on joining, and tells consumers it changed. Replies about
+// channels the bot is not in are ignored.
+//
+//	:server 324 me #channel +nt              RPL_CHANNELMODEIS
+//	:server 331 me #channel :No topic is set RPL_NOTOPIC
+//	:server 332 me #channel :the topic       RPL_TOPIC
+//	:server 333 me #channel nick!u@h 1639000000  RPL_TOPICWHOTIME
+//	:server 366 me #channel :End of /NAMES list.
+func (s *service) handleChannelNumeric(msg Message) {
+	support := s.ServerSupport()
+	channel := support.Fold(msg.Arg(1))
+	if msg.Command == "353" {
+		// RPL_NAMREPLY  :server 353 me = #channel :@op +voice nick
+		channel = support.Fold(msg.Arg(2))
+	}
+	if !s.state.has(channel) {
+		return
+	}
+	switch msg.Command {
+	case "324":
+		args := msg.Args()
+		if len(args) < 3 {
+			return
+		}
+		s.state.mode(channel, support.parseModes(args[2], args[3:]), true, &support)
+	case "331":
+		s.state.topic(channel, Topic{})
+	case "332":
+		s.state.topic(channel, Topic{Text: msg.Arg(2)})
+	case "333":
+		var setAt time.Time
+		if sec, err := strconv.ParseInt(msg.Arg(3), 10, 64); err == nil {
+			setAt = time.Unix(sec, 0).UTC()
+		}
+		s.state.topicWho(channel, ParseSource(msg.Arg(2)).Nick, setAt)
+	case "353":
+		for _, entry := range strings.Fields(msg.Arg(3)) {
+			s.state.names(channel, entry, &support)
+		}
+		return
+	case "366":
+		s.state.endNames(channel)
+	}
+	s.send(ChannelStateEvent{EventInfo: EventInfo{Type: EventChannelState, Network: s.Network, Channel: channel, Message: msg}})
+}
+
+// requestModes asks the server for the modes of a channel the bot has joined.
+// It runs on the reader, so the MODE is queued without waiting for it to be
+// sent behind everything else.
+func (s *service) requestModes(channel string) {
+	s.enqueue(PriorityLow, "MODE %s", channel)
+}
@@ -0,0 +1,194 @@
+package IRC
+
+import (
+	"bufio"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelState(t *testing.T) {
+	testcases := map[string]struct {
+		lines    []string
+		expected ChannelState
+		found    bool
+	}{
+		"unknown channel": {},
+		"replies about a channel the bot is not in": {
+			lines: []string{
+				":fake.server 353 fake-user = #fake-channel :@fake-op other-nick",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+				":fake.server 324 fake-user #fake-channel +nt",
+				":fake.server 332 fake-user #fake-channel :a topic",
+				":fake.server 333 fake-user #fake-channel fake-op!u@h 1639000000",
+				":other-nick!u@h JOIN #fake-channel",
+			},
+		},
+		"names with prefixes": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake.server 353 fake-user = #fake-channel :fake-user @+Fake-Op +voiced other-nick!u@h",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+			},
+			found: true,
+			expected: ChannelState{
+				Name: "#fake-channel",
+				Members: []Member{
+					{Nick: "Fake-Op", Modes: "ov", Prefixes: "@+"},
+					{Nick: "fake-user"},
+					{Nick: "other-nick"},
+					{Nick: "voiced", Modes: "v", Prefixes: "+"},
+				},
+				Modes: map[string]string{},
+			},
+		},
+		"a new names reply replaces the members": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake.server 353 fake-user = #fake-channel :fake-user gone-nick",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+				":fake.server 353 fake-user = #fake-channel :fake-user",
+				":fake.server 366 fake-user #fake-channel :End of /NAMES list.",
+			},
+			found: true,
+			expected: ChannelState{
+				Name:    "#fake-channel",
+				Members: []Member{{Nick: "fake-user"}},
+				Modes:   map[string]string{},
+			},
+		},
+		"joins, parts, kicks, quits and nicks": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":a-nick!u@h JOIN #fake-channel",
+				":b-nick!u@h JOIN #fake-channel",
+				":c-nick!u@h JOIN #fake-channel",
+				":d-nick!u@h JOIN #fake-channel",
+				":a-nick!u@h PART #fake-channel",
+				":fake-user!u@h KICK #fake-channel b-nick :behave",
+				":c-nick!u@h QUIT :gone",
+				":d-nick!u@h NICK :New-Nick",
+			},
+			found: true,
+			expected: ChannelState{
+				Name:    "#fake-channel",
+				Members: []Member{{Nick: "fake-user"}, {Nick: "New-Nick"}},
+				Modes:   map[string]string{},
+			},
+		},
+		"modes": {
+			lines: []string{
+				":fake.server 005 fake-user PREFIX=(qaohv)~&@%+ CHANMODES=beI,k,l,imnpst :are supported by this server",
+				":fake-user!u@h JOIN #fake-channel",
+				":fake-nick!u@h JOIN #fake-channel",
+				":fake.server 324 fake-user #fake-channel +ntl 10",
+				":op!u@h MODE #fake-channel +vbko-t FAKE-NICK *!*@spam key fake-nick",
+				":op!u@h MODE #fake-channel -l+h fake-nick",
+				":op!u@h MODE #fake-channel -v fake-nick",
+			},
+			found: true,
+			expected: ChannelState{
+				Name:    "#fake-channel",
+				Members: []Member{{Nick: "fake-nick", Modes: "oh", Prefixes: "@%"}, {Nick: "fake-user"}},
+				Modes:   map[string]string{"n": "", "k": ""},
+			},
+		},
+		"a mode line without modes is ignored": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake.server 324 fake-user #fake-channel +nt",
+				":fake.server MODE #fake-channel",
+			},
+			found: true,
+			expected: ChannelState{
+				Name:    "#fake-channel",
+				Members: []Member{{Nick: "fake-user"}},
+				Modes:   map[string]string{"n": "", "t": ""},
+			},
+		},
+		"topic from joining": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake.server 332 fake-user #fake-channel :the topic",
+				":fake.server 333 fake-user #fake-channel fake-nick!u@h 1639000000",
+			},
+			found: true,
+			expected: ChannelState{
+				Name:    "#fake-channel",
+				Members: []Member{{Nick: "fake-user"}},
+				Topic:   Topic{Text: "the topic", SetBy: "fake-nick", SetAt: time.Unix(1639000000, 0).UTC()},
+				Modes:   map[string]string{},
+			},
+		},
+		"the bot leaving forgets the channel": {
+			lines: []string{
+				":fake-user!u@h JOIN #fake-channel",
+				":fake-nick!u@h JOIN #fake-channel",
+				":fake-user!u@h PART #fake-channel",
+			},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			s, _ := NewService("fake-owner", []string{})
+			s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+			writeErr = nil
+			s.Username = "fake-user"
+			for _, line := range tc.lines {
+				s.processLine(line)
+				s.sendQueue().drain()
+			}
+			state, found := s.ChannelState("#Fake-Channel")
+			assert.Equal(t, tc.found, found)
+			if tc.found {
+				assert.Equal(t, tc.expected, state)
+			}
+		})
+	}
+}
+
+func TestTopicChange(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	s.Username = "fake-user"
+	s.processLine(":fake-user!u@h JOIN #fake-channel")
+	s.processLine(":fake-user!u@h JOIN #other-channel")
+	s.processLine(":fake-nick!u@h TOPIC #fake-channel :new topic")
+	s.sendQueue().drain()
+
+	states := s.ChannelStates()
+	assert.Len(t, states, 2)
+	assert.Equal(t, "#fake-channel", states[0].Name)
+	assert.Equal(t, "new topic", states[0].Topic.Text)
+	assert.Equal(t, "fake-nick", states[0].Topic.SetBy)
+	assert.False(t, states[0].Topic.SetAt.IsZero())
+	assert.Equal(t, "#other-channel", states[1].Name)
+}
+
+func TestModeString(t *testing.T) {
+	assert.Equal(t, "", ChannelState{}.ModeString())
+	assert.Equal(t, "+klnt 10", ChannelState{Modes: map[string]string{"n": "", "t": "", "k": "", "l": "10"}}.ModeString())
+}
+
+func TestChannelKeyIsNotExposed(t *testing.T) {
+	s, _ := NewService("fake-owner", []string{})
+	s.writer = textproto.NewWriter(bufio.NewWriter(&fakeConn{}))
+	writeErr = nil
+	s.Username = "fake-user"
+	s.processLine(":fake-user!u@h JOIN #fake-channel")
+	s.processLine(":fake.server 324 fake-user #fake-channel +knt fake-key")
+	state, _ := s.ChannelState("#fake-channel")
+	assert.Equal(t, "+knt", state.ModeString())
+
+	s.processLine(":op!u@h MODE #fake-channel +kl other-key 10")
+	s.sendQueue().drain()
+	state, _ = s.ChannelState("#fake-channel")
+	assert.Equal(t, "+klnt 10", state.ModeString())
+	assert.NotContains(t, state.ModeString(), "key")
+	for _, param := range state.Modes {
+		assert.NotContains(t, param, "key")
+	}
+}
@@ -0,0 +1,141 @@
+package IRC
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions tune the TLS connection made by Connect. The zero value verifies
+// the server against the system roots, without a client certificate.
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM client certificate and key, used for
+	// CertFP and SASL EXTERNAL. Both or neither must be set.
+	CertFile string
+	KeyFile  string
+	// CAFile is a PEM bundle of the certificate authorities to trust instead
+	// of the system roots
+	CAFile string
+	// ServerName overrides the name sent for SNI and checked against the
+	// server certificate, it defaults to the host being connected to
+	ServerName string
+	// MinVersion is the oldest TLS version allowed, 1.2 unless set
+	MinVersion uint16
+	// Pins are the base64 SHA-256 hashes of the SubjectPublicKeyInfo of
+	// certificates the server must present one of, as well as passing the
+	// usual verification. An optional `sha256/` prefix is ignored.
+	Pins []string
+}
+
+// TLSOptionError is the reason TLSOptions cannot be used, Options are the
+// names of the fields that are wrong, so that callers can name the setting
+// they came from
+type TLSOptionError struct {
+	Options []string
+	Err     error
+}
+
+func (e *TLSOptionError) Error() string {
+	return fmt.Sprintf("tls %s %v", strings.Join(e.Options, " and "), e.Err)
+}
+
+func (e *TLSOptionError) Unwrap() error {
+	return e.Err
+}
+
+// ParseTLSVersion turns a version such as 1.2 into its crypto/tls value
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q, expected one of 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// hasClientCert reports whether a client certificate has been configured
+func (o TLSOptions) hasClientCert() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+// Validate checks that the options can be used, the files they name are
+// read, errors are a TLSOptionError
+func (o TLSOptions) Validate() error {
+	_, err := o.config()
+	return err
+}
+
+// config builds the tls.Config the options describe, errors are a
+// TLSOptionError naming the option that is wrong
+func (o TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{
+		Rand:       rand.Reader,
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if o.MinVersion != 0 {
+		config.MinVersion = o.MinVersion
+	}
+
+	if o.hasClientCert() {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, &TLSOptionError{[]string{"CertFile", "KeyFile"}, fmt.Errorf("must be set together")}
+		}
+		cert, err := tlsLoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, &TLSOptionError{[]string{"CertFile", "KeyFile"}, fmt.Errorf("could not be loaded from %q and %q %w", o.CertFile, o.KeyFile, err)}
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, &TLSOptionError{[]string{"CAFile"}, fmt.Errorf("%q could not be read %w", o.CAFile, err)}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &TLSOptionError{[]string{"CAFile"}, fmt.Errorf("%q holds no PEM certificates", o.CAFile)}
+		}
+		config.RootCAs = pool
+	}
+
+	if len(o.Pins) > 0 {
+		pins := make([][]byte, 0, len(o.Pins))
+		for _, p := range o.Pins {
+			pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(p), "sha256/"))
+			if err != nil || len(pin) != sha256.Size {
+				return nil, &TLSOptionError{[]string{"Pins"}, fmt.Errorf("%q is not a base64 SHA-256 hash", p)}
+			}
+			pins = append(pins, pin)
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs.PeerCertificates, pins)
+		}
+	}
+	return config, nil
+}
+
+// verifyPins checks that one of the certificates has a pinned public key
+func verifyPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("tls server certificate does not match any of the Pins")
+}
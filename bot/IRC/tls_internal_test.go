@@ -0,0 +1,105 @@
+package IRC
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	testcases := map[string]struct {
+		version string
+		out     uint16
+		outErr  error
+	}{
+		"dotted":        {version: "1.2", out: tls.VersionTLS12},
+		"named":         {version: "TLS1.3", out: tls.VersionTLS13},
+		"without a dot": {version: "11", out: tls.VersionTLS11},
+		"unknown": {
+			version: "2.0",
+			outErr:  fmt.Errorf("unknown tls version %q, expected one of 1.0, 1.1, 1.2 or 1.3", "2.0"),
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			v, err := ParseTLSVersion(tc.version)
+			if tc.outErr == nil {
+				assert.Nil(t, err, "got unexpected err %v", err)
+				assert.Equal(t, tc.out, v)
+			} else {
+				assert.EqualError(t, err, tc.outErr.Error())
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.txt")
+	assert.Nil(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o600))
+	missing := filepath.Join(dir, "missing.pem")
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	testcases := map[string]struct {
+		opts   TLSOptions
+		min    uint16
+		outErr error
+	}{
+		"defaults": {min: tls.VersionTLS12},
+		"minimum version": {
+			opts: TLSOptions{MinVersion: tls.VersionTLS13},
+			min:  tls.VersionTLS13,
+		},
+		"cert without key": {
+			opts:   TLSOptions{CertFile: "cert.pem"},
+			outErr: fmt.Errorf("tls CertFile and KeyFile must be set together"),
+		},
+		"missing ca file": {
+			opts:   TLSOptions{CAFile: missing},
+			outErr: fmt.Errorf("tls CAFile %q could not be read open %s: no such file or directory", missing, missing),
+		},
+		"ca file without certificates": {
+			opts:   TLSOptions{CAFile: notPEM},
+			outErr: fmt.Errorf("tls CAFile %q holds no PEM certificates", notPEM),
+		},
+		"bad pin": {
+			opts:   TLSOptions{Pins: []string{"c2hvcnQ="}},
+			outErr: fmt.Errorf("tls Pins %q is not a base64 SHA-256 hash", "c2hvcnQ="),
+		},
+		"prefixed pin": {
+			opts: TLSOptions{Pins: []string{"sha256/" + pin}},
+			min:  tls.VersionTLS12,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			config, err := tc.opts.config()
+			if tc.outErr == nil {
+				assert.Nil(t, err, "got unexpected err %v", err)
+				assert.Equal(t, tc.min, config.MinVersion)
+				assert.Equal(t, len(tc.opts.Pins) > 0, config.VerifyConnection != nil)
+			} else {
+				assert.EqualError(t, err, tc.outErr.Error())
+				var optErr *TLSOptionError
+				assert.True(t, errors.As(err, &optErr), "got %T", err)
+			}
+		})
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	cert := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("fake-spki")}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other-spki"))
+
+	assert.Nil(t, verifyPins([]*x509.Certificate{cert}, [][]byte{other[:], sum[:]}))
+	assert.EqualError(t, verifyPins([]*x509.Certificate{cert}, [][]byte{other[:]}), "tls server certificate does not match any of the Pins")
+}
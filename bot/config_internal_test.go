@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadNetworkTLSErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	testcases := map[string]struct {
+		env    map[string]string
+		outErr string
+	}{
+		"cert without key": {
+			env:    map[string]string{"FAKE_TLS_CERT_FILE": "cert.pem"},
+			outErr: "env var FAKE_TLS_CERT_FILE and FAKE_TLS_KEY_FILE must be set together",
+		},
+		"missing ca file": {
+			env:    map[string]string{"FAKE_TLS_CA_FILE": missing},
+			outErr: "env var FAKE_TLS_CA_FILE \"" + missing + "\" could not be read open " + missing + ": no such file or directory",
+		},
+		"bad pin": {
+			env:    map[string]string{"FAKE_TLS_PINS": "c2hvcnQ="},
+			outErr: "env var FAKE_TLS_PINS \"c2hvcnQ=\" is not a base64 SHA-256 hash",
+		},
+		"not checked without SECURE": {
+			env: map[string]string{"FAKE_SECURE": "false", "FAKE_TLS_PINS": "c2hvcnQ="},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("FAKE_BOT_OWNER", "fake-owner")
+			t.Setenv("FAKE_IRC_SERVER", "irc.fake.server:6697")
+			t.Setenv("FAKE_SECURE", "true")
+			t.Setenv("FAKE_IRC_USERNAME", "fake-user")
+			t.Setenv("FAKE_IRC_PASSWORD", "fake-password")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadNetwork(network{name: "fake", prefix: "FAKE_"})
+			if tc.outErr == "" {
+				assert.Nil(t, err, "got unexpected err %v", err)
+				return
+			}
+			assert.EqualError(t, err, tc.outErr)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mindfarm/fluentdrama/bot/IRC"
+)
+
+// inboxPage is how many private messages the inbox command shows at once
+const inboxPage = 10
+
+// inboxSenders is how many senders are named in the summary
+const inboxSenders = 5
+
+type sayer interface {
+	Say(target, text string) error
+}
+
+// storePrivate keeps a message, action or notice sent to the bot for the owner
+func storePrivate(ds datastore, ev IRC.EventInfo) {
+	kind := "message"
+	switch ev.Type {
+	case IRC.EventPrivateNotice:
+		kind = "notice"
+	case IRC.EventPrivateAction:
+		kind = "action"
+	}
+	if err := ds.AddPrivate(context.Background(), ev.Network, ev.Nick, ev.Account, kind, ev.Text, ev.Message.Charset != ""); err != nil {
+		log.Printf("Error adding private %s from %s %v", kind, ev.Nick, err)
+	}
+}
+
+// summarisePrivate tells the owner, who has just come online, about the
+// private messages waiting for them
+func summarisePrivate(ds datastore, s sayer, network, nick string) {
+	count, senders, err := ds.CountPrivate(context.Background(), network)
+	if err != nil {
+		log.Printf("Error counting private messages %v", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+	from := strings.Join(senders, ", ")
+	if len(senders) > inboxSenders {
+		from = fmt.Sprintf("%s and %d others", strings.Join(senders[:inboxSenders], ", "), len(senders)-inboxSenders)
+	}
+	if err := s.Say(nick, fmt.Sprintf("%d private messages waiting on %s from %s, send inbox to read them", count, network, from)); err != nil {
+		log.Printf("Error telling %s about private messages %v", nick, err)
+	}
+}
+
+// registerInboxCommands lets the owner read the private messages kept for them,
+// and acknowledge them once read. The datastore is used from the worker, not
+// the reader.
+func registerInboxCommands(s commandRegistry, ds datastore, network string, w *worker) error {
+	// shown are the ids the last inbox listed, ack all acknowledges only
+	// those, so that messages that arrived since are not acknowledged
+	// unseen. Only the worker touches it.
+	var shown []int64
+	if err := s.RegisterCommand(IRC.Command{
+		Name: "inbox",
+		Help: "lists the private messages sent to the bot that have not been acknowledged",
+		Run: w.command(func(req IRC.CommandRequest) error {
+			msgs, err := ds.GetPrivate(context.Background(), network, inboxPage+1)
+			if err != nil {
+				log.Printf("Error fetching private messages %v", err)
+				return fmt.Errorf("unable to fetch, please try again later")
+			}
+			shown = nil
+			if len(msgs) == 0 {
+				return req.Reply("no private messages")
+			}
+			more := len(msgs) > inboxPage
+			if more {
+				msgs = msgs[:inboxPage]
+			}
+			for _, m := range msgs {
+				from := "<" + m.Nick + ">"
+				switch m.Kind {
+				case "notice":
+					from = "-" + m.Nick + "-"
+				case "action":
+					from = "* " + m.Nick
+				}
+				if err := req.Reply("%d %s %s %s", m.ID, m.Stamp.UTC().Format("2006-01-02 15:04"), from, m.Said); err != nil {
+					return err
+				}
+				shown = append(shown, m.ID)
+			}
+			if more {
+				return req.Reply("there are more, ack these to see the rest")
+			}
+			return nil
+		}),
+	}); err != nil {
+		return err
+	}
+	return s.RegisterCommand(IRC.Command{
+		Name:    "ack",
+		Usage:   "<id>... | all",
+		Help:    "acknowledges private messages, by the ids inbox shows, or all of those it last showed, so that they are no longer listed",
+		MinArgs: 1,
+		MaxArgs: -1,
+		Run: w.command(func(req IRC.CommandRequest) error {
+			ids := []int64{}
+			all := len(req.Args) == 1 && strings.EqualFold(req.Args[0], "all")
+			if all {
+				if len(shown) == 0 {
+					return req.Reply("nothing listed to acknowledge, send inbox first")
+				}
+				ids = shown
+			} else {
+				for _, arg := range req.Args {
+					id, err := strconv.ParseInt(arg, 10, 64)
+					if err != nil {
+						return fmt.Errorf("%q is not a private message id", arg)
+					}
+					ids = append(ids, id)
+				}
+			}
+			n, err := ds.AckPrivate(context.Background(), network, ids)
+			if err != nil {
+				log.Printf("Error acknowledging private messages %v", err)
+				return fmt.Errorf("unable to save, please try again later")
+			}
+			if all {
+				shown = nil
+			}
+			return req.Reply("acknowledged %d private messages", n)
+		}),
+	})
+}
@@ -2,119 +2,306 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mindfarm/fluentdrama/bot/IRC"
 	data "github.com/mindfarm/fluentdrama/bot/repository/postgres"
 )
 
+type datastore interface {
+	AddChannel(ctx context.Context, network, channel string) error
+	GetChannels(ctx context.Context, network string) ([]string, error)
+	AddLog(ctx context.Context, network, channel, nick, account, event, said string, transcoded bool) error
+	AddOptOut(ctx context.Context, network, kind, identity string) error
+	RemoveOptOut(ctx context.Context, network, kind, identity string) error
+	GetOptOuts(ctx context.Context, network string) ([][2]string, error)
+	SetChannelState(ctx context.Context, network, channel, topic, topicSetter string, topicTime time.Time, modes string, members []string) error
+	ClearChannelState(ctx context.Context, network, channel string) error
+	SetChannelStatus(ctx context.Context, network, channel, status, reason string) error
+	AddPrivate(ctx context.Context, network, nick, account, kind, said string, transcoded bool) error
+	GetPrivate(ctx context.Context, network string, limit int) ([]data.PrivateMessage, error)
+	CountPrivate(ctx context.Context, network string) (int, []string, error)
+	AckPrivate(ctx context.Context, network string, ids []int64) (int64, error)
+}
+
 func main() {
 	dbURI, ok := os.LookupEnv("DBURI")
 	if !ok {
 		log.Fatalf("DBURI is not set")
 	}
 
-	owner, ok := os.LookupEnv("BOT_OWNER")
-	if !ok {
-		log.Fatal("env var BOT_OWNER not set, cannot continue")
+	networks, err := loadNetworks()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	server, ok := os.LookupEnv("IRC_SERVER")
-	if !ok {
-		log.Fatal("env var IRC_SERVER not set, cannot continue")
+	// Datastore
+	ds, err := data.NewPgCustomerRepo(dbURI)
+	if err != nil {
+		log.Fatalf("Unable to connect to datastore with error %v", err)
 	}
 
-	secureStr, ok := os.LookupEnv("SECURE")
-	if !ok {
-		log.Print("env var SECURE not set, defaulting to `false`")
-		secureStr = "false"
+	// SIGINT and SIGTERM stop the bot, each network quits and the logs still
+	// waiting are written before it exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	stopped := make(chan error, len(networks))
+	// a network that cannot be started is logged and the others carry on
+	running := 0
+	for _, n := range networks {
+		if err := startNetwork(ctx, ds, n, &wg, stopped); err != nil {
+			log.Printf("Unable to start network %s: %v", n.name, err)
+			continue
+		}
+		running++
 	}
-	secureBool, err := strconv.ParseBool(secureStr)
-	if err != nil {
-		log.Fatalf("env var SECURE was not a valid boolean, please use `true` or `false`, got %q", secureStr)
+	if running == 0 {
+		log.Fatal("No network could be started")
 	}
 
-	username, ok := os.LookupEnv("IRC_USERNAME")
-	if !ok {
-		log.Fatal("env var IRC_USERNAME not set, cannot continue")
+	// the bot runs until it is stopped, or every network has stopped. A
+	// network that fails is logged and the others carry on.
+	failed := running < len(networks)
+wait:
+	for running > 0 {
+		select {
+		case <-ctx.Done():
+			log.Print("Shutting down")
+			break wait
+		case err := <-stopped:
+			running--
+			if err != nil {
+				log.Print(err)
+				failed = true
+			}
+		}
 	}
-
-	password, ok := os.LookupEnv("IRC_PASSWORD")
-	if !ok {
-		log.Fatal("env var IRC_PASSWORD not set, cannot continue")
+	if running == 0 {
+		log.Print("Every network has stopped, shutting down")
 	}
+	cancel()
+	wg.Wait()
+	if failed {
+		os.Exit(1)
+	}
+}
 
-	// Datastore
-	ds, err := data.NewPgCustomerRepo(dbURI)
+// startNetwork connects to the network and logs its channels to the datastore
+// until ctx is cancelled. Once the network stops, whether it failed, quit or
+// was cancelled, the error that stopped it, or nil, is sent on stopped. wg is
+// done once the bot has quit and every event has been stored.
+func startNetwork(ctx context.Context, ds datastore, n network, wg *sync.WaitGroup, stopped chan<- error) error {
+	channels, err := ds.GetChannels(context.Background(), n.name)
 	if err != nil {
-		log.Fatalf("Unable to connect to datastore with error %v", err)
+		log.Printf("error fetching channels for %s %v", n.name, err)
 	}
-	fmt.Println(ds)
-	channels, err := ds.GetChannels(context.Background())
+
+	// Create an instance of the server
+	s, err := IRC.NewService(n.owner, channels)
 	if err != nil {
-		log.Printf("error fetching channels %v", err)
+		return err
 	}
+	s.Network = n.name
+	s.SASLMechanism = n.mechanism
+	s.JoinOn = n.joinOn
+	s.AltNicks = n.altNicks
+	s.NickRecovery = n.nickRecovery
+	s.FloodBurst = n.floodBurst
+	s.FloodRate = n.floodRate
+	s.PingInterval = n.pingInterval
+	s.PingTimeout = n.pingTimeout
+	s.TLS = n.tls
+	s.Proxy = n.proxy
+	s.InvitePolicy = n.invitePolicy
+	s.QuitMessage = n.quitMessage
+	s.Charset = n.charset
+	s.ChannelCharsets = n.channelCharsets
+	s.OwnerNicks = n.ownerNicks
 
-	// Create an instance of the server
-	out := make(chan map[string]string)
-	s, err := IRC.NewService(owner, channels, out)
+	// commands that use the datastore run on the worker, not the reader
+	w := newWorker()
+	go w.run(ctx)
+
+	// people can ask the bot not to log them
+	optouts := newOptOuts(s.Fold)
+	ids, err := ds.GetOptOuts(context.Background(), n.name)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	for _, id := range ids {
+		optouts.set(id[0], id[1], true)
+	}
+	if err := registerOptOutCommands(s, ds, n.name, optouts, w); err != nil {
+		return err
+	}
+	// messages sent to the bot are kept for the owner
+	if err := registerInboxCommands(s, ds, n.name, w); err != nil {
+		return err
 	}
 
-	// Connect to the server
-	if err = s.Connect(server, secureBool); err != nil {
-		log.Fatalf("Could not connect to server with error %v", err)
+	// every event is stored, the buffer lets the reader carry on while the
+	// datastore is slow. Once it fills the reader waits for storeWait, and
+	// then events are dropped until the datastore catches up, so that the
+	// bot still answers PINGs.
+	events := s.Subscribe(IRC.SubscribeOptions{Buffer: storeBuffer, Overflow: IRC.OverflowWait, Wait: storeWait})
+
+	// Connect to the server, and begin registering straight away, the
+	// channels are joined once the server says we are ready. A server that
+	// cannot be reached is retried by Run, with backoff, the way a lost
+	// connection is.
+	if err = s.Connect(n.server, n.secure); err != nil {
+		var cfgErr *IRC.ConfigError
+		if errors.As(err, &cfgErr) {
+			return err
+		}
+		log.Printf("Unable to connect to %s, will retry %v", n.name, err)
+	}
+	if err = s.Login(n.username, n.password); err != nil {
+		return err
 	}
 
-	go s.Listen()
-	// m := map[string]string{}
+	stored := make(chan struct{})
+	wg.Add(1)
 	go func() {
-		// Just dump the output for now
-		for {
-			m := <-out
-			log.Printf("%#v", m)
-			c, ok := m["Command"]
-			if !ok {
-				log.Printf("No command detected in %#v", m)
-				continue
-			}
-			switch strings.ToUpper(c) {
-			case "JOIN":
-				if p, ok := m["Prefix"]; ok && strings.Split(p, "!")[0] == username {
-					if err = ds.AddChannel(context.Background(), m["CmdParams"]); err != nil {
-						log.Printf("Error adding channel %s %v", c, err)
-					} else {
-						log.Println("Successfully added channel ", c)
+		defer wg.Done()
+		// the subscription is closed once Run has returned
+		err := s.Run(ctx)
+		<-stored
+		if err != nil {
+			err = fmt.Errorf("network %s failed with %w", n.name, err)
+		}
+		stopped <- err
+	}()
+	// the state of each channel is saved once its changes have settled,
+	// rather than for every event
+	states := newStateSaver(s.Fold, func(channel string) {
+		saveChannelState(ds, s, optouts, n.name, channel)
+	})
+	go states.run()
+	go func() {
+		defer close(stored)
+		defer states.stop()
+		for e := range events.C {
+			ev := e.Info()
+			switch ev.Type {
+			case IRC.EventDisconnected:
+				// the bot is in no channels until it reconnects
+				states.clear(func() {
+					if err := ds.ClearChannelState(context.Background(), ev.Network, ""); err != nil {
+						log.Printf("Error clearing channel state %v", err)
 					}
+				})
+				continue
+			case IRC.EventConnected, IRC.EventReconnecting:
+				// lifecycle events are not logged
+				continue
+			case IRC.EventChannelState:
+				states.mark(ev.Channel)
+				continue
+			case IRC.EventChannelStatus:
+				saveChannelStatus(ds, s, ev.Network, ev.Channel)
+				continue
+			case IRC.EventReady:
+				log.Printf("Registered with %s (%s)", n.name, n.server)
+				continue
+			case IRC.EventPrivateMessage, IRC.EventPrivateNotice, IRC.EventPrivateAction:
+				storePrivate(ds, ev)
+				continue
+			case IRC.EventOwnerOnline:
+				network, nick := ev.Network, ev.Nick
+				if err := w.do(func() { summarisePrivate(ds, s, network, nick) }); err != nil {
+					log.Printf("Not telling %s about private messages, %v", nick, err)
 				}
-			case "PRIVMSG":
-				// log channel messagesAddLog(ctx context.Context, channel, username, said string) error
-				// ignore private messages sent to the bot
-				if cp, ok := m["CmdParams"]; ok && strings.Split(cp, "!")[0] != username {
-					if err = ds.AddLog(context.Background(), m["CmdParams"], strings.Split(m["Prefix"], "!")[0], m["Trailing"]); err != nil {
-						log.Printf("Error adding log %#v %v", m, err)
+				continue
+			case IRC.EventJoin:
+				if s.Fold(ev.Nick) == s.Fold(s.CurrentNick()) {
+					if err := ds.AddChannel(context.Background(), ev.Network, ev.Channel); err != nil {
+						log.Printf("Error adding channel %s %v", ev.Channel, err)
 					} else {
-						log.Println("Successfully added log ", m)
+						log.Println("Successfully added channel ", ev.Channel)
 					}
+					saveChannelStatus(ds, s, ev.Network, ev.Channel)
 				}
 			}
+			switch ev.Type {
+			case IRC.EventJoin, IRC.EventPart, IRC.EventKick, IRC.EventQuit, IRC.EventNick, IRC.EventTopic, IRC.EventMode:
+				states.mark(ev.Channel)
+			}
+			ev, ok := optouts.filter(ev, n.optOutMode)
+			if !ok {
+				continue
+			}
+			if err := ds.AddLog(context.Background(), ev.Network, ev.Channel, ev.Nick, ev.Account, ev.Type, ev.Text, ev.Message.Charset != ""); err != nil {
+				log.Printf("Error adding %s log for %s %s %v", ev.Type, ev.Network, ev.Channel, err)
+			}
 		}
 	}()
+	return nil
+}
 
-	// TODO - drop this sleep and call the Login when a 376 is detected (end of
-	// motd)
-	time.Sleep(5 * time.Second)
-	err = s.Login(username, password)
-	if err != nil {
-		log.Fatalf("Unable to login with the following issue: %v", err)
+// storeBuffer is how many events can wait to be stored, and storeWait how
+// long the reader waits for room once they fill it
+const (
+	storeBuffer = 1000
+	storeWait   = 5 * time.Second
+)
+
+type channelStater interface {
+	ChannelState(channel string) (IRC.ChannelState, bool)
+	Account(nick string) (string, bool)
+}
+
+type channelStatuser interface {
+	ChannelStatus(channel string) (IRC.ChannelStatus, bool)
+}
+
+// saveChannelStatus stores whether the bot is in the channel, and why not, for
+// the webserver to show
+func saveChannelStatus(ds datastore, s channelStatuser, network, channel string) {
+	status, ok := s.ChannelStatus(channel)
+	if !ok {
+		return
+	}
+	if err := ds.SetChannelStatus(context.Background(), network, channel, status.Status, status.Reason); err != nil {
+		log.Printf("Error saving status of %s %v", channel, err)
+	}
+}
+
+// saveChannelState stores what the bot knows about the channel, for the
+// webserver to show. People who have opted out, by nick or by the account the
+// bot knows they are logged in to, are left out of the members.
+func saveChannelState(ds datastore, s channelStater, o *optOuts, network, channel string) {
+	state, ok := s.ChannelState(channel)
+	if !ok {
+		if err := ds.ClearChannelState(context.Background(), network, channel); err != nil {
+			log.Printf("Error clearing state of %s %v", channel, err)
+		}
+		return
+	}
+	members := make([]string, 0, len(state.Members))
+	for _, m := range state.Members {
+		account, _ := s.Account(m.Nick)
+		if o.has(m.Nick, account) {
+			continue
+		}
+		members = append(members, m.Prefix()+m.Nick)
+	}
+	topic := state.Topic
+	if account, _ := s.Account(topic.SetBy); o.has(topic.SetBy, account) {
+		topic.SetBy = redacted
+	}
+	if err := ds.SetChannelState(context.Background(), network, channel, topic.Text, topic.SetBy, topic.SetAt, state.ModeString(), members); err != nil {
+		log.Printf("Error saving state of %s %v", channel, err)
 	}
-	time.Sleep(15 * time.Second)
-	// hold the main thread open forever
-	select {}
 }
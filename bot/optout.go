@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/mindfarm/fluentdrama/bot/IRC"
+)
+
+// The kinds of identity someone can opt out of logging with
+const (
+	optOutNick    = "nick"
+	optOutAccount = "account"
+)
+
+// What happens to the lines of people who have opted out
+const (
+	// optOutSkip does not store their lines at all
+	optOutSkip = "skip"
+	// optOutRedact stores that something happened, without who or what
+	optOutRedact = "redact"
+)
+
+const redacted = "[redacted]"
+
+// optOuts are the identities on a network that are not to be logged, kept in
+// memory so that every event does not need a database lookup. Nicks are
+// folded by the network's CASEMAPPING, and accounts by foldAccount.
+type optOuts struct {
+	m        sync.RWMutex
+	fold     func(string) string
+	nicks    map[string]struct{}
+	accounts map[string]struct{}
+}
+
+func newOptOuts(fold func(string) string) *optOuts {
+	return &optOuts{
+		fold:     fold,
+		nicks:    map[string]struct{}{},
+		accounts: map[string]struct{}{},
+	}
+}
+
+func (o *optOuts) set(kind, identity string, out bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	ids := o.nicks
+	if kind == optOutAccount {
+		ids = o.accounts
+		identity = foldAccount(identity)
+	} else {
+		identity = o.fold(identity)
+	}
+	if out {
+		ids[identity] = struct{}{}
+	} else {
+		delete(ids, identity)
+	}
+}
+
+// has reports whether the nick or account has opted out
+func (o *optOuts) has(nick, account string) bool {
+	o.m.RLock()
+	defer o.m.RUnlock()
+	if _, ok := o.nicks[o.fold(nick)]; ok {
+		return true
+	}
+	_, ok := o.accounts[foldAccount(account)]
+	return ok && account != ""
+}
+
+// foldAccount folds a services account, which services match ignoring case,
+// the way the webserver compares them
+func foldAccount(account string) string {
+	return strings.ToLower(account)
+}
+
+// target is the nick that an event names in its text, the new nick of a NICK
+// and the kicked nick of a KICK, it is empty for every other event
+func target(ev IRC.EventInfo) string {
+	switch ev.Type {
+	case IRC.EventNick:
+		return ev.Text
+	case IRC.EventKick:
+		// the kicked nick is the first word, the reason follows it
+		return strings.SplitN(ev.Text, " ", 2)[0]
+	}
+	return ""
+}
+
+// filter applies the opt outs to an event before it is stored, it reports
+// false when the event should not be stored at all. The nick an event names,
+// the new nick of a NICK or the kicked nick of a KICK, is checked as well as
+// the sender.
+func (o *optOuts) filter(ev IRC.EventInfo, mode string) (IRC.EventInfo, bool) {
+	out := o.has(ev.Nick, ev.Account)
+	if t := target(ev); !out && t != "" {
+		out = o.has(t, "")
+	}
+	if !out {
+		return ev, true
+	}
+	if mode != optOutRedact {
+		return ev, false
+	}
+	text := ""
+	if ev.Type == IRC.EventNick || ev.Type == IRC.EventKick {
+		// so the line still reads as someone kicked, or renamed
+		text = redacted
+	}
+	ev.Nick, ev.Account, ev.Text = redacted, "", text
+	return ev, true
+}
+
+// optOutIdentity is the identity the sender of a command opts out with, their
+// folded services account when it is known, their folded nick otherwise
+func optOutIdentity(req IRC.CommandRequest, fold func(string) string) (string, string) {
+	if req.Account != "" {
+		return optOutAccount, foldAccount(req.Account)
+	}
+	return optOutNick, fold(req.Source.Nick)
+}
+
+// optInIdentity is the identity the sender of optin is logged again with.
+// Anyone can use a nick, so only a services account can opt back in, the
+// owner alone can opt a nick back in, by naming it.
+func optInIdentity(req IRC.CommandRequest, fold func(string) string) (string, string, error) {
+	if len(req.Args) > 0 {
+		if !req.Owner {
+			return "", "", fmt.Errorf("only the owner can opt in a nick")
+		}
+		return optOutNick, fold(req.Args[0]), nil
+	}
+	if req.Account == "" {
+		return "", "", fmt.Errorf("log in to services first, anyone could be using the nick %s", req.Source.Nick)
+	}
+	return optOutAccount, foldAccount(req.Account), nil
+}
+
+type commandRegistry interface {
+	RegisterCommand(cmd IRC.Command) error
+	Fold(name string) string
+}
+
+// registerOptOutCommands lets anyone ask the bot to stop, or start again,
+// logging them on the network. The datastore is used from the worker, not the
+// reader.
+func registerOptOutCommands(s commandRegistry, ds datastore, network string, o *optOuts, w *worker) error {
+	toggle := func(out bool) func(req IRC.CommandRequest) error {
+		return w.command(func(req IRC.CommandRequest) error {
+			kind, identity := optOutIdentity(req, s.Fold)
+			var err error
+			if !out {
+				if kind, identity, err = optInIdentity(req, s.Fold); err != nil {
+					return err
+				}
+			}
+			if out {
+				err = ds.AddOptOut(context.Background(), network, kind, identity)
+			} else {
+				err = ds.RemoveOptOut(context.Background(), network, kind, identity)
+			}
+			if err != nil {
+				log.Printf("Error saving optout for %s %s %v", kind, identity, err)
+				return fmt.Errorf("unable to save, please try again later")
+			}
+			o.set(kind, identity, out)
+			log.Printf("%s %s %s opted out %t", network, kind, identity, out)
+			switch {
+			case out && kind == optOutAccount:
+				return req.Reply("%s %s will no longer be logged on %s, and past lines are hidden. Send optin to undo this.", kind, identity, network)
+			case out:
+				return req.Reply("%s %s will no longer be logged on %s, and past lines are hidden. Anyone could use the nick, so only the owner can undo this.", kind, identity, network)
+			}
+			return req.Reply("%s %s will be logged on %s again", kind, identity, network)
+		})
+	}
+	if err := s.RegisterCommand(IRC.Command{
+		Name:       "optout",
+		Help:       "stops the bot logging you, by services account if you are logged in and by nick if not",
+		Permission: IRC.PermissionAnyone,
+		Run:        toggle(true),
+	}); err != nil {
+		return err
+	}
+	return s.RegisterCommand(IRC.Command{
+		Name:       "optin",
+		Usage:      "[nick]",
+		Help:       "lets the bot log your services account again, you must be logged in, only the owner can name a nick to log again",
+		MaxArgs:    1,
+		Permission: IRC.PermissionAnyone,
+		Run:        toggle(false),
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mindfarm/fluentdrama/bot/IRC"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptOutsFilter(t *testing.T) {
+	o := newOptOuts(strings.ToLower)
+	o.set(optOutNick, "Opted-Out", true)
+	o.set(optOutAccount, "Hidden-Account", true)
+
+	testcases := map[string]struct {
+		ev      IRC.EventInfo
+		mode    string
+		stored  bool
+		nick    string
+		account string
+		text    string
+	}{
+		"Someone else is stored": {
+			ev:     IRC.EventInfo{Type: IRC.EventMessage, Nick: "someone", Text: "hello"},
+			mode:   optOutSkip,
+			stored: true,
+			nick:   "someone",
+			text:   "hello",
+		},
+		"An opted out nick is skipped": {
+			ev:   IRC.EventInfo{Type: IRC.EventMessage, Nick: "opted-out", Text: "hello"},
+			mode: optOutSkip,
+		},
+		"An opted out account is redacted": {
+			ev:     IRC.EventInfo{Type: IRC.EventMessage, Nick: "someone", Account: "hidden-account", Text: "hello"},
+			mode:   optOutRedact,
+			stored: true,
+			nick:   redacted,
+		},
+		"Changing to an opted out nick is skipped": {
+			ev:   IRC.EventInfo{Type: IRC.EventNick, Nick: "someone", Text: "Opted-Out"},
+			mode: optOutSkip,
+		},
+		"Changing to an opted out nick is redacted": {
+			ev:     IRC.EventInfo{Type: IRC.EventNick, Nick: "someone", Text: "Opted-Out"},
+			mode:   optOutRedact,
+			stored: true,
+			nick:   redacted,
+			text:   redacted,
+		},
+		"Kicking an opted out nick is skipped": {
+			ev:   IRC.EventInfo{Type: IRC.EventKick, Nick: "op", Text: "OPTED-OUT spamming"},
+			mode: optOutSkip,
+		},
+		"Kicking an opted out nick is redacted": {
+			ev:     IRC.EventInfo{Type: IRC.EventKick, Nick: "op", Text: "opted-out spamming"},
+			mode:   optOutRedact,
+			stored: true,
+			nick:   redacted,
+			text:   redacted,
+		},
+		"Kicking someone else is stored": {
+			ev:     IRC.EventInfo{Type: IRC.EventKick, Nick: "op", Text: "someone opted-out"},
+			mode:   optOutSkip,
+			stored: true,
+			nick:   "op",
+			text:   "someone opted-out",
+		},
+		"A message naming an opted out nick is stored": {
+			ev:     IRC.EventInfo{Type: IRC.EventMessage, Nick: "someone", Text: "opted-out"},
+			mode:   optOutSkip,
+			stored: true,
+			nick:   "someone",
+			text:   "opted-out",
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ev, ok := o.filter(tc.ev, tc.mode)
+			assert.Equal(t, tc.stored, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, tc.nick, ev.Nick)
+			assert.Equal(t, tc.account, ev.Account)
+			assert.Equal(t, tc.text, ev.Text)
+		})
+	}
+}
@@ -0,0 +1,8 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Every row was a PRIVMSG before the event column existed
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS event TEXT NOT NULL DEFAULT 'message';
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+ALTER TABLE logs DROP COLUMN IF EXISTS event;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Channels and logs recorded before networks existed belong to the network
+-- the bot calls `default`
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS network TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE channels ALTER COLUMN network DROP DEFAULT;
+ALTER TABLE channels DROP CONSTRAINT IF EXISTS channels_name_key;
+ALTER TABLE channels ADD CONSTRAINT channels_network_name_key UNIQUE(network, name);
+
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS network TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE logs ALTER COLUMN network DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS logs_network_channel_stamp_idx ON logs(network, channel, stamp);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP INDEX IF EXISTS logs_network_channel_stamp_idx;
+ALTER TABLE logs DROP COLUMN IF EXISTS network;
+ALTER TABLE channels DROP CONSTRAINT IF EXISTS channels_network_name_key;
+ALTER TABLE channels DROP COLUMN IF EXISTS network;
+ALTER TABLE channels ADD CONSTRAINT channels_name_key UNIQUE(name);
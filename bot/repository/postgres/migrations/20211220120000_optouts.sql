@@ -0,0 +1,19 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- People who have asked not to be logged, by nick or services account. Nicks
+-- are stored in lower case.
+CREATE TABLE IF NOT EXISTS optouts (
+    network TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('nick', 'account')),
+    identity TEXT NOT NULL,
+    stamp TIMESTAMP DEFAULT NOW(),
+    UNIQUE(network, kind, identity)
+);
+
+-- the account lets lines be hidden for people who opt out by account
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS account TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+ALTER TABLE logs DROP COLUMN IF EXISTS account;
+DROP TABLE IF EXISTS optouts;
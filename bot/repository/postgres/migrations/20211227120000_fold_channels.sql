@@ -0,0 +1,15 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Channel names are now folded to lower case before they are stored, merge
+-- the rows that only differed by case. The bot folds []\~ as well on
+-- rfc1459 networks, those rare names are left for it to re-add.
+DELETE FROM channels a USING channels b
+    WHERE a.network = b.network
+    AND lower(a.name) = lower(b.name)
+    AND a.name > b.name;
+UPDATE channels SET name = lower(name);
+UPDATE logs SET channel = lower(channel) WHERE channel <> lower(channel);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+-- The original case of the names is not kept, so there is nothing to undo
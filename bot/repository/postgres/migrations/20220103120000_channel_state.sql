@@ -0,0 +1,20 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- What the bot knows about each channel it is in right now, for the
+-- webserver to show. Members are nicks with their highest prefix, eg @op,
+-- separated by spaces.
+CREATE TABLE IF NOT EXISTS channel_state (
+    network TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    topic TEXT NOT NULL DEFAULT '',
+    topic_setter TEXT NOT NULL DEFAULT '',
+    topic_stamp TIMESTAMP,
+    modes TEXT NOT NULL DEFAULT '',
+    members TEXT NOT NULL DEFAULT '',
+    stamp TIMESTAMP DEFAULT NOW(),
+    UNIQUE(network, channel)
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP TABLE IF EXISTS channel_state;
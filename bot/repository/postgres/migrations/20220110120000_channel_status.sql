@@ -0,0 +1,13 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Whether the bot is in each channel, one of joining, joined, kicked, banned,
+-- failed or forwarded, and the reason the server gave when it is not.
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT '';
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS status_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS status_stamp TIMESTAMP;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+ALTER TABLE channels DROP COLUMN IF EXISTS status_stamp;
+ALTER TABLE channels DROP COLUMN IF EXISTS status_reason;
+ALTER TABLE channels DROP COLUMN IF EXISTS status;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Marks the lines that were not valid UTF-8 when they were received, and so
+-- were decoded with the charset configured for the network or channel.
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS transcoded BOOLEAN NOT NULL DEFAULT false;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+ALTER TABLE logs DROP COLUMN IF EXISTS transcoded;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Messages and notices sent to the bot rather than to a channel, kept for the
+-- owner until they acknowledge them. kind is message or notice.
+CREATE TABLE IF NOT EXISTS private (
+    id BIGSERIAL PRIMARY KEY,
+    network TEXT NOT NULL,
+    nick TEXT NOT NULL,
+    account TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL CHECK (kind IN ('message', 'notice')),
+    said TEXT NOT NULL DEFAULT '',
+    transcoded BOOLEAN NOT NULL DEFAULT false,
+    stamp TIMESTAMP DEFAULT NOW(),
+    acknowledged TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS private_unacknowledged ON private (network, id) WHERE acknowledged IS NULL;
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP TABLE IF EXISTS private;
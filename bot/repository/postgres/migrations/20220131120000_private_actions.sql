@@ -0,0 +1,11 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- CTCP ACTIONs (/me) sent to the bot are kept too.
+ALTER TABLE private DROP CONSTRAINT IF EXISTS private_kind_check;
+ALTER TABLE private ADD CONSTRAINT private_kind_check CHECK (kind IN ('message', 'notice', 'action'));
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DELETE FROM private WHERE kind = 'action';
+ALTER TABLE private DROP CONSTRAINT IF EXISTS private_kind_check;
+ALTER TABLE private ADD CONSTRAINT private_kind_check CHECK (kind IN ('message', 'notice'));
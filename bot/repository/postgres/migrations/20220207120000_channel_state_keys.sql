@@ -0,0 +1,9 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Channel keys are no longer stored with the modes, drop the parameters of
+-- what was stored before, they are filled in again as the modes change.
+UPDATE channel_state SET modes = split_part(modes, ' ', 1);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+-- The keys that were removed are not restored.
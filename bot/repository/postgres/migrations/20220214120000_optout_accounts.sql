@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- Services match accounts ignoring case, so accounts are stored lower cased,
+-- keeping one of any that only differed in case.
+DELETE FROM optouts a USING optouts b
+    WHERE a.kind = 'account' AND b.kind = 'account' AND a.network = b.network
+    AND lower(a.identity) = lower(b.identity) AND a.identity > b.identity;
+UPDATE optouts SET identity = lower(identity) WHERE kind = 'account';
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+-- The case the accounts were stored in is not restored.
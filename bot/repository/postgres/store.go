@@ -5,10 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	//"github.com/jackc/pgx/v4/pgxpool"
-	_ "github.com/lib/pq" //nolint:revive
+	"github.com/lib/pq"
 )
 
 type pgCustomerRepo struct {
@@ -32,18 +33,19 @@ func NewPgCustomerRepo(connString string) (*pgCustomerRepo, error) {
 
 }
 
-// AddChannel -
-func (p *pgCustomerRepo) AddChannel(ctx context.Context, channel string) error {
-	_, err := p.dbHandler.Query(`INSERT INTO channels(name) VALUES($1)`, channel)
+// AddChannel - the channel is expected to be folded already, adding a channel
+// that is already stored is not an error
+func (p *pgCustomerRepo) AddChannel(ctx context.Context, network, channel string) error {
+	_, err := p.dbHandler.Exec(`INSERT INTO channels(network, name) VALUES($1, $2) ON CONFLICT DO NOTHING`, network, channel)
 	if err != nil {
-		return fmt.Errorf("adding channel %q produced %w", channel, err)
+		return fmt.Errorf("adding channel %q on %q produced %w", channel, network, err)
 	}
 	return err
 }
 
-// GetChannels -
-func (p *pgCustomerRepo) GetChannels(ctx context.Context) ([]string, error) {
-	rows, err := p.dbHandler.Query(`SELECT name from channels`)
+// GetChannels - the channels the bot should be in on the network
+func (p *pgCustomerRepo) GetChannels(ctx context.Context, network string) ([]string, error) {
+	rows, err := p.dbHandler.Query(`SELECT name from channels WHERE network=$1`, network)
 	if err != nil {
 		return nil, fmt.Errorf(`unable to fetch channels with error %w`, err)
 	}
@@ -62,19 +64,180 @@ func (p *pgCustomerRepo) GetChannels(ctx context.Context) ([]string, error) {
 	return channels, nil
 }
 
-// AddLog -
-func (p *pgCustomerRepo) AddLog(ctx context.Context, channel, nick, said string) error {
-	rows, err := p.dbHandler.Query(`INSERT INTO logs(channel, nick,  said) VALUES($1, $2, $3)`, channel, nick, said)
+// AddLog - event is the type of line, eg message, join or kick, account is
+// the services account of the nick, if known, and transcoded marks lines that
+// were not UTF-8 when they were received
+func (p *pgCustomerRepo) AddLog(ctx context.Context, network, channel, nick, account, event, said string, transcoded bool) error {
+	rows, err := p.dbHandler.Query(`INSERT INTO logs(network, channel, nick, account, event, said, transcoded) VALUES($1, $2, $3, $4, $5, $6, $7)`, network, channel, nick, account, event, said, transcoded)
 	if err != nil {
-		return fmt.Errorf("adding log %q %q %q produced %w", channel, nick, said, err)
+		return fmt.Errorf("adding log %q %q %q %q %q %q produced %w", network, channel, nick, account, event, said, err)
 	}
 	defer rows.Close()
 	return err
 }
 
+// AddOptOut - kind is nick or account
+func (p *pgCustomerRepo) AddOptOut(ctx context.Context, network, kind, identity string) error {
+	_, err := p.dbHandler.Exec(`INSERT INTO optouts(network, kind, identity) VALUES($1, $2, $3) ON CONFLICT DO NOTHING`, network, kind, identity)
+	if err != nil {
+		return fmt.Errorf("adding optout %q %q on %q produced %w", kind, identity, network, err)
+	}
+	return nil
+}
+
+// RemoveOptOut -
+func (p *pgCustomerRepo) RemoveOptOut(ctx context.Context, network, kind, identity string) error {
+	_, err := p.dbHandler.Exec(`DELETE FROM optouts WHERE network=$1 AND kind=$2 AND identity=$3`, network, kind, identity)
+	if err != nil {
+		return fmt.Errorf("removing optout %q %q on %q produced %w", kind, identity, network, err)
+	}
+	return nil
+}
+
+// GetOptOuts - the identities on the network that are not to be logged, as
+// kind and identity pairs
+func (p *pgCustomerRepo) GetOptOuts(ctx context.Context, network string) ([][2]string, error) {
+	rows, err := p.dbHandler.Query(`SELECT kind, identity FROM optouts WHERE network=$1`, network)
+	if err != nil {
+		return nil, fmt.Errorf(`unable to fetch optouts with error %w`, err)
+	}
+	defer rows.Close()
+
+	optouts := [][2]string{}
+	var kind, identity sql.NullString
+	for rows.Next() {
+		if err := rows.Scan(&kind, &identity); err != nil {
+			log.Printf("Unable to scan optout with error %v", err)
+			continue
+		}
+		optouts = append(optouts, [2]string{kind.String, identity.String})
+	}
+	return optouts, nil
+}
+
+// SetChannelState - members are nicks with their highest prefix, eg @op, a
+// zero topicTime is stored as NULL
+func (p *pgCustomerRepo) SetChannelState(ctx context.Context, network, channel, topic, topicSetter string, topicTime time.Time, modes string, members []string) error {
+	stamp := sql.NullTime{Time: topicTime, Valid: !topicTime.IsZero()}
+	_, err := p.dbHandler.Exec(`INSERT INTO channel_state(network, channel, topic, topic_setter, topic_stamp, modes, members, stamp) VALUES($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (network, channel) DO UPDATE SET topic=$3, topic_setter=$4, topic_stamp=$5, modes=$6, members=$7, stamp=NOW()`,
+		network, channel, topic, topicSetter, stamp, modes, strings.Join(members, " "))
+	if err != nil {
+		return fmt.Errorf("setting state of %q on %q produced %w", channel, network, err)
+	}
+	return nil
+}
+
+// ClearChannelState - for a channel the bot is no longer in, an empty channel
+// clears every channel on the network
+func (p *pgCustomerRepo) ClearChannelState(ctx context.Context, network, channel string) error {
+	var err error
+	if channel == "" {
+		_, err = p.dbHandler.Exec(`DELETE FROM channel_state WHERE network=$1`, network)
+	} else {
+		_, err = p.dbHandler.Exec(`DELETE FROM channel_state WHERE network=$1 AND channel=$2`, network, channel)
+	}
+	if err != nil {
+		return fmt.Errorf("clearing state of %q on %q produced %w", channel, network, err)
+	}
+	return nil
+}
+
+// SetChannelStatus - status is one of the IRC channel statuses, eg joined or
+// banned. Only channels that are stored have a status.
+func (p *pgCustomerRepo) SetChannelStatus(ctx context.Context, network, channel, status, reason string) error {
+	_, err := p.dbHandler.Exec(`UPDATE channels SET status=$3, status_reason=$4, status_stamp=NOW() WHERE network=$1 AND name=$2`, network, channel, status, reason)
+	if err != nil {
+		return fmt.Errorf("setting status of %q on %q produced %w", channel, network, err)
+	}
+	return nil
+}
+
+// PrivateMessage is a message, action or notice sent to the bot, kept for the
+// owner
+type PrivateMessage struct {
+	ID      int64
+	Nick    string
+	Account string
+	// Kind is message, action or notice
+	Kind  string
+	Said  string
+	Stamp time.Time
+}
+
+// AddPrivate - kind is message, action or notice, transcoded marks text that was not
+// UTF-8 when it was received
+func (p *pgCustomerRepo) AddPrivate(ctx context.Context, network, nick, account, kind, said string, transcoded bool) error {
+	_, err := p.dbHandler.Exec(`INSERT INTO private(network, nick, account, kind, said, transcoded) VALUES($1, $2, $3, $4, $5, $6)`, network, nick, account, kind, said, transcoded)
+	if err != nil {
+		return fmt.Errorf("adding private %s from %q on %q produced %w", kind, nick, network, err)
+	}
+	return nil
+}
+
+// GetPrivate - the oldest private messages on the network that have not been
+// acknowledged, at most limit of them
+func (p *pgCustomerRepo) GetPrivate(ctx context.Context, network string, limit int) ([]PrivateMessage, error) {
+	rows, err := p.dbHandler.Query(`SELECT id, nick, account, kind, said, stamp FROM private WHERE network=$1 AND acknowledged IS NULL ORDER BY id ASC LIMIT $2`, network, limit)
+	if err != nil {
+		return nil, fmt.Errorf(`unable to fetch private messages with error %w`, err)
+	}
+	defer rows.Close()
+
+	msgs := []PrivateMessage{}
+	for rows.Next() {
+		var m PrivateMessage
+		var stamp sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Nick, &m.Account, &m.Kind, &m.Said, &stamp); err != nil {
+			log.Printf("Unable to scan private message with error %v", err)
+			continue
+		}
+		m.Stamp = stamp.Time
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// CountPrivate - how many private messages on the network have not been
+// acknowledged, and who sent them
+func (p *pgCustomerRepo) CountPrivate(ctx context.Context, network string) (int, []string, error) {
+	rows, err := p.dbHandler.Query(`SELECT nick, COUNT(*) FROM private WHERE network=$1 AND acknowledged IS NULL GROUP BY nick ORDER BY MIN(id)`, network)
+	if err != nil {
+		return 0, nil, fmt.Errorf(`unable to count private messages with error %w`, err)
+	}
+	defer rows.Close()
+
+	total := 0
+	nicks := []string{}
+	for rows.Next() {
+		var nick string
+		var count int
+		if err := rows.Scan(&nick, &count); err != nil {
+			log.Printf("Unable to scan private message count with error %v", err)
+			continue
+		}
+		total += count
+		nicks = append(nicks, nick)
+	}
+	return total, nicks, nil
+}
+
+// AckPrivate - acknowledges the private messages on the network with the ids,
+// returning how many were
+func (p *pgCustomerRepo) AckPrivate(ctx context.Context, network string, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := p.dbHandler.Exec(`UPDATE private SET acknowledged=NOW() WHERE network=$1 AND acknowledged IS NULL AND id = ANY($2)`, network, pq.Array(ids))
+	if err != nil {
+		return 0, fmt.Errorf("acknowledging private messages on %q produced %w", network, err)
+	}
+	return res.RowsAffected()
+}
+
 // GetChannelLogsByTime -
-func (p *pgCustomerRepo) GetChannelLogsByTime(ctx context.Context, channel string, start, finish time.Time) ([]map[string]string, error) {
-	rows, err := p.dbHandler.Query(`SELECT  nick, stamp, said FROM channels WHERE channel=$1 stamp BETWEEN $2 AND $3`, channel, start, finish)
+func (p *pgCustomerRepo) GetChannelLogsByTime(ctx context.Context, network, channel string, start, finish time.Time) ([]map[string]string, error) {
+	rows, err := p.dbHandler.Query(`SELECT  nick, stamp, said FROM logs WHERE network=$1 AND channel=$2 AND stamp BETWEEN $3 AND $4`, network, channel, start, finish)
 	if err != nil {
 		return nil, fmt.Errorf(`unable to fetch channels with error %w`, err)
 	}
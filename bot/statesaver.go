@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// stateSaveDelay is how long the changes to a channel are gathered before its
+// state is saved, so that a netsplit, or a burst of joins, is saved once
+// rather than once for each line
+const stateSaveDelay = 2 * time.Second
+
+// stateSaver saves the state of the channels that have changed, at most once
+// every stateSaveDelay, on its own goroutine, so that saving the members of a
+// large channel never holds up storing the logs
+type stateSaver struct {
+	m sync.Mutex
+	// dirty are the channels that have changed, by their folded name
+	dirty map[string]string
+	fold  func(string) string
+	// saving is held while the datastore is written, so that a clear is
+	// never overtaken by a save that started before it
+	saving sync.Mutex
+	save   func(channel string)
+	delay  time.Duration
+	wake   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newStateSaver(fold func(string) string, save func(channel string)) *stateSaver {
+	return &stateSaver{
+		dirty: map[string]string{},
+		fold:  fold,
+		save:  save,
+		delay: stateSaveDelay,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// mark notes that the channel has changed, its state is saved after the delay
+func (ss *stateSaver) mark(channel string) {
+	ss.m.Lock()
+	ss.dirty[ss.fold(channel)] = channel
+	ss.m.Unlock()
+	select {
+	case ss.wake <- struct{}{}:
+	default:
+	}
+}
+
+// clear forgets the changes still waiting and runs clearAll, for when the bot
+// has left every channel
+func (ss *stateSaver) clear(clearAll func()) {
+	ss.saving.Lock()
+	defer ss.saving.Unlock()
+	ss.m.Lock()
+	ss.dirty = map[string]string{}
+	ss.m.Unlock()
+	clearAll()
+}
+
+// run saves the channels that have changed until stop is called
+func (ss *stateSaver) run() {
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ss.wake:
+		}
+		// let the changes settle before saving them
+		select {
+		case <-ss.done:
+			return
+		case <-time.After(ss.delay):
+		}
+		ss.flush()
+	}
+}
+
+func (ss *stateSaver) flush() {
+	ss.saving.Lock()
+	defer ss.saving.Unlock()
+	ss.m.Lock()
+	channels := ss.dirty
+	ss.dirty = map[string]string{}
+	ss.m.Unlock()
+	for _, channel := range channels {
+		ss.save(channel)
+	}
+}
+
+// stop ends run, the changes still waiting are not saved
+func (ss *stateSaver) stop() {
+	ss.once.Do(func() {
+		close(ss.done)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/mindfarm/fluentdrama/bot/IRC"
+)
+
+// workerJobs is how many jobs can wait for the worker
+const workerJobs = 100
+
+// worker runs the datastore work of commands one job at a time, away from the
+// reader that runs the commands, so that a slow datastore never stops the bot
+// answering the server
+type worker struct {
+	jobs chan func()
+}
+
+func newWorker() *worker {
+	return &worker{jobs: make(chan func(), workerJobs)}
+}
+
+// run does the jobs until ctx is cancelled
+func (w *worker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-w.jobs:
+			job()
+		}
+	}
+}
+
+// do queues the job, without waiting for it, it fails when too many jobs are
+// already waiting
+func (w *worker) do(job func()) error {
+	select {
+	case w.jobs <- job:
+		return nil
+	default:
+		return fmt.Errorf("busy, please try again later")
+	}
+}
+
+// command runs a command on the worker rather than on the reader, its error is
+// replied the way the bot replies to any failed command
+func (w *worker) command(run func(req IRC.CommandRequest) error) func(req IRC.CommandRequest) error {
+	return func(req IRC.CommandRequest) error {
+		return w.do(func() {
+			if err := run(req); err != nil {
+				log.Printf("Command %s from %s failed %v", req.Name, req.Source, err)
+				if err := req.Reply("%s failed: %v", req.Name, err); err != nil {
+					log.Printf("Error replying to %s %v", req.Source, err)
+				}
+			}
+		})
+	}
+}
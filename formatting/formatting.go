@@ -0,0 +1,209 @@
+// Package formatting understands the mIRC style and colour codes that IRC
+// clients put in messages, so that logged lines can be shown as plain text or
+// as HTML.
+//
+//	\x02 bold, \x1d italics, \x1f underline, \x1e strikethrough, \x11
+//	monospace, \x16 reverse, \x0f reset, \x03 colour with up to two digits
+//	and an optional background, \x04 hex colour
+package formatting
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The codes that toggle or reset styles
+const (
+	Bold          = '\x02'
+	Colour        = '\x03'
+	HexColour     = '\x04'
+	Reset         = '\x0f'
+	Monospace     = '\x11'
+	Reverse       = '\x16'
+	Italic        = '\x1d'
+	Strikethrough = '\x1e'
+	Underline     = '\x1f'
+)
+
+// Style is how a span of text is shown. Colours are hex, eg #ff0000, and
+// empty for the default.
+type Style struct {
+	Bold          bool
+	Italic        bool
+	Underline     bool
+	Strikethrough bool
+	Monospace     bool
+	Reverse       bool
+	Foreground    string
+	Background    string
+}
+
+// Span is a run of text that shares a style
+type Span struct {
+	Style
+	Text string
+}
+
+// Parse splits text into spans at its formatting codes, the codes themselves
+// are dropped. Neighbouring runs with the same style are merged, and spans
+// without text are left out.
+func Parse(text string) []Span {
+	spans := []Span{}
+	var style Style
+	var b strings.Builder
+	flush := func() {
+		if b.Len() == 0 {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Style == style {
+			spans[n-1].Text += b.String()
+		} else {
+			spans = append(spans, Span{Style: style, Text: b.String()})
+		}
+		b.Reset()
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case Bold, Italic, Underline, Strikethrough, Monospace, Reverse, Reset:
+			flush()
+			style = toggle(style, c)
+		case Colour:
+			flush()
+			fg, bg, n := colourCode(text[i+1:], 2, isDigit)
+			i += n
+			style = setColours(style, fg, bg, paletteColour)
+		case HexColour:
+			flush()
+			fg, bg, n := colourCode(text[i+1:], 6, isHex)
+			i += n
+			style = setColours(style, fg, bg, func(hex string) string {
+				return "#" + strings.ToLower(hex)
+			})
+		default:
+			b.WriteByte(c)
+		}
+	}
+	flush()
+	return spans
+}
+
+// CodeLen returns the length of the formatting code at the start of text,
+// including any colours that follow it, or 0 if text does not start with one
+func CodeLen(text string) int {
+	if text == "" {
+		return 0
+	}
+	switch text[0] {
+	case Bold, Italic, Underline, Strikethrough, Monospace, Reverse, Reset:
+		return 1
+	case Colour:
+		_, _, n := colourCode(text[1:], 2, isDigit)
+		return 1 + n
+	case HexColour:
+		_, _, n := colourCode(text[1:], 6, isHex)
+		return 1 + n
+	}
+	return 0
+}
+
+// Strip returns text without its formatting codes
+func Strip(text string) string {
+	var b strings.Builder
+	for _, span := range Parse(text) {
+		b.WriteString(span.Text)
+	}
+	return b.String()
+}
+
+func toggle(style Style, code byte) Style {
+	switch code {
+	case Bold:
+		style.Bold = !style.Bold
+	case Italic:
+		style.Italic = !style.Italic
+	case Underline:
+		style.Underline = !style.Underline
+	case Strikethrough:
+		style.Strikethrough = !style.Strikethrough
+	case Monospace:
+		style.Monospace = !style.Monospace
+	case Reverse:
+		style.Reverse = !style.Reverse
+	case Reset:
+		style = Style{}
+	}
+	return style
+}
+
+// setColours applies a colour code, a code without a foreground resets both
+// colours, and one without a background leaves the background alone
+func setColours(style Style, fg, bg string, colour func(string) string) Style {
+	if fg == "" {
+		style.Foreground, style.Background = "", ""
+		return style
+	}
+	style.Foreground = colour(fg)
+	if bg != "" {
+		style.Background = colour(bg)
+	}
+	return style
+}
+
+// colourCode reads the foreground and optional background that follow a
+// colour code, a foreground has one to width characters and a hex one
+// exactly width. n is how much of text they took.
+func colourCode(text string, width int, valid func(byte) bool) (fg, bg string, n int) {
+	count := func(s string) int {
+		n := 0
+		for n < width && n < len(s) && valid(s[n]) {
+			n++
+		}
+		// hex colours are always written in full
+		if width == 6 && n < width {
+			return 0
+		}
+		return n
+	}
+	n = count(text)
+	if n == 0 {
+		return "", "", 0
+	}
+	fg = text[:n]
+	if n < len(text) && text[n] == ',' {
+		if m := count(text[n+1:]); m > 0 {
+			bg = text[n+1 : n+1+m]
+			n += 1 + m
+		}
+	}
+	return fg, bg, n
+}
+
+// paletteColour returns the hex colour for a mIRC colour number, 99 and any
+// number off the palette are the default colour
+func paletteColour(code string) string {
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 0 || n >= len(palette) {
+		return ""
+	}
+	return palette[n]
+}
+
+// palette holds the 16 standard mIRC colours followed by the 83 extended ones
+var palette = [...]string{
+	"#ffffff", "#000000", "#00007f", "#009300", "#ff0000", "#7f0000", "#9c009c", "#fc7f00",
+	"#ffff00", "#00fc00", "#009393", "#00ffff", "#0000fc", "#ff00ff", "#7f7f7f", "#d2d2d2",
+	"#470000", "#472100", "#474700", "#324700", "#004700", "#00472c", "#004747", "#002747", "#000047", "#2e0047", "#470047", "#47002a",
+	"#740000", "#743a00", "#747400", "#517400", "#007400", "#007449", "#007474", "#004074", "#000074", "#4b0074", "#740074", "#740045",
+	"#b50000", "#b56300", "#b5b500", "#7db500", "#00b500", "#00b571", "#00b5b5", "#0063b5", "#0000b5", "#7500b5", "#b500b5", "#b5006b",
+	"#ff0000", "#ff8c00", "#ffff00", "#b2ff00", "#00ff00", "#00ffa0", "#00ffff", "#008cff", "#0000ff", "#a500ff", "#ff00ff", "#ff0098",
+	"#ff5959", "#ffb459", "#ffff71", "#cfff60", "#6fff6f", "#65ffc9", "#6dffff", "#59b4ff", "#5959ff", "#c459ff", "#ff66ff", "#ff59bc",
+	"#ff9c9c", "#ffd39c", "#ffff9c", "#e2ff9c", "#9cff9c", "#9cffdb", "#9cffff", "#9cd3ff", "#9c9cff", "#dc9cff", "#ff9cff", "#ff94d3",
+	"#000000", "#131313", "#282828", "#363636", "#4d4d4d", "#656565", "#818181", "#9f9f9f", "#bcbcbc", "#e2e2e2", "#ffffff",
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
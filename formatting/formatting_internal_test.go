@@ -0,0 +1,186 @@
+package formatting
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	testcases := map[string]struct {
+		input    string
+		expected []Span
+	}{
+		"plain text": {
+			input:    "hello",
+			expected: []Span{{Text: "hello"}},
+		},
+		"empty": {
+			input:    "",
+			expected: []Span{},
+		},
+		"bold toggles": {
+			input: "a \x02bold\x02 b",
+			expected: []Span{
+				{Text: "a "},
+				{Style: Style{Bold: true}, Text: "bold"},
+				{Text: " b"},
+			},
+		},
+		"styles combine and reset": {
+			input: "\x1d\x1fboth\x0f plain",
+			expected: []Span{
+				{Style: Style{Italic: true, Underline: true}, Text: "both"},
+				{Text: " plain"},
+			},
+		},
+		"colour with a background": {
+			input: "\x0304,12red on blue",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff0000", Background: "#0000fc"}, Text: "red on blue"},
+			},
+		},
+		"one digit colour": {
+			input: "\x034red",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff0000"}, Text: "red"},
+			},
+		},
+		"digits after two are text": {
+			input: "\x03041",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff0000"}, Text: "1"},
+			},
+		},
+		"a comma without a background is text": {
+			input: "\x0304,x",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff0000"}, Text: ",x"},
+			},
+		},
+		"a foreground keeps the background": {
+			input: "\x0304,12a\x0309b",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff0000", Background: "#0000fc"}, Text: "a"},
+				{Style: Style{Foreground: "#00fc00", Background: "#0000fc"}, Text: "b"},
+			},
+		},
+		"a bare colour code resets the colours": {
+			input: "\x02\x0304,12a\x03b",
+			expected: []Span{
+				{Style: Style{Bold: true, Foreground: "#ff0000", Background: "#0000fc"}, Text: "a"},
+				{Style: Style{Bold: true}, Text: "b"},
+			},
+		},
+		"99 is the default colour": {
+			input: "\x0399,04a",
+			expected: []Span{
+				{Style: Style{Background: "#ff0000"}, Text: "a"},
+			},
+		},
+		"extended colours": {
+			input: "\x0352a\x0398b",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff0000"}, Text: "a"},
+				{Style: Style{Foreground: "#ffffff"}, Text: "b"},
+			},
+		},
+		"hex colour": {
+			input: "\x04FF8800,000000a",
+			expected: []Span{
+				{Style: Style{Foreground: "#ff8800", Background: "#000000"}, Text: "a"},
+			},
+		},
+		"short hex is text": {
+			input: "\x04abcx",
+			expected: []Span{
+				{Text: "abcx"},
+			},
+		},
+		"codes without text leave no span": {
+			input:    "\x02\x02\x0304",
+			expected: []Span{},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Parse(tc.input))
+		})
+	}
+}
+
+func TestStrip(t *testing.T) {
+	testcases := map[string]struct {
+		input    string
+		expected string
+	}{
+		"plain":   {input: "hello there", expected: "hello there"},
+		"styles":  {input: "\x02bold\x02 \x1ditalic\x0f", expected: "bold italic"},
+		"colours": {input: "\x0304,12red\x03 \x04ff0000hex\x04", expected: "red hex"},
+		"digits":  {input: "\x0312345", expected: "345"},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Strip(tc.input))
+		})
+	}
+}
+
+func TestCodeLen(t *testing.T) {
+	testcases := map[string]struct {
+		input    string
+		expected int
+	}{
+		"no code":                 {input: "hello", expected: 0},
+		"empty":                   {input: "", expected: 0},
+		"style":                   {input: "\x02bold", expected: 1},
+		"bare colour":             {input: "\x03text", expected: 1},
+		"colour":                  {input: "\x034red", expected: 2},
+		"colour with background":  {input: "\x0304,12a", expected: 6},
+		"digits after two":        {input: "\x03041", expected: 3},
+		"hex colour":              {input: "\x04FF8800,000000a", expected: 14},
+		"short hex is not colour": {input: "\x04abcx", expected: 1},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, CodeLen(tc.input))
+		})
+	}
+}
+
+func TestHTML(t *testing.T) {
+	testcases := map[string]struct {
+		input    string
+		expected string
+	}{
+		"plain text is escaped": {
+			input:    `<script>alert("x")</script> & more`,
+			expected: `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; more`,
+		},
+		"bold": {
+			input:    "a \x02b\x02",
+			expected: `a <span style="font-weight:bold">b</span>`,
+		},
+		"decorations": {
+			input:    "\x1f\x1e\x11a",
+			expected: `<span style="text-decoration:underline line-through;font-family:monospace">a</span>`,
+		},
+		"colours": {
+			input:    "\x0304,12a",
+			expected: `<span style="color:#ff0000;background-color:#0000fc">a</span>`,
+		},
+		"reverse swaps the colours": {
+			input:    "\x0304\x16a",
+			expected: `<span style="color:#ffffff;background-color:#ff0000">a</span>`,
+		},
+		"styled text is escaped": {
+			input:    "\x1d<b>",
+			expected: `<span style="font-style:italic">&lt;b&gt;</span>`,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, HTML(tc.input))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package formatting
+
+import (
+	"html"
+	"strings"
+)
+
+// The colours reversed text swaps when it has none of its own
+const (
+	defaultForeground = "#000000"
+	defaultBackground = "#ffffff"
+)
+
+// HTML renders text as HTML that is safe to insert into a page. The text is
+// escaped, and styled spans are wrapped in span elements whose inline style is
+// built only from the parsed style, never from the text.
+func HTML(text string) string {
+	var b strings.Builder
+	for _, span := range Parse(text) {
+		escaped := html.EscapeString(span.Text)
+		css := span.css()
+		if css == "" {
+			b.WriteString(escaped)
+			continue
+		}
+		b.WriteString(`<span style="`)
+		b.WriteString(css)
+		b.WriteString(`">`)
+		b.WriteString(escaped)
+		b.WriteString(`</span>`)
+	}
+	return b.String()
+}
+
+// css returns the inline style for the span, empty when it is unstyled
+func (s Style) css() string {
+	rules := []string{}
+	if s.Bold {
+		rules = append(rules, "font-weight:bold")
+	}
+	if s.Italic {
+		rules = append(rules, "font-style:italic")
+	}
+	decorations := []string{}
+	if s.Underline {
+		decorations = append(decorations, "underline")
+	}
+	if s.Strikethrough {
+		decorations = append(decorations, "line-through")
+	}
+	if len(decorations) > 0 {
+		rules = append(rules, "text-decoration:"+strings.Join(decorations, " "))
+	}
+	if s.Monospace {
+		rules = append(rules, "font-family:monospace")
+	}
+	fg, bg := s.Foreground, s.Background
+	if s.Reverse {
+		if fg == "" {
+			fg = defaultForeground
+		}
+		if bg == "" {
+			bg = defaultBackground
+		}
+		fg, bg = bg, fg
+	}
+	if fg != "" {
+		rules = append(rules, "color:"+fg)
+	}
+	if bg != "" {
+		rules = append(rules, "background-color:"+bg)
+	}
+	return strings.Join(rules, ";")
+}
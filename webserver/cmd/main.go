@@ -45,7 +45,9 @@ func main() {
 
 	c := handlers.NewHandlerData(ds)
 	mux.Handle("/logs/", http.StripPrefix("/logs/", AllowCors(http.HandlerFunc(c.Logs))))
-	mux.Handle("/channels", AllowCors(http.HandlerFunc(c.GetChannels)))
+	mux.Handle("/networks", AllowCors(http.HandlerFunc(c.GetNetworks)))
+	mux.Handle("/channels/", http.StripPrefix("/channels/", AllowCors(http.HandlerFunc(c.GetChannels))))
+	mux.Handle("/state/", http.StripPrefix("/state/", AllowCors(http.HandlerFunc(c.GetChannelState))))
 
 	// listen on all localhost
 	ip := "127.0.0.1"
@@ -1,6 +1,10 @@
 package main
 
 /*
+/networks
+/channels/:network
+/state/:network/#channel
+/logs/:network/#channel/:date/:nick
 /_config
 /_channels
 /_channels_body
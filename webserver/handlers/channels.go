@@ -24,7 +24,36 @@ func NewHandlerData(ds *data.PGCustomerRepo) *handlerData {
 	return &handlerData{ds: ds}
 }
 
-// GetChannels -
+// GetNetworks -
+func (hd *handlerData) GetNetworks(w http.ResponseWriter, r *http.Request) {
+	// return the list of networks that we have channels on
+	// only GET allowed
+	if r.Method != http.MethodGet {
+		http.Error(w, "Bad request - Go away!", http.StatusMethodNotAllowed)
+		return
+	}
+	// Get networks from Datastore
+	networks, err := hd.ds.GetNetworks(context.Background())
+	if err != nil {
+		log.Printf("ERROR getting networks in GetNetworks handler %v", err)
+		return
+	}
+
+	resp, err := json.Marshal(struct {
+		N []string `json:"networks"`
+	}{networks})
+	if err != nil {
+		log.Printf("ERROR marshalling networks in GetNetworks handler %v", err)
+		return
+	}
+	_, err = w.Write(resp)
+	if err != nil {
+		log.Printf("ERROR writing networks in GetNetworks handler %v", err)
+		return
+	}
+}
+
+// GetChannels - the network is the path, eg /channels/libera
 func (hd *handlerData) GetChannels(w http.ResponseWriter, r *http.Request) {
 	// return the list of channels that we have logs on
 	// only GET allowed
@@ -32,8 +61,13 @@ func (hd *handlerData) GetChannels(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request - Go away!", http.StatusMethodNotAllowed)
 		return
 	}
+	network := strings.Trim(r.URL.Path, "/")
+	if network == "" || len(network) > maxQueryLength {
+		http.Error(w, "Bad network supplied", http.StatusBadRequest)
+		return
+	}
 	// Get channels from Datastore
-	channels, err := hd.ds.GetChannels(context.Background())
+	channels, err := hd.ds.GetChannels(context.Background(), network)
 	if err != nil {
 		log.Printf("ERROR getting channels in GetChannels handler %v", err)
 		return
@@ -53,6 +87,45 @@ func (hd *handlerData) GetChannels(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetChannelState - the path is network/#channel, eg /state/libera/#go-nuts
+func (hd *handlerData) GetChannelState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Bad request - Go away!", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(r.URL.Path) > maxQueryLength {
+		http.Error(w, "Bad network or channel supplied", http.StatusBadRequest)
+		return
+	}
+	chunks := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+	if len(chunks) != 2 || chunks[0] == "" || !strings.HasPrefix(chunks[1], "#") {
+		http.Error(w, "Bad network or channel supplied", http.StatusBadRequest)
+		return
+	}
+	state, err := hd.ds.GetChannelState(context.Background(), chunks[0], strings.ToLower(chunks[1]))
+	if err != nil {
+		log.Printf("ERROR getting channel state in GetChannelState handler %v", err)
+		return
+	}
+	if state == nil {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+
+	resp, err := json.Marshal(struct {
+		S map[string]interface{} `json:"state"`
+	}{state})
+	if err != nil {
+		log.Printf("ERROR marshalling channel state in GetChannelState handler %v", err)
+		return
+	}
+	_, err = w.Write(resp)
+	if err != nil {
+		log.Printf("ERROR writing channel state in GetChannelState handler %v", err)
+		return
+	}
+}
+
 // No query with a total length > maxQueryLength should be allowed
 const maxQueryLength = 256
 
@@ -63,14 +136,16 @@ func (hd *handlerData) Logs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Is this a channel request
-	if len(path) > 1 && (path[0] == '#' || (path[0] == '/' && path[1] == '#')) {
+	// Is this a channel request, network/#channel
+	if strings.Contains(string(path), "/#") {
 		// split on '/'
 		chunks := []string{}
 		holder := []rune{}
 		for i := 0; i < len(path); i++ {
 			if path[i] == '/' {
-				chunks = append(chunks, string(holder))
+				if i > 0 {
+					chunks = append(chunks, string(holder))
+				}
 				holder = []rune{}
 				continue
 			}
@@ -79,13 +154,22 @@ func (hd *handlerData) Logs(w http.ResponseWriter, r *http.Request) {
 		if len(holder) > 0 {
 			chunks = append(chunks, string(holder))
 		}
+		if len(chunks) < 2 || chunks[0] == "" || !strings.HasPrefix(chunks[1], "#") {
+			http.Error(w, "Bad network or channel supplied", http.StatusBadRequest)
+			return
+		}
+		network := chunks[0]
+		chunks = chunks[1:]
 		// channel, date, nick, time will be after a ?
 		if len(chunks) == 1 {
 			log.Print("No Date found")
 			// default to today
 			chunks = append(chunks, strings.Split(time.Now().UTC().String(), " ")[0])
 		}
-		channel := chunks[0]
+		// the bot stores channel names folded by the network's
+		// CASEMAPPING, the datastore matches both folds of the lower case
+		// name, so links with any case find the same logs
+		channel := strings.ToLower(chunks[0])
 		// YYYY-MM-DD
 		date, err := time.Parse("2006-01-02", chunks[1])
 		if err != nil {
@@ -97,7 +181,18 @@ func (hd *handlerData) Logs(w http.ResponseWriter, r *http.Request) {
 		if len(chunks) > 2 {
 			nick = chunks[2]
 		}
-		logs, err := hd.ds.GetChannelLogs(context.Background(), channel, nick, date)
+		// format=html adds a sanitized HTML rendering of the formatting
+		// to the plain text of each line
+		var withHTML bool
+		switch r.URL.Query().Get("format") {
+		case "", "text":
+		case "html":
+			withHTML = true
+		default:
+			http.Error(w, "Bad format supplied, use text or html", http.StatusBadRequest)
+			return
+		}
+		logs, err := hd.ds.GetChannelLogs(context.Background(), network, channel, nick, date, withHTML)
 		if err != nil {
 			log.Printf("ERROR getting channel logs: %v", err)
 			http.Error(w, "Bad channel or nick supplied", http.StatusBadRequest)
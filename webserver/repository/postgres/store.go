@@ -8,9 +8,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq" //nolint:revive
+	"github.com/mindfarm/fluentdrama/formatting"
 )
 
 // PGCustomerRepo -
@@ -32,9 +34,30 @@ func NewPGCustomerRepo(connString string) (*PGCustomerRepo, error) {
 	}, nil
 }
 
-// GetChannels -
-func (p *PGCustomerRepo) GetChannels(ctx context.Context) ([]string, error) {
-	rows, err := p.DbHandler.Query(`SELECT name FROM channels ORDER BY name ASC`)
+// GetNetworks - the networks that have channels
+func (p *PGCustomerRepo) GetNetworks(ctx context.Context) ([]string, error) {
+	rows, err := p.DbHandler.Query(`SELECT DISTINCT network FROM channels ORDER BY network ASC`)
+	if err != nil {
+		return nil, fmt.Errorf(`unable to fetch networks with error %w`, err)
+	}
+	defer rows.Close()
+
+	networks := []string{}
+	var network sql.NullString
+	for rows.Next() {
+		err := rows.Scan(&network)
+		if err != nil {
+			log.Printf("Unable to scan network with error %v", err)
+			continue
+		}
+		networks = append(networks, network.String)
+	}
+	return networks, nil
+}
+
+// GetChannels - the channels on the network
+func (p *PGCustomerRepo) GetChannels(ctx context.Context, network string) ([]string, error) {
+	rows, err := p.DbHandler.Query(`SELECT name FROM channels WHERE network=$1 ORDER BY name ASC`, network)
 	if err != nil {
 		return nil, fmt.Errorf(`unable to fetch channels with error %w`, err)
 	}
@@ -53,10 +76,76 @@ func (p *PGCustomerRepo) GetChannels(ctx context.Context) ([]string, error) {
 	return channels, nil
 }
 
-// GetChannelLogs -
-func (p *PGCustomerRepo) GetChannelLogs(ctx context.Context, channel, nick string, date time.Time) ([]map[string]string, error) {
-	// channel is mandatory
+// GetChannelState - who is in the channel right now, with its topic and modes,
+// as last stored by the bot, and whether the bot is in it. Nothing is returned
+// for a channel the bot knows nothing about.
+func (p *PGCustomerRepo) GetChannelState(ctx context.Context, network, channel string) (map[string]interface{}, error) {
+	state := map[string]interface{}{}
+	row := p.DbHandler.QueryRow(`SELECT status, status_reason, status_stamp FROM channels WHERE network=$1 AND name `+sameChannel, network, channel)
+	var status, reason sql.NullString
+	var statusStamp sql.NullTime
+	switch err := row.Scan(&status, &reason, &statusStamp); err {
+	case nil:
+		state["Status"] = status.String
+		state["StatusReason"] = reason.String
+		if statusStamp.Valid {
+			state["StatusTime"] = statusStamp.Time.String()
+		}
+	case sql.ErrNoRows:
+	default:
+		return nil, fmt.Errorf(`unable to fetch channel status with error %w`, err)
+	}
+
+	row = p.DbHandler.QueryRow(`SELECT topic, topic_setter, topic_stamp, modes, members, stamp FROM channel_state WHERE network=$1 AND channel `+sameChannel, network, channel)
+	var topic, setter, modes, members sql.NullString
+	var topicStamp, stamp sql.NullTime
+	if err := row.Scan(&topic, &setter, &topicStamp, &modes, &members, &stamp); err != nil {
+		if err == sql.ErrNoRows {
+			if len(state) == 0 {
+				return nil, nil
+			}
+			return state, nil
+		}
+		return nil, fmt.Errorf(`unable to fetch channel state with error %w`, err)
+	}
+	state["Topic"] = topic.String
+	state["TopicSetter"] = setter.String
+	state["Modes"] = modes.String
+	state["Members"] = strings.Fields(members.String)
+	state["Updated"] = stamp.Time.String()
+	if topicStamp.Valid {
+		state["TopicTime"] = topicStamp.Time.String()
+	}
+	return state, nil
+}
+
+// sameChannel matches a channel name against the second parameter, which is
+// always the channel. The bot stores channel names folded by the network's
+// CASEMAPPING and the handlers lower case them, so they are compared both as
+// given, as ascii folds them, and with []\~ folded to {}|^, as rfc1459 does.
+const sameChannel = `IN ($2, translate($2, '[]\~', '{}|^'))`
+
+// notOptedOut filters out the log lines of people who have asked not to be
+// logged, by nick or by services account, and the NICK and KICK lines that
+// name them, by the new nick or the kicked nick at the start of said. The bot
+// stores nicks folded by the network's CASEMAPPING, so they are compared both
+// lower cased, as ascii folds them, and with []\~ folded to {}|^, as rfc1459
+// does. Accounts are stored lower cased, services match them ignoring case.
+const notOptedOut = `NOT EXISTS (SELECT 1 FROM optouts o WHERE o.network=logs.network AND
+	((o.kind='nick' AND o.identity IN (lower(logs.nick), translate(lower(logs.nick), '[]\~', '{}|^')))
+	OR (o.kind='nick' AND logs.event='nick' AND o.identity IN (lower(logs.said), translate(lower(logs.said), '[]\~', '{}|^')))
+	OR (o.kind='nick' AND logs.event='kick' AND o.identity IN (lower(split_part(logs.said, ' ', 1)), translate(lower(split_part(logs.said, ' ', 1)), '[]\~', '{}|^')))
+	OR (o.kind='account' AND logs.account<>'' AND o.identity=lower(logs.account))))`
+
+// GetChannelLogs - Said and Label are plain text, with the formatting codes
+// removed, withHTML adds SaidHTML and LabelHTML, which keep the formatting as
+// sanitized HTML
+func (p *PGCustomerRepo) GetChannelLogs(ctx context.Context, network, channel, nick string, date time.Time, withHTML bool) ([]map[string]string, error) {
+	// network and channel are mandatory
 	// nick is optional
+	if network == "" {
+		return nil, fmt.Errorf("network is mandatory")
+	}
 	if channel == "" {
 		return nil, fmt.Errorf("channel is mandatory")
 	}
@@ -66,12 +155,12 @@ func (p *PGCustomerRepo) GetChannelLogs(ctx context.Context, channel, nick strin
 	// be from a cache
 	// TODO cache the start for each channel for faster lookup
 	// get the time of the latest entry in the logs for this channel
-	l, err := p.getBoundary(nick, channel, "last")
+	l, err := p.getBoundary(network, nick, channel, "last")
 	if err != nil {
 		return nil, err
 	}
 	// get the time of the earliest entry in the logs for this channel
-	f, err := p.getBoundary(nick, channel, "first")
+	f, err := p.getBoundary(network, nick, channel, "first")
 	if err != nil {
 		return nil, err
 	}
@@ -88,10 +177,10 @@ func (p *PGCustomerRepo) GetChannelLogs(ctx context.Context, channel, nick strin
 
 	var rows *sql.Rows
 	if nick == "" {
-		rows, err = p.DbHandler.Query(`SELECT  nick, stamp, said FROM logs WHERE channel=$1 AND stamp BETWEEN $2 AND $3 ORDER BY stamp ASC`, channel, start, finish)
+		rows, err = p.DbHandler.Query(`SELECT  nick, stamp, said, event FROM logs WHERE network=$1 AND channel `+sameChannel+` AND stamp BETWEEN $3 AND $4 AND `+notOptedOut+` ORDER BY stamp ASC`, network, channel, start, finish)
 	} else {
 		// only get the logs for the specified nick
-		rows, err = p.DbHandler.Query(`SELECT  nick, stamp, said FROM logs WHERE channel=$1 AND nick=$2 AND stamp BETWEEN $3 AND $4 ORDER BY stamp ASC`, channel, nick, start, finish)
+		rows, err = p.DbHandler.Query(`SELECT  nick, stamp, said, event FROM logs WHERE network=$1 AND channel `+sameChannel+` AND nick=$3 AND stamp BETWEEN $4 AND $5 AND `+notOptedOut+` ORDER BY stamp ASC`, network, channel, nick, start, finish)
 	}
 	defer rows.Close()
 	if err != nil {
@@ -102,18 +191,68 @@ func (p *PGCustomerRepo) GetChannelLogs(ctx context.Context, channel, nick strin
 	var rnick sql.NullString
 	var rsaid sql.NullString
 	var rstamp sql.NullTime
+	var revent sql.NullString
 	for rows.Next() {
-		err := rows.Scan(&rnick, &rstamp, &rsaid)
+		err := rows.Scan(&rnick, &rstamp, &rsaid, &revent)
 		if err != nil {
 			log.Printf("Unable to scan channel with error %v", err)
 			continue
 		}
-		logs = append(logs, map[string]string{"Time": rstamp.Time.String(), "Nick": rnick.String, "Said": rsaid.String})
+		l := label(revent.String, rnick.String, rsaid.String)
+		line := map[string]string{
+			"Time":  rstamp.Time.String(),
+			"Nick":  rnick.String,
+			"Said":  formatting.Strip(rsaid.String),
+			"Event": revent.String,
+			"Label": formatting.Strip(l),
+		}
+		if withHTML {
+			line["SaidHTML"] = formatting.HTML(rsaid.String)
+			line["LabelHTML"] = formatting.HTML(l)
+		}
+		logs = append(logs, line)
 	}
 	return logs, nil
 }
 
-func (p *PGCustomerRepo) getBoundary(nick, channel, order string) (time.Time, error) {
+// label describes a log line the way an IRC client would show it
+func label(event, nick, said string) string {
+	withReason := func(s string) string {
+		if said == "" {
+			return s
+		}
+		return fmt.Sprintf("%s (%s)", s, said)
+	}
+	switch event {
+	case "action":
+		return fmt.Sprintf("* %s %s", nick, said)
+	case "notice":
+		return fmt.Sprintf("-%s- %s", nick, said)
+	case "join":
+		return fmt.Sprintf("%s has joined", nick)
+	case "part":
+		return withReason(fmt.Sprintf("%s has left", nick))
+	case "quit":
+		return withReason(fmt.Sprintf("%s has quit", nick))
+	case "kick":
+		// the kicked nick is the first word, the reason follows it
+		kicked := strings.SplitN(said, " ", 2)
+		if len(kicked) == 2 {
+			return fmt.Sprintf("%s was kicked by %s (%s)", kicked[0], nick, kicked[1])
+		}
+		return fmt.Sprintf("%s was kicked by %s", said, nick)
+	case "nick":
+		return fmt.Sprintf("%s is now known as %s", nick, said)
+	case "topic":
+		return fmt.Sprintf("%s changed the topic to: %s", nick, said)
+	case "mode":
+		return fmt.Sprintf("%s sets mode %s", nick, said)
+	default:
+		return fmt.Sprintf("<%s> %s", nick, said)
+	}
+}
+
+func (p *PGCustomerRepo) getBoundary(network, nick, channel, order string) (time.Time, error) {
 	direction := "DESC"
 	if order == "first" {
 		direction = "ASC"
@@ -121,11 +260,11 @@ func (p *PGCustomerRepo) getBoundary(nick, channel, order string) (time.Time, er
 	var rows *sql.Rows
 	var err error
 	if nick != "" {
-		query := fmt.Sprintf("SELECT stamp FROM logs WHERE channel=$1 AND nick=$2 ORDER BY stamp %s LIMIT 1", direction)
-		rows, err = p.DbHandler.Query(query, channel, nick)
+		query := fmt.Sprintf("SELECT stamp FROM logs WHERE network=$1 AND channel "+sameChannel+" AND nick=$3 ORDER BY stamp %s LIMIT 1", direction)
+		rows, err = p.DbHandler.Query(query, network, channel, nick)
 	} else {
-		query := fmt.Sprintf("SELECT stamp FROM logs WHERE channel=$1  ORDER BY stamp %s LIMIT 1", direction)
-		rows, err = p.DbHandler.Query(query, channel)
+		query := fmt.Sprintf("SELECT stamp FROM logs WHERE network=$1 AND channel "+sameChannel+" ORDER BY stamp %s LIMIT 1", direction)
+		rows, err = p.DbHandler.Query(query, network, channel)
 	}
 	defer rows.Close()
 	if err != nil {
@@ -139,7 +278,7 @@ func (p *PGCustomerRepo) getBoundary(nick, channel, order string) (time.Time, er
 	}
 	if !f.Valid {
 		// no channel
-		return time.Time{}, fmt.Errorf("channel %s or nick %s does not exist", channel, nick)
+		return time.Time{}, fmt.Errorf("channel %s on %s or nick %s does not exist", channel, network, nick)
 	}
 	return f.Time, nil
 }
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNotOptedOut needs a postgres database, TEST_DBURI, to run the query
+// against. The tables are temporary, so nothing is left in it.
+func TestNotOptedOut(t *testing.T) {
+	dbURI, ok := os.LookupEnv("TEST_DBURI")
+	if !ok {
+		t.Skip("TEST_DBURI is not set")
+	}
+	p, err := NewPGCustomerRepo(dbURI)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer p.DbHandler.Close()
+	// temporary tables belong to the connection that made them
+	p.DbHandler.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		`CREATE TEMPORARY TABLE logs (network TEXT NOT NULL, channel TEXT NOT NULL, nick TEXT NOT NULL, account TEXT NOT NULL DEFAULT '', event TEXT NOT NULL, said TEXT)`,
+		`CREATE TEMPORARY TABLE optouts (network TEXT NOT NULL, kind TEXT NOT NULL, identity TEXT NOT NULL)`,
+		`INSERT INTO optouts VALUES ('fake-network', 'nick', 'opted{out}'), ('fake-network', 'account', 'hidden-account')`,
+		`INSERT INTO logs (network, channel, nick, account, event, said) VALUES
+			('fake-network', '#fake', 'someone', '', 'message', 'stored message'),
+			('fake-network', '#fake', 'Opted[Out]', '', 'message', 'hidden by nick'),
+			('fake-network', '#fake', 'someone', 'Hidden-Account', 'message', 'hidden by account'),
+			('fake-network', '#fake', 'someone', '', 'nick', 'Opted[Out]'),
+			('fake-network', '#fake', 'someone', '', 'nick', 'stored-nick'),
+			('fake-network', '#fake', 'op', '', 'kick', 'OPTED{OUT} spamming'),
+			('fake-network', '#fake', 'op', '', 'kick', 'someone opted{out}'),
+			('fake-network', '#fake', 'someone', '', 'message', 'opted{out}'),
+			('other-network', '#fake', 'op', '', 'kick', 'opted{out}')`,
+	} {
+		if _, err := p.DbHandler.Exec(stmt); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	rows, err := p.DbHandler.Query(`SELECT network, event, said FROM logs WHERE ` + notOptedOut + ` ORDER BY network, event, said`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rows.Close()
+	stored := []string{}
+	for rows.Next() {
+		var network, event, said string
+		if !assert.NoError(t, rows.Scan(&network, &event, &said)) {
+			return
+		}
+		stored = append(stored, network+" "+event+" "+said)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []string{
+		"fake-network kick someone opted{out}",
+		"fake-network message opted{out}",
+		"fake-network message stored message",
+		"fake-network nick stored-nick",
+		"other-network kick opted{out}",
+	}, stored)
+}